@@ -9,14 +9,23 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/avast/retry-go"
+	"go.uber.org/zap"
+
 	"github.com/shahradelahi/cloudflare-warp/cloudflare/model"
 	"github.com/shahradelahi/cloudflare-warp/cloudflare/network"
+	"github.com/shahradelahi/cloudflare-warp/log"
 )
 
 const (
 	apiBase string = "https://api.cloudflareclient.com/v0a1922"
+
+	// defaultTimeout bounds a single API call, including its retries, when the
+	// caller's context has no earlier deadline.
+	defaultTimeout = 30 * time.Second
 )
 
 func defaultHeaders() map[string]string {
@@ -28,34 +37,107 @@ func defaultHeaders() map[string]string {
 }
 
 type WarpAPI struct {
-	client *http.Client
+	client  *http.Client
+	baseURL string
+	timeout time.Duration
+}
+
+type Option func(*WarpAPI)
+
+// WithBaseURL points the client at a different API root, e.g. a warptest server.
+func WithBaseURL(baseURL string) Option {
+	return func(w *WarpAPI) {
+		w.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithHTTPClient replaces the default client, which dials the API through the
+// DPI-evading TLS dialer.
+func WithHTTPClient(client *http.Client) Option {
+	return func(w *WarpAPI) {
+		w.client = client
+	}
 }
 
-func NewWarpAPI() *WarpAPI {
+// WithTimeout sets the deadline applied to every API call.
+func WithTimeout(timeout time.Duration) Option {
+	return func(w *WarpAPI) {
+		w.timeout = timeout
+	}
+}
+
+func NewWarpAPI(options ...Option) *WarpAPI {
 	tlsDialer := network.Dialer{}
 	// Create a custom HTTP transport
 	transport := &http.Transport{
 		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return tlsDialer.TLSDial(network, addr)
+			return tlsDialer.TLSDialContext(ctx, network, addr)
 		},
 	}
 
-	return &WarpAPI{
-		client: &http.Client{Transport: transport},
+	w := &WarpAPI{
+		client:  &http.Client{Transport: transport},
+		baseURL: apiBase,
+		timeout: defaultTimeout,
+	}
+
+	for _, option := range options {
+		option(w)
 	}
+
+	return w
 }
 
-func (w *WarpAPI) request(method, url, authToken string, body interface{}, out interface{}) error {
-	var bodyReader io.Reader
+func (w *WarpAPI) request(ctx context.Context, method, path, authToken string, body interface{}, out interface{}) error {
+	return w.requestWithHeaders(ctx, method, path, authToken, nil, body, out)
+}
+
+func (w *WarpAPI) requestWithHeaders(ctx context.Context, method, path, authToken string, headers map[string]string, body interface{}, out interface{}) error {
+	if w.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.timeout)
+		defer cancel()
+	}
+
+	url := w.baseURL + path
+
+	var jsonBody []byte
 	if body != nil {
-		jsonBody, err := json.Marshal(body)
+		var err error
+		jsonBody, err = json.Marshal(body)
 		if err != nil {
 			return err
 		}
-		bodyReader = bytes.NewBuffer(jsonBody)
 	}
 
-	req, err := http.NewRequest(method, url, bodyReader)
+	if !isIdempotent(method) {
+		return w.do(ctx, method, url, authToken, headers, jsonBody, out)
+	}
+
+	return retry.Do(
+		func() error {
+			return w.do(ctx, method, url, authToken, headers, jsonBody, out)
+		},
+		retry.Context(ctx),
+		retry.Attempts(retryAttempts),
+		retry.Delay(retryDelay),
+		retry.MaxDelay(maxRetryAfter),
+		retry.DelayType(retryDelayType),
+		retry.RetryIf(isRetryable),
+		retry.LastErrorOnly(true),
+		retry.OnRetry(func(n uint, err error) {
+			log.Debugw("Retrying WARP API request", zap.String("method", method), zap.Uint("attempt", n+1), zap.Error(err))
+		}),
+	)
+}
+
+func (w *WarpAPI) do(ctx context.Context, method, url, authToken string, headers map[string]string, jsonBody []byte, out interface{}) error {
+	var bodyReader io.Reader
+	if jsonBody != nil {
+		bodyReader = bytes.NewReader(jsonBody)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
 	if err != nil {
 		return err
 	}
@@ -63,6 +145,9 @@ func (w *WarpAPI) request(method, url, authToken string, body interface{}, out i
 	for k, v := range defaultHeaders() {
 		req.Header.Set(k, v)
 	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 	if authToken != "" {
 		req.Header.Set("Authorization", "Bearer "+authToken)
 	}
@@ -74,7 +159,7 @@ func (w *WarpAPI) request(method, url, authToken string, body interface{}, out i
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("API request failed with status: %s", resp.Status)
+		return parseAPIError(resp)
 	}
 
 	if out != nil {
@@ -84,20 +169,73 @@ func (w *WarpAPI) request(method, url, authToken string, body interface{}, out i
 	return nil
 }
 
-func (w *WarpAPI) GetAccount(authToken, deviceID string) (model.IdentityAccount, error) {
+const (
+	retryAttempts = 4
+	retryDelay    = 500 * time.Millisecond
+	// maxRetryAfter is the longest Retry-After the client is willing to wait
+	// for; anything longer is returned to the caller straight away.
+	maxRetryAfter = 30 * time.Second
+)
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func isRetryable(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return isTransportError(err)
+	}
+	if apiErr.RetryAfter > maxRetryAfter {
+		return false
+	}
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrServerError)
+}
+
+// isTransportError reports whether err is a network failure worth another
+// attempt, such as a refused connection, a reset or a truncated response,
+// as opposed to an invalid request or response body.
+func isTransportError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func retryDelayType(n uint, err error, config *retry.Config) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter
+	}
+	return retry.BackOffDelay(n, err, config)
+}
+
+func (w *WarpAPI) GetAccount(ctx context.Context, authToken, deviceID string) (model.IdentityAccount, error) {
 	var rspData model.IdentityAccount
-	err := w.request("GET", fmt.Sprintf("%s/reg/%s/account", apiBase, deviceID), authToken, nil, &rspData)
+	err := w.request(ctx, "GET", fmt.Sprintf("/reg/%s/account", deviceID), authToken, nil, &rspData)
 	return rspData, err
 }
 
-func (w *WarpAPI) GetBoundDevices(authToken, deviceID string) ([]model.IdentityDevice, error) {
+func (w *WarpAPI) GetBoundDevices(ctx context.Context, authToken, deviceID string) ([]model.IdentityDevice, error) {
 	var rspData []model.IdentityDevice
-	err := w.request("GET", fmt.Sprintf("%s/reg/%s/account/devices", apiBase, deviceID), authToken, nil, &rspData)
+	err := w.request(ctx, "GET", fmt.Sprintf("/reg/%s/account/devices", deviceID), authToken, nil, &rspData)
 	return rspData, err
 }
 
-func (w *WarpAPI) GetSourceBoundDevice(authToken, deviceID string) (*model.IdentityDevice, error) {
-	devices, err := w.GetBoundDevices(authToken, deviceID)
+func (w *WarpAPI) GetSourceBoundDevice(ctx context.Context, authToken, deviceID string) (*model.IdentityDevice, error) {
+	devices, err := w.GetBoundDevices(ctx, authToken, deviceID)
 	if err != nil {
 		return nil, err
 	}
@@ -111,13 +249,23 @@ func (w *WarpAPI) GetSourceBoundDevice(authToken, deviceID string) (*model.Ident
 	return nil, errors.New("no matching bound device found")
 }
 
-func (w *WarpAPI) GetSourceDevice(authToken, deviceID string) (model.Identity, error) {
+func (w *WarpAPI) GetSourceDevice(ctx context.Context, authToken, deviceID string) (model.Identity, error) {
 	var rspData model.Identity
-	err := w.request("GET", fmt.Sprintf("%s/reg/%s", apiBase, deviceID), authToken, nil, &rspData)
+	err := w.request(ctx, "GET", fmt.Sprintf("/reg/%s", deviceID), authToken, nil, &rspData)
 	return rspData, err
 }
 
-func (w *WarpAPI) Register(publicKey string) (model.Identity, error) {
+func (w *WarpAPI) Register(ctx context.Context, publicKey string) (model.Identity, error) {
+	return w.register(ctx, publicKey, nil)
+}
+
+// RegisterTeam enrolls a device into a Cloudflare Zero Trust organization
+// using the Access JWT obtained from the organization's enrollment page.
+func (w *WarpAPI) RegisterTeam(ctx context.Context, publicKey, token string) (model.Identity, error) {
+	return w.register(ctx, publicKey, map[string]string{"CF-Access-Jwt-Assertion": token})
+}
+
+func (w *WarpAPI) register(ctx context.Context, publicKey string, headers map[string]string) (model.Identity, error) {
 	data := map[string]interface{}{
 		"install_id":   "",
 		"fcm_token":    "",
@@ -130,39 +278,39 @@ func (w *WarpAPI) Register(publicKey string) (model.Identity, error) {
 	}
 
 	var rspData model.Identity
-	err := w.request("POST", fmt.Sprintf("%s/reg", apiBase), "", data, &rspData)
+	err := w.requestWithHeaders(ctx, "POST", "/reg", "", headers, data, &rspData)
 	return rspData, err
 }
 
-func (w *WarpAPI) ResetAccountLicense(authToken, deviceID string) (model.License, error) {
+func (w *WarpAPI) ResetAccountLicense(ctx context.Context, authToken, deviceID string) (model.License, error) {
 	var rspData model.License
-	err := w.request("POST", fmt.Sprintf("%s/reg/%s/account/license", apiBase, deviceID), authToken, nil, &rspData)
+	err := w.request(ctx, "POST", fmt.Sprintf("/reg/%s/account/license", deviceID), authToken, nil, &rspData)
 	return rspData, err
 }
 
-func (w *WarpAPI) UpdateAccount(authToken, deviceID, license string) (model.IdentityAccount, error) {
+func (w *WarpAPI) UpdateAccount(ctx context.Context, authToken, deviceID, license string) (model.IdentityAccount, error) {
 	var rspData model.IdentityAccount
-	err := w.request("PUT", fmt.Sprintf("%s/reg/%s/account", apiBase, deviceID), authToken, map[string]interface{}{"license": license}, &rspData)
+	err := w.request(ctx, "PUT", fmt.Sprintf("/reg/%s/account", deviceID), authToken, map[string]interface{}{"license": license}, &rspData)
 	return rspData, err
 }
 
-func (w *WarpAPI) UpdateBoundDevice(authToken, deviceID, otherDeviceID, name string, active bool) (model.IdentityDevice, error) {
+func (w *WarpAPI) UpdateBoundDevice(ctx context.Context, authToken, deviceID, otherDeviceID, name string, active bool) (model.IdentityDevice, error) {
 	data := map[string]interface{}{
 		"active": active,
 		"name":   name,
 	}
 
 	var rspData model.IdentityDevice
-	err := w.request("PATCH", fmt.Sprintf("%s/reg/%s/account/devices/%s", apiBase, deviceID, otherDeviceID), authToken, data, &rspData)
+	err := w.request(ctx, "PATCH", fmt.Sprintf("/reg/%s/account/devices/%s", deviceID, otherDeviceID), authToken, data, &rspData)
 	return rspData, err
 }
 
-func (w *WarpAPI) UpdateSourceDevice(authToken, deviceID string, data map[string]interface{}) (model.Identity, error) {
+func (w *WarpAPI) UpdateSourceDevice(ctx context.Context, authToken, deviceID string, data map[string]interface{}) (model.Identity, error) {
 	var rspData model.Identity
-	err := w.request("PATCH", fmt.Sprintf("%s/reg/%s", apiBase, deviceID), authToken, data, &rspData)
+	err := w.request(ctx, "PATCH", fmt.Sprintf("/reg/%s", deviceID), authToken, data, &rspData)
 	return rspData, err
 }
 
-func (w *WarpAPI) DeleteDevice(authToken, deviceID string) error {
-	return w.request("DELETE", fmt.Sprintf("%s/reg/%s", apiBase, deviceID), authToken, nil, nil)
+func (w *WarpAPI) DeleteDevice(ctx context.Context, authToken, deviceID string) error {
+	return w.request(ctx, "DELETE", fmt.Sprintf("/reg/%s", deviceID), authToken, nil, nil)
 }
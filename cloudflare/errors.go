@@ -0,0 +1,125 @@
+package cloudflare
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sentinel errors describing why the WARP API rejected a request. They are
+// matched with errors.Is against the *APIError returned by WarpAPI methods.
+var (
+	ErrUnauthorized   = errors.New("device token rejected")
+	ErrNotFound       = errors.New("registration not found")
+	ErrTooManyDevices = errors.New("too many devices bound to the account")
+	ErrInvalidLicense = errors.New("invalid license key")
+	ErrRateLimited    = errors.New("rate limited")
+	ErrServerError    = errors.New("server error")
+)
+
+// APIError is returned for every non-2xx response from the WARP API.
+type APIError struct {
+	StatusCode int
+	Code       int
+	Message    string
+	// RetryAfter is the delay requested by the server with the Retry-After
+	// header, or zero if none was sent.
+	RetryAfter time.Duration
+
+	kind error
+}
+
+func (e *APIError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	if e.Code != 0 {
+		return fmt.Sprintf("API request failed with status %d: %s (code %d)", e.StatusCode, msg, e.Code)
+	}
+	return fmt.Sprintf("API request failed with status %d: %s", e.StatusCode, msg)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.kind
+}
+
+// apiErrorBody is the error envelope used by the Cloudflare API.
+type apiErrorBody struct {
+	Errors []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// maxErrorBodySize caps how much of an error response is read.
+const maxErrorBodySize = 64 << 10
+
+func parseAPIError(resp *http.Response) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+
+	var body apiErrorBody
+	if err := json.Unmarshal(data, &body); err == nil && len(body.Errors) > 0 {
+		apiErr.Code = body.Errors[0].Code
+		apiErr.Message = body.Errors[0].Message
+	} else if text := strings.TrimSpace(string(data)); text != "" && !strings.HasPrefix(text, "<") {
+		apiErr.Message = text
+	}
+
+	apiErr.kind = classifyAPIError(apiErr)
+	return apiErr
+}
+
+func classifyAPIError(e *APIError) error {
+	switch {
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.StatusCode >= 500:
+		return ErrServerError
+	case e.StatusCode < 400:
+		return nil
+	}
+
+	// The API answers license and device limit errors with various 4xx
+	// statuses, so only the message tells them apart.
+	msg := strings.ToLower(e.Message)
+	switch {
+	case strings.Contains(msg, "license"):
+		return ErrInvalidLicense
+	case strings.Contains(msg, "too many") && strings.Contains(msg, "device"):
+		return ErrTooManyDevices
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return ErrUnauthorized
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	}
+	return nil
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as
+// an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
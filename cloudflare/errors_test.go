@@ -0,0 +1,141 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func errorResponse(status int, body string, header http.Header) *http.Response {
+	rec := httptest.NewRecorder()
+	for k, v := range header {
+		rec.Header()[k] = v
+	}
+	rec.WriteHeader(status)
+	rec.WriteString(body)
+	return rec.Result()
+}
+
+func TestParseAPIError(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		kind    error
+		code    int
+		message string
+	}{
+		{
+			name:    "invalid license",
+			status:  http.StatusBadRequest,
+			body:    `{"result":null,"success":false,"errors":[{"code":1000,"message":"Invalid license"}],"messages":[]}`,
+			kind:    ErrInvalidLicense,
+			code:    1000,
+			message: "Invalid license",
+		},
+		{
+			name:    "too many devices",
+			status:  http.StatusForbidden,
+			body:    `{"success":false,"errors":[{"code":1001,"message":"Too many connected devices."}]}`,
+			kind:    ErrTooManyDevices,
+			code:    1001,
+			message: "Too many connected devices.",
+		},
+		{
+			name:   "revoked token",
+			status: http.StatusUnauthorized,
+			body:   `{"success":false,"errors":[{"code":10000,"message":"Authentication error"}]}`,
+			kind:   ErrUnauthorized,
+			code:   10000,
+		},
+		{
+			name:   "missing registration",
+			status: http.StatusNotFound,
+			body:   ``,
+			kind:   ErrNotFound,
+		},
+		{
+			name:    "server error with plain body",
+			status:  http.StatusBadGateway,
+			body:    "upstream unavailable",
+			kind:    ErrServerError,
+			message: "upstream unavailable",
+		},
+		{
+			name:    "server error mentioning a license",
+			status:  http.StatusServiceUnavailable,
+			body:    `{"success":false,"errors":[{"code":1,"message":"License service unavailable"}]}`,
+			kind:    ErrServerError,
+			code:    1,
+			message: "License service unavailable",
+		},
+		{
+			name:   "rate limit mentioning devices",
+			status: http.StatusTooManyRequests,
+			body:   `{"success":false,"errors":[{"code":2,"message":"Too many requests from this device"}]}`,
+			kind:   ErrRateLimited,
+			code:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiErr := parseAPIError(errorResponse(tt.status, tt.body, nil))
+			assert.Equal(t, tt.status, apiErr.StatusCode)
+			assert.True(t, errors.Is(apiErr, tt.kind), "expected %v, got %v", tt.kind, apiErr.Unwrap())
+			assert.Equal(t, tt.code, apiErr.Code)
+			if tt.message != "" {
+				assert.Equal(t, tt.message, apiErr.Message)
+			}
+		})
+	}
+}
+
+func TestParseAPIErrorRateLimited(t *testing.T) {
+	apiErr := parseAPIError(errorResponse(http.StatusTooManyRequests, "", http.Header{"Retry-After": {"7"}}))
+	assert.True(t, errors.Is(apiErr, ErrRateLimited))
+	assert.Equal(t, 7*time.Second, apiErr.RetryAfter)
+	assert.True(t, isRetryable(apiErr))
+
+	apiErr = parseAPIError(errorResponse(http.StatusTooManyRequests, "", http.Header{"Retry-After": {"3600"}}))
+	assert.False(t, isRetryable(apiErr), "Retry-After beyond maxRetryAfter should not be retried")
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", &APIError{StatusCode: http.StatusBadGateway, kind: ErrServerError}, true},
+		{"invalid license", &APIError{StatusCode: http.StatusBadRequest, kind: ErrInvalidLicense}, false},
+		{"connection refused", &url.Error{Op: "Get", URL: "https://api", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, true},
+		{"truncated response", io.ErrUnexpectedEOF, true},
+		{"invalid JSON", &json.SyntaxError{}, false},
+		{"invalid request", &url.Error{Op: "Get", URL: "::", Err: errors.New("unsupported protocol scheme")}, false},
+		{"canceled", &url.Error{Op: "Get", URL: "https://api", Err: context.Canceled}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isRetryable(tt.err))
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, 12*time.Second, parseRetryAfter("12", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("not a date", now))
+}
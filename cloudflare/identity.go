@@ -1,8 +1,10 @@
 package cloudflare
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 
 	"go.uber.org/zap"
@@ -12,15 +14,17 @@ import (
 	"github.com/shahradelahi/cloudflare-warp/log"
 )
 
-func CreateOrUpdateIdentity(license string) (*model.Identity, error) {
-	warpAPI := NewWarpAPI()
+// ErrNoPeers is returned when an identity's WireGuard config has no peer,
+// usually because the identity files are incomplete.
+var ErrNoPeers = errors.New("identity contains 0 peers")
 
+func CreateOrUpdateIdentity(ctx context.Context, warpAPI *WarpAPI, license string) (*model.Identity, error) {
 	identity, err := LoadIdentity()
 	if err != nil {
 		log.Warnw("Failed to load existing WARP identity; attempting to create a new one", zap.Error(err))
 
 		log.Info("Initiating creation of a new WARP identity...")
-		newIdentity, err := CreateIdentity(warpAPI, license)
+		newIdentity, err := CreateIdentity(ctx, warpAPI, license)
 		if err != nil {
 			return nil, err
 		}
@@ -29,12 +33,12 @@ func CreateOrUpdateIdentity(license string) (*model.Identity, error) {
 
 	if license != "" && identity.Account.License != license {
 		log.Info("Attempting to update WARP account license key...")
-		_, err := warpAPI.UpdateAccount(identity.Token, identity.ID, license)
+		_, err := warpAPI.UpdateAccount(ctx, identity.Token, identity.ID, license)
 		if err != nil {
 			return nil, err
 		}
 
-		iAcc, err := warpAPI.GetAccount(identity.Token, identity.ID)
+		iAcc, err := warpAPI.GetAccount(ctx, identity.Token, identity.ID)
 		if err != nil {
 			return nil, err
 		}
@@ -44,8 +48,8 @@ func CreateOrUpdateIdentity(license string) (*model.Identity, error) {
 	return identity, nil
 }
 
-func LoadOrCreateIdentity() (*model.Identity, error) {
-	identity, err := CreateOrUpdateIdentity("")
+func LoadOrCreateIdentity(ctx context.Context, warpAPI *WarpAPI) (*model.Identity, error) {
+	identity, err := CreateOrUpdateIdentity(ctx, warpAPI, "")
 	if err != nil {
 		return nil, err
 	}
@@ -98,13 +102,13 @@ func LoadIdentity() (*model.Identity, error) {
 	}
 
 	if len(identity.Config.Peers) < 1 {
-		return nil, errors.New("identity contains 0 peers")
+		return nil, ErrNoPeers
 	}
 
 	return &identity, nil
 }
 
-func CreateIdentity(warpAPI *WarpAPI, license string) (model.Identity, error) {
+func CreateIdentity(ctx context.Context, warpAPI *WarpAPI, license string) (model.Identity, error) {
 	priv, err := crypto.GeneratePrivateKey()
 	if err != nil {
 		return model.Identity{}, err
@@ -112,19 +116,19 @@ func CreateIdentity(warpAPI *WarpAPI, license string) (model.Identity, error) {
 
 	privateKey, publicKey := priv.String(), priv.PublicKey().String()
 
-	i, err := warpAPI.Register(publicKey)
+	i, err := warpAPI.Register(ctx, publicKey)
 	if err != nil {
 		return model.Identity{}, err
 	}
 
 	if license != "" {
 		log.Info("Attempting to update WARP account license key...")
-		_, err := warpAPI.UpdateAccount(i.Token, i.ID, license)
+		_, err := warpAPI.UpdateAccount(ctx, i.Token, i.ID, license)
 		if err != nil {
 			return model.Identity{}, err
 		}
 
-		ac, err := warpAPI.GetAccount(i.Token, i.ID)
+		ac, err := warpAPI.GetAccount(ctx, i.Token, i.ID)
 		if err != nil {
 			return model.Identity{}, err
 		}
@@ -136,3 +140,40 @@ func CreateIdentity(warpAPI *WarpAPI, license string) (model.Identity, error) {
 
 	return i, nil
 }
+
+// RotateKey replaces the WireGuard key of an existing registration. A fresh
+// private key is generated, its public half is sent to the API, and the local
+// identity files are only rewritten once the API has returned a usable config.
+func RotateKey(ctx context.Context, warpAPI *WarpAPI, identity *model.Identity) (*model.Identity, error) {
+	priv, err := crypto.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, publicKey := priv.String(), priv.PublicKey().String()
+
+	log.Info("Updating WARP registration with a new public key...")
+	i, err := warpAPI.UpdateSourceDevice(ctx, identity.Token, identity.ID, map[string]interface{}{"key": publicKey})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update registration key: %w", err)
+	}
+
+	if i.Key != "" && i.Key != publicKey {
+		return nil, errors.New("registration did not accept the new public key")
+	}
+	if len(i.Config.Peers) < 1 {
+		return nil, errors.New("registration returned a config with 0 peers")
+	}
+
+	rotated := *identity
+	rotated.PrivateKey = privateKey
+	rotated.Key = publicKey
+	rotated.Config = i.Config
+
+	if err := rotated.SaveIdentity(); err != nil {
+		return nil, fmt.Errorf("key was rotated on the server but saving it failed; the identity on disk may be stale: %w", err)
+	}
+
+	log.Infow("WARP key rotated successfully", zap.String("public_key", publicKey))
+	return &rotated, nil
+}
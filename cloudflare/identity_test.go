@@ -1,12 +1,18 @@
 package cloudflare
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/shahradelahi/cloudflare-warp/cloudflare/model"
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/warptest"
 	"github.com/shahradelahi/cloudflare-warp/core/datadir"
 )
 
@@ -27,7 +33,7 @@ func TestLoadOrCreateIdentity(t *testing.T) {
 	// Test creating a new identity with the provided license key
 	// Using a real license key makes this an integration test.
 	licenseKey := "5m3o6Qq4-495D2Kpk-egrG8326"
-	identity, err := CreateOrUpdateIdentity(licenseKey)
+	identity, err := CreateOrUpdateIdentity(context.Background(), NewWarpAPI(), licenseKey)
 	assert.NoError(t, err)
 	assert.NotNil(t, identity)
 	assert.NotEmpty(t, identity.ID, "Identity ID should not be empty")
@@ -52,3 +58,163 @@ func TestLoadOrCreateIdentity(t *testing.T) {
 	assert.Equal(t, identity.Token, loadedIdentity.Token)
 	assert.Equal(t, identity.Account.License, loadedIdentity.Account.License)
 }
+
+func newTestAPI(t *testing.T) (*WarpAPI, *warptest.Server) {
+	srv := warptest.NewServer()
+	t.Cleanup(srv.Close)
+
+	datadir.SetDataDir(t.TempDir())
+
+	return NewWarpAPI(WithBaseURL(srv.URL), WithHTTPClient(srv.Client())), srv
+}
+
+func TestCreateOrUpdateIdentityOffline(t *testing.T) {
+	warpAPI, srv := newTestAPI(t)
+	ctx := context.Background()
+
+	srv.AddLicense("AAAAAAAA-BBBBBBBB-CCCCCCCC", 1<<30)
+
+	identity, err := LoadOrCreateIdentity(ctx, warpAPI)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, identity.ID)
+	assert.NotEmpty(t, identity.Token)
+	assert.False(t, identity.Account.WarpPlus)
+
+	_, ok := srv.Registration(identity.ID)
+	assert.True(t, ok, "registration should exist on the server")
+
+	updated, err := CreateOrUpdateIdentity(ctx, warpAPI, "AAAAAAAA-BBBBBBBB-CCCCCCCC")
+	assert.NoError(t, err)
+	assert.Equal(t, identity.ID, updated.ID, "updating the license should keep the registration")
+	assert.True(t, updated.Account.WarpPlus)
+	assert.Equal(t, int64(1<<30), updated.Account.PremiumData)
+
+	_, err = CreateOrUpdateIdentity(ctx, warpAPI, "00000000-00000000-00000000")
+	assert.ErrorIs(t, err, ErrInvalidLicense)
+
+	loaded, err := LoadIdentity()
+	assert.NoError(t, err)
+	assert.Equal(t, identity.ID, loaded.ID)
+	assert.Equal(t, identity.PrivateKey, loaded.PrivateKey)
+}
+
+func TestLoadIdentityNoPeers(t *testing.T) {
+	datadir.SetDataDir(t.TempDir())
+	assert.NoError(t, os.WriteFile(model.GetRegPath(), []byte(`{"registration_id":"id","api_token":"token"}`), 0600))
+	assert.NoError(t, os.WriteFile(model.GetConfPath(), []byte(`{"config":{"peers":[]}}`), 0600))
+
+	_, err := LoadIdentity()
+	assert.ErrorIs(t, err, ErrNoPeers)
+}
+
+func TestRotateKey(t *testing.T) {
+	warpAPI, srv := newTestAPI(t)
+	ctx := context.Background()
+
+	identity, err := LoadOrCreateIdentity(ctx, warpAPI)
+	assert.NoError(t, err)
+
+	rotated, err := RotateKey(ctx, warpAPI, identity)
+	assert.NoError(t, err)
+	assert.Equal(t, identity.ID, rotated.ID)
+	assert.NotEqual(t, identity.PrivateKey, rotated.PrivateKey)
+
+	reg, _ := srv.Registration(identity.ID)
+	assert.Equal(t, rotated.Key, reg.Key, "server should hold the new public key")
+
+	loaded, err := LoadIdentity()
+	assert.NoError(t, err)
+	assert.Equal(t, rotated.PrivateKey, loaded.PrivateKey, "reg.json should hold the new private key")
+}
+
+func TestRotateKeySaveFailure(t *testing.T) {
+	warpAPI, srv := newTestAPI(t)
+	ctx := context.Background()
+
+	identity, err := LoadOrCreateIdentity(ctx, warpAPI)
+	assert.NoError(t, err)
+
+	// A directory in place of reg.json makes the last write fail.
+	assert.NoError(t, os.Remove(model.GetRegPath()))
+	assert.NoError(t, os.MkdirAll(filepath.Join(model.GetRegPath(), "blocked"), 0700))
+
+	_, err = RotateKey(ctx, warpAPI, identity)
+	assert.ErrorContains(t, err, "the identity on disk may be stale")
+
+	reg, _ := srv.Registration(identity.ID)
+	assert.NotEqual(t, identity.Key, reg.Key, "the server already holds the new key")
+}
+
+func TestRequestRetries(t *testing.T) {
+	warpAPI, srv := newTestAPI(t)
+	ctx := context.Background()
+
+	identity, err := LoadOrCreateIdentity(ctx, warpAPI)
+	assert.NoError(t, err)
+
+	srv.FailNext(http.StatusServiceUnavailable, 2)
+	_, err = warpAPI.GetAccount(ctx, identity.Token, identity.ID)
+	assert.NoError(t, err, "idempotent requests should be retried on 5xx")
+
+	srv.FailNext(http.StatusServiceUnavailable, 1)
+	_, err = warpAPI.UpdateSourceDevice(ctx, identity.Token, identity.ID, map[string]interface{}{"name": "test"})
+	assert.ErrorIs(t, err, ErrServerError, "non-idempotent requests should not be retried")
+
+	_, err = warpAPI.GetAccount(ctx, "bogus", identity.ID)
+	assert.ErrorIs(t, err, ErrUnauthorized)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	warpAPI := NewWarpAPI(WithBaseURL(srv.URL), WithHTTPClient(srv.Client()), WithTimeout(100*time.Millisecond))
+
+	start := time.Now()
+	_, err := warpAPI.GetAccount(context.Background(), "token", "id")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestCreateTeamIdentity(t *testing.T) {
+	warpAPI, _ := newTestAPI(t)
+
+	token := warptest.TeamToken("acme")
+	team, err := TeamFromToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", team)
+
+	identity, err := CreateTeamIdentity(context.Background(), warpAPI, team, token)
+	assert.NoError(t, err)
+	assert.Equal(t, "team", identity.Account.AccountType)
+	assert.Equal(t, "acme", identity.Account.Organization)
+	assert.Equal(t, "100.96.0.2", identity.Config.Interface.Addresses.V4)
+
+	assert.NoError(t, identity.SaveIdentity())
+	loaded, err := LoadIdentity()
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", loaded.Account.Organization)
+	assert.Equal(t, identity.Config.Interface.Addresses, loaded.Config.Interface.Addresses)
+
+	_, err = CreateTeamIdentity(context.Background(), warpAPI, "acme", "not.a.token")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+}
+
+func TestParseTeamToken(t *testing.T) {
+	token := warptest.TeamToken("acme")
+
+	parsed, err := ParseTeamToken("  " + token + "\n")
+	assert.NoError(t, err)
+	assert.Equal(t, token, parsed)
+
+	parsed, err = ParseTeamToken("com.cloudflare.warp://acme.cloudflareaccess.com/auth?token=" + token)
+	assert.NoError(t, err)
+	assert.Equal(t, token, parsed)
+
+	_, err = ParseTeamToken("garbage")
+	assert.Error(t, err)
+
+	assert.Equal(t, "https://acme.cloudflareaccess.com/warp", TeamEnrollURL("acme"))
+}
@@ -14,6 +14,7 @@ type IdentityAccount struct {
 	Usage                    int64  `json:"usage"`
 	ReferralCount            int64  `json:"referral_count"`
 	TTL                      string `json:"ttl"`
+	Organization             string `json:"organization,omitempty"`
 }
 
 type License struct {
@@ -1,5 +1,10 @@
 package model
 
+import (
+	"encoding/base64"
+	"fmt"
+)
+
 type IdentityConfigPeerEndpoint struct {
 	V4    string   `json:"v4"`
 	V6    string   `json:"v6"`
@@ -64,3 +69,19 @@ type IdentityDevice struct {
 	Active    bool   `json:"active"`
 	Role      string `json:"role"`
 }
+
+// Reserved decodes ClientID into the three bytes WARP expects in the reserved
+// field of WireGuard message headers.
+func (c *IdentityConfig) Reserved() ([]byte, error) {
+	if c.ClientID == "" {
+		return nil, fmt.Errorf("identity has no client_id")
+	}
+	b, err := base64.StdEncoding.DecodeString(c.ClientID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client_id: %w", err)
+	}
+	if len(b) != 3 {
+		return nil, fmt.Errorf("invalid client_id: expected 3 bytes, got %d", len(b))
+	}
+	return b, nil
+}
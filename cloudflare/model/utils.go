@@ -2,10 +2,10 @@ package model
 
 import (
 	"encoding/json"
-	"os"
 	"path/filepath"
 
 	"github.com/shahradelahi/cloudflare-warp/core/datadir"
+	"github.com/shahradelahi/cloudflare-warp/utils"
 )
 
 func GetRegPath() string {
@@ -16,34 +16,27 @@ func GetConfPath() string {
 	return filepath.Join(datadir.GetDataDir(), "conf.json")
 }
 
+// SaveIdentity writes conf.json, then reg.json. The private key in reg.json is
+// written last so that it only changes once the config it belongs to is saved.
 func (a *Identity) SaveIdentity() error {
-
-	regPath := GetRegPath()
-	confPath := GetConfPath()
-
-	// Save reg.json
-	regFileContent := RegFile{
+	regData, err := json.MarshalIndent(RegFile{
 		RegistrationID: a.ID,
 		Token:          a.Token,
 		PrivateKey:     a.PrivateKey,
-	}
-	regData, err := json.MarshalIndent(regFileContent, "", "  ")
+	}, "", "  ")
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(regPath, regData, 0600); err != nil {
-		return err
-	}
-
-	// Save conf.json
-	confFileContent := ConfFile{
+	confData, err := json.MarshalIndent(ConfFile{
 		Account: a.Account,
 		Config:  a.Config,
-	}
-	confData, err := json.MarshalIndent(confFileContent, "", "  ")
+	}, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(confPath, confData, 0600)
+	if err := utils.WriteFileAtomic(GetConfPath(), confData, 0600); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(GetRegPath(), regData, 0600)
 }
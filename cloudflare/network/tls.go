@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -106,14 +107,14 @@ func spec(sni string) *tls.ClientHelloSpec {
 	}
 }
 
-func makeTLSHelloPacketWithSNICurve(plainConn net.Conn, config *tls.Config, sni string) (*tls.UConn, error) {
+func makeTLSHelloPacketWithSNICurve(ctx context.Context, plainConn net.Conn, config *tls.Config, sni string) (*tls.UConn, error) {
 	utlsConn := tls.UClient(plainConn, config, tls.HelloCustom)
 	err := utlsConn.ApplyPreset(spec(sni))
 	if err != nil {
 		return nil, fmt.Errorf("uTlsConn.Handshake() error: %w", err)
 	}
 
-	err = utlsConn.Handshake()
+	err = utlsConn.HandshakeContext(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("uTlsConn.Handshake() error: %w", err)
 	}
@@ -121,13 +122,13 @@ func makeTLSHelloPacketWithSNICurve(plainConn net.Conn, config *tls.Config, sni
 	return utlsConn, nil
 }
 
-func dialCurve(network string, ip netip.Addr, sni string) (net.Conn, error) {
+func dialCurve(ctx context.Context, network string, ip netip.Addr, sni string) (net.Conn, error) {
 	plainDialer := &net.Dialer{
 		Timeout:   5 * time.Second,
 		KeepAlive: 5 * time.Second,
 	}
 
-	plainConn, err := plainDialer.Dial(network, netip.AddrPortFrom(ip, 443).String())
+	plainConn, err := plainDialer.DialContext(ctx, network, netip.AddrPortFrom(ip, 443).String())
 	if err != nil {
 		return nil, err
 	}
@@ -138,7 +139,7 @@ func dialCurve(network string, ip netip.Addr, sni string) (net.Conn, error) {
 		RootCAs:    certpool.Roots(),
 	}
 
-	tlsConn, handshakeErr := makeTLSHelloPacketWithSNICurve(plainConn, &config, sni)
+	tlsConn, handshakeErr := makeTLSHelloPacketWithSNICurve(ctx, plainConn, &config, sni)
 	if handshakeErr != nil {
 		_ = plainConn.Close()
 		return nil, handshakeErr
@@ -146,13 +147,13 @@ func dialCurve(network string, ip netip.Addr, sni string) (net.Conn, error) {
 	return tlsConn, nil
 }
 
-func dial2(network string, ip netip.Addr, sni string) (net.Conn, error) {
+func dial2(ctx context.Context, network string, ip netip.Addr, sni string) (net.Conn, error) {
 	plainDialer := &net.Dialer{
 		Timeout:   5 * time.Second,
 		KeepAlive: 5 * time.Second,
 	}
 
-	plainConn, err := plainDialer.Dial(network, netip.AddrPortFrom(ip, 443).String())
+	plainConn, err := plainDialer.DialContext(ctx, network, netip.AddrPortFrom(ip, 443).String())
 	if err != nil {
 		return nil, err
 	}
@@ -164,7 +165,7 @@ func dial2(network string, ip netip.Addr, sni string) (net.Conn, error) {
 	}
 
 	tlsConn := tls.Client(plainConn, &tlsConfig)
-	err = tlsConn.Handshake()
+	err = tlsConn.HandshakeContext(ctx)
 	if err != nil {
 		_ = plainConn.Close()
 		return nil, err
@@ -172,13 +173,13 @@ func dial2(network string, ip netip.Addr, sni string) (net.Conn, error) {
 
 	return tlsConn, nil
 }
-func dial3(network string, ip netip.Addr, sni string) (net.Conn, error) {
+func dial3(ctx context.Context, network string, ip netip.Addr, sni string) (net.Conn, error) {
 	plainDialer := &net.Dialer{
 		Timeout:   5 * time.Second,
 		KeepAlive: 5 * time.Second,
 	}
 
-	plainConn, err := plainDialer.Dial(network, netip.AddrPortFrom(ip, 443).String())
+	plainConn, err := plainDialer.DialContext(ctx, network, netip.AddrPortFrom(ip, 443).String())
 	if err != nil {
 		return nil, err
 	}
@@ -190,7 +191,7 @@ func dial3(network string, ip netip.Addr, sni string) (net.Conn, error) {
 	}
 
 	tlsConn := tls.UClient(plainConn, &tlsConfig, tls.HelloChrome_Auto)
-	err = tlsConn.Handshake()
+	err = tlsConn.HandshakeContext(ctx)
 	if err != nil {
 		_ = plainConn.Close()
 		return nil, err
@@ -201,6 +202,12 @@ func dial3(network string, ip netip.Addr, sni string) (net.Conn, error) {
 
 // TLSDial dials a TLS connection.
 func (d *Dialer) TLSDial(network, addr string) (net.Conn, error) {
+	return d.TLSDialContext(context.Background(), network, addr)
+}
+
+// TLSDialContext dials a TLS connection. ctx bounds the connection and the
+// TLS handshake of every attempt.
+func (d *Dialer) TLSDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	sni, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
@@ -215,9 +222,10 @@ func (d *Dialer) TLSDial(network, addr string) (net.Conn, error) {
 	log.Debugw("Attempting TLS dial with fingerprint 1 (SNICurve)", zap.String("target_address", addr))
 	err = retry.Do(
 		func() error {
-			tlsConn, err = dialCurve(network, ip, sni)
+			tlsConn, err = dialCurve(ctx, network, ip, sni)
 			return err
 		},
+		retry.Context(ctx),
 		retry.Attempts(3),
 		retry.Delay(250*time.Millisecond),
 		retry.DelayType(retry.FixedDelay),
@@ -230,9 +238,10 @@ func (d *Dialer) TLSDial(network, addr string) (net.Conn, error) {
 		log.Debugw("Attempting TLS dial with fingerprint 2 (TLS 1.3 default)", zap.String("target_address", addr))
 		err = retry.Do(
 			func() error {
-				tlsConn, err = dial2(network, ip, sni)
+				tlsConn, err = dial2(ctx, network, ip, sni)
 				return err
 			},
+			retry.Context(ctx),
 			retry.Attempts(3),
 			retry.Delay(250*time.Millisecond),
 			retry.DelayType(retry.FixedDelay),
@@ -246,9 +255,10 @@ func (d *Dialer) TLSDial(network, addr string) (net.Conn, error) {
 		log.Debugw("Attempting TLS dial with fingerprint 3 (Chrome Auto)", zap.String("target_address", addr))
 		err = retry.Do(
 			func() error {
-				tlsConn, err = dial3(network, ip, sni)
+				tlsConn, err = dial3(ctx, network, ip, sni)
 				return err
 			},
+			retry.Context(ctx),
 			retry.Attempts(3),
 			retry.Delay(250*time.Millisecond),
 			retry.DelayType(retry.FixedDelay),
@@ -258,5 +268,8 @@ func (d *Dialer) TLSDial(network, addr string) (net.Conn, error) {
 		)
 	}
 
+	if err != nil {
+		return nil, err
+	}
 	return tlsConn, nil
 }
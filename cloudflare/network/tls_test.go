@@ -0,0 +1,21 @@
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSDialContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var d Dialer
+	start := time.Now()
+	conn, err := d.TLSDialContext(ctx, "tcp", "api.cloudflareclient.com:443")
+	assert.Error(t, err)
+	assert.Nil(t, conn)
+	assert.Less(t, time.Since(start), time.Second, "a canceled dial should not be retried")
+}
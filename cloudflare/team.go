@@ -0,0 +1,98 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/crypto"
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/model"
+	"github.com/shahradelahi/cloudflare-warp/log"
+)
+
+const teamDomainSuffix = ".cloudflareaccess.com"
+
+// TeamEnrollURL returns the page where a user of the given Zero Trust
+// organization signs in to obtain an enrollment token.
+func TeamEnrollURL(team string) string {
+	return "https://" + team + teamDomainSuffix + "/warp"
+}
+
+// ParseTeamToken extracts the Access JWT from user input, which may be the raw
+// token or the "com.cloudflare.warp://...?token=" link shown after signing in.
+func ParseTeamToken(input string) (string, error) {
+	input = strings.TrimSpace(input)
+	if strings.Contains(input, "token=") {
+		u, err := url.Parse(input)
+		if err != nil {
+			return "", fmt.Errorf("invalid enrollment link: %w", err)
+		}
+		input = u.Query().Get("token")
+	}
+
+	if strings.Count(input, ".") != 2 {
+		return "", errors.New("team token is not a valid JWT")
+	}
+	return input, nil
+}
+
+// TeamFromToken returns the organization name from the issuer of an Access
+// JWT. The token signature is not verified; Cloudflare does that on enrollment.
+func TeamFromToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("team token is not a valid JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode team token: %w", err)
+	}
+
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("failed to decode team token: %w", err)
+	}
+
+	u, err := url.Parse(claims.Issuer)
+	if err != nil || !strings.HasSuffix(u.Hostname(), teamDomainSuffix) {
+		return "", fmt.Errorf("team token has an unexpected issuer %q", claims.Issuer)
+	}
+
+	return strings.TrimSuffix(u.Hostname(), teamDomainSuffix), nil
+}
+
+// CreateTeamIdentity registers a new device enrolled into the Zero Trust
+// organization identified by token. The returned identity is not saved.
+func CreateTeamIdentity(ctx context.Context, warpAPI *WarpAPI, team, token string) (model.Identity, error) {
+	priv, err := crypto.GeneratePrivateKey()
+	if err != nil {
+		return model.Identity{}, err
+	}
+
+	privateKey, publicKey := priv.String(), priv.PublicKey().String()
+
+	log.Infow("Enrolling device into Zero Trust organization", "team", team)
+	i, err := warpAPI.RegisterTeam(ctx, publicKey, token)
+	if err != nil {
+		return model.Identity{}, err
+	}
+
+	if len(i.Config.Peers) < 1 {
+		return model.Identity{}, ErrNoPeers
+	}
+
+	if i.Account.Organization == "" {
+		i.Account.Organization = team
+	}
+	i.PrivateKey = privateKey
+	i.Version = "v2"
+
+	return i, nil
+}
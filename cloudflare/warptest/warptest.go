@@ -0,0 +1,445 @@
+// Package warptest provides an in-memory fake of the WARP registration API,
+// served over httptest, so identity flows can be exercised without reaching
+// Cloudflare. Point a client at it with cloudflare.WithBaseURL(srv.URL).
+package warptest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/model"
+)
+
+// PeerPublicKey is the WireGuard public key of the fake WARP peer.
+const PeerPublicKey = "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo="
+
+// DefaultMaxDevices is the number of devices an account may have bound.
+const DefaultMaxDevices = 5
+
+type registration struct {
+	identity  model.Identity
+	accountID string
+	active    bool
+}
+
+// Server is a fake WARP API. Its zero value is not usable; create one with
+// NewServer and Close it when done.
+type Server struct {
+	*httptest.Server
+
+	// MaxDevices limits how many registrations can share an account.
+	MaxDevices int
+
+	mu       sync.Mutex
+	regs     map[string]*registration
+	accounts map[string]*model.IdentityAccount
+	failures []int
+}
+
+// NewServer starts a fake WARP API.
+func NewServer() *Server {
+	s := &Server{
+		MaxDevices: DefaultMaxDevices,
+		regs:       make(map[string]*registration),
+		accounts:   make(map[string]*model.IdentityAccount),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /reg", s.handleRegister)
+	mux.HandleFunc("GET /reg/{id}", s.withAuth(s.handleGetReg))
+	mux.HandleFunc("PATCH /reg/{id}", s.withAuth(s.handleUpdateReg))
+	mux.HandleFunc("DELETE /reg/{id}", s.withAuth(s.handleDeleteReg))
+	mux.HandleFunc("GET /reg/{id}/account", s.withAuth(s.handleGetAccount))
+	mux.HandleFunc("PUT /reg/{id}/account", s.withAuth(s.handleUpdateAccount))
+	mux.HandleFunc("GET /reg/{id}/account/devices", s.withAuth(s.handleGetDevices))
+	mux.HandleFunc("PATCH /reg/{id}/account/devices/{other}", s.withAuth(s.handleUpdateDevice))
+	mux.HandleFunc("POST /reg/{id}/account/license", s.withAuth(s.handleResetLicense))
+
+	s.Server = httptest.NewServer(s.injectFailures(mux))
+	return s
+}
+
+// AddLicense creates a WARP+ account reachable through the given license key.
+func (s *Server) AddLicense(license string, premiumData int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc := newAccount(license)
+	acc.AccountType = "unlimited"
+	acc.WarpPlus = true
+	acc.PremiumData = premiumData
+	acc.Quota = premiumData
+	s.accounts[acc.ID] = acc
+}
+
+// SetPremiumData overrides the remaining premium data of the account bound to
+// the given registration.
+func (s *Server) SetPremiumData(regID string, premiumData int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if reg, ok := s.regs[regID]; ok {
+		s.accounts[reg.accountID].PremiumData = premiumData
+	}
+}
+
+// FailNext makes the next n requests fail with the given status code before
+// reaching the handlers. It is used to exercise client retries.
+func (s *Server) FailNext(status, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		s.failures = append(s.failures, status)
+	}
+}
+
+// Registration returns the server-side state of a registration.
+func (s *Server) Registration(id string) (model.Identity, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reg, ok := s.regs[id]
+	if !ok {
+		return model.Identity{}, false
+	}
+	return s.identityLocked(reg), true
+}
+
+func (s *Server) injectFailures(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		var status int
+		if len(s.failures) > 0 {
+			status, s.failures = s.failures[0], s.failures[1:]
+		}
+		s.mu.Unlock()
+
+		if status != 0 {
+			writeError(w, status, 0, http.StatusText(status))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) withAuth(next func(http.ResponseWriter, *http.Request, *registration)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		reg, ok := s.regs[r.PathValue("id")]
+		if !ok {
+			writeError(w, http.StatusNotFound, 1003, "Registration not found")
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+reg.identity.Token {
+			writeError(w, http.StatusUnauthorized, 10000, "Authentication error")
+			return
+		}
+		next(w, r, reg)
+	}
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Key   string `json:"key"`
+		Type  string `json:"type"`
+		Model string `json:"model"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Key == "" {
+		writeError(w, http.StatusBadRequest, 1004, "Invalid request body")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc := newAccount(randomLicense())
+	config := newConfig()
+	if token := r.Header.Get("CF-Access-Jwt-Assertion"); token != "" {
+		team, ok := teamFromToken(token)
+		if !ok {
+			writeError(w, http.StatusForbidden, 1006, "Invalid Access token")
+			return
+		}
+		acc.AccountType = "team"
+		acc.Organization = team
+		acc.License = ""
+		config.Interface.Addresses = model.IdentityConfigInterfaceAddresses{
+			V4: "100.96.0.2",
+			V6: "2606:4700:cf1:1000::2",
+		}
+	}
+	s.accounts[acc.ID] = acc
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	reg := &registration{
+		identity: model.Identity{
+			ID:          randomID(),
+			Token:       randomID(),
+			Key:         body.Key,
+			Type:        body.Type,
+			Model:       body.Model,
+			Locale:      "en_US",
+			WarpEnabled: true,
+			Enabled:     true,
+			Created:     now,
+			Updated:     now,
+			Config:      config,
+		},
+		accountID: acc.ID,
+		active:    true,
+	}
+	s.regs[reg.identity.ID] = reg
+
+	writeJSON(w, http.StatusOK, s.identityLocked(reg))
+}
+
+func (s *Server) handleGetReg(w http.ResponseWriter, r *http.Request, reg *registration) {
+	ident := s.identityLocked(reg)
+	ident.Token = ""
+	writeJSON(w, http.StatusOK, ident)
+}
+
+func (s *Server) handleUpdateReg(w http.ResponseWriter, r *http.Request, reg *registration) {
+	var body struct {
+		Name   *string `json:"name"`
+		Key    *string `json:"key"`
+		Active *bool   `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, 1004, "Invalid request body")
+		return
+	}
+
+	if body.Name != nil {
+		reg.identity.Name = *body.Name
+	}
+	if body.Key != nil {
+		if _, err := base64.StdEncoding.DecodeString(*body.Key); err != nil || *body.Key == "" {
+			writeError(w, http.StatusBadRequest, 1005, "Invalid public key")
+			return
+		}
+		reg.identity.Key = *body.Key
+	}
+	if body.Active != nil {
+		reg.active = *body.Active
+	}
+	reg.identity.Updated = time.Now().UTC().Format(time.RFC3339Nano)
+
+	ident := s.identityLocked(reg)
+	ident.Token = ""
+	writeJSON(w, http.StatusOK, ident)
+}
+
+func (s *Server) handleDeleteReg(w http.ResponseWriter, r *http.Request, reg *registration) {
+	delete(s.regs, reg.identity.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleGetAccount(w http.ResponseWriter, r *http.Request, reg *registration) {
+	writeJSON(w, http.StatusOK, s.accounts[reg.accountID])
+}
+
+func (s *Server) handleUpdateAccount(w http.ResponseWriter, r *http.Request, reg *registration) {
+	var body struct {
+		License string `json:"license"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, 1004, "Invalid request body")
+		return
+	}
+
+	var target *model.IdentityAccount
+	for _, acc := range s.accounts {
+		if acc.License == body.License {
+			target = acc
+			break
+		}
+	}
+	if target == nil {
+		writeError(w, http.StatusBadRequest, 1001, "Invalid license")
+		return
+	}
+
+	if target.ID != reg.accountID {
+		if len(s.devicesLocked(target.ID)) >= s.MaxDevices {
+			writeError(w, http.StatusForbidden, 1002, "Too many connected devices.")
+			return
+		}
+		reg.accountID = target.ID
+	}
+
+	writeJSON(w, http.StatusOK, target)
+}
+
+func (s *Server) handleGetDevices(w http.ResponseWriter, r *http.Request, reg *registration) {
+	writeJSON(w, http.StatusOK, s.devicesLocked(reg.accountID))
+}
+
+func (s *Server) handleUpdateDevice(w http.ResponseWriter, r *http.Request, reg *registration) {
+	other, ok := s.regs[r.PathValue("other")]
+	if !ok || other.accountID != reg.accountID {
+		writeError(w, http.StatusNotFound, 1003, "Device not found")
+		return
+	}
+
+	var body struct {
+		Name   *string `json:"name"`
+		Active *bool   `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, 1004, "Invalid request body")
+		return
+	}
+	if body.Name != nil {
+		other.identity.Name = *body.Name
+	}
+	if body.Active != nil {
+		other.active = *body.Active
+	}
+
+	writeJSON(w, http.StatusOK, s.deviceLocked(other))
+}
+
+func (s *Server) handleResetLicense(w http.ResponseWriter, r *http.Request, reg *registration) {
+	acc := s.accounts[reg.accountID]
+	acc.License = randomLicense()
+	writeJSON(w, http.StatusOK, model.License{License: acc.License})
+}
+
+func (s *Server) identityLocked(reg *registration) model.Identity {
+	ident := reg.identity
+	ident.Account = *s.accounts[reg.accountID]
+	return ident
+}
+
+func (s *Server) devicesLocked(accountID string) []model.IdentityDevice {
+	var devices []model.IdentityDevice
+	for _, reg := range s.regs {
+		if reg.accountID == accountID {
+			devices = append(devices, s.deviceLocked(reg))
+		}
+	}
+	return devices
+}
+
+func (s *Server) deviceLocked(reg *registration) model.IdentityDevice {
+	return model.IdentityDevice{
+		ID:        reg.identity.ID,
+		Name:      reg.identity.Name,
+		Type:      reg.identity.Type,
+		Model:     reg.identity.Model,
+		Created:   reg.identity.Created,
+		Activated: reg.identity.Updated,
+		Active:    reg.active,
+		Role:      s.accounts[reg.accountID].Role,
+	}
+}
+
+// TeamToken returns an unsigned Access JWT issued for the given organization,
+// accepted by the fake server for Zero Trust enrollment.
+func TeamToken(team string) string {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss": "https://" + team + ".cloudflareaccess.com",
+		"sub": randomID(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	return header + "." + enc.EncodeToString(claims) + "." + enc.EncodeToString([]byte("signature"))
+}
+
+func teamFromToken(token string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", false
+	}
+	host := strings.TrimPrefix(claims.Issuer, "https://")
+	team, ok := strings.CutSuffix(host, ".cloudflareaccess.com")
+	return team, ok && team != ""
+}
+
+func newAccount(license string) *model.IdentityAccount {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	return &model.IdentityAccount{
+		ID:          randomID(),
+		Created:     now,
+		Updated:     now,
+		License:     license,
+		AccountType: "free",
+		Role:        "parent",
+	}
+}
+
+func newConfig() model.IdentityConfig {
+	clientID := make([]byte, 3)
+	_, _ = rand.Read(clientID)
+
+	return model.IdentityConfig{
+		Peers: []model.IdentityConfigPeer{{
+			PublicKey: PeerPublicKey,
+			Endpoint: model.IdentityConfigPeerEndpoint{
+				V4:    "162.159.192.1:0",
+				V6:    "[2606:4700:d0::a29f:c001]:0",
+				Host:  "engage.cloudflareclient.com:2408",
+				Ports: []uint16{2408, 500, 1701, 4500},
+			},
+		}},
+		Interface: model.IdentityConfigInterface{
+			Addresses: model.IdentityConfigInterfaceAddresses{
+				V4: "172.16.0.2",
+				V6: "2606:4700:110:8a36:df92:102a:9602:fa18",
+			},
+		},
+		Services: model.IdentityConfigServices{HTTPProxy: "172.16.0.1:2480"},
+		ClientID: base64.StdEncoding.EncodeToString(clientID),
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func randomLicense() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	h := strings.ToUpper(hex.EncodeToString(b))
+	return h[0:8] + "-" + h[8:16] + "-" + h[16:24]
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status, code int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"result":   nil,
+		"success":  false,
+		"errors":   []map[string]interface{}{{"code": code, "message": message}},
+		"messages": []interface{}{},
+	})
+}
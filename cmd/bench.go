@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/shahradelahi/cloudflare-warp/cloudflare"
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/model"
+	"github.com/shahradelahi/cloudflare-warp/core"
+	"github.com/shahradelahi/cloudflare-warp/core/cache"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+	"github.com/shahradelahi/cloudflare-warp/log"
+)
+
+var BenchCmd = &cobra.Command{
+	Use:   "bench ENDPOINT...",
+	Short: "Measure the throughput of WARP endpoints",
+	Long: `Brings up a short-lived WireGuard session with each endpoint using the identity,
+downloads and uploads through it, and reports the throughput in Mbps. Handshake RTT alone
+does not reveal endpoints that are throttled. The results are stored in the endpoint cache.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runBench,
+}
+
+func init() {
+	addBenchFlags(BenchCmd, "", "bench.")
+	BenchCmd.Flags().String("dns", core.DefaultDNS[0].String(), "DNS server that resolves the endpoints and serves the tunnel.")
+	viper.BindPFlag("bench.dns", BenchCmd.Flags().Lookup("dns"))
+	addObfuscationFlag(BenchCmd, "obfuscation", "bench.obfuscation", statute.ObfuscationOff, "Junk packets sent before each handshake")
+	addReservedFlag(BenchCmd, "bench.reserved")
+}
+
+// benchResult is an entry of the array printed by 'bench' with --output json|yaml.
+// Latency is given in nanoseconds.
+type benchResult struct {
+	core.BenchResult
+	Error string `json:"error,omitempty"`
+}
+
+// addBenchFlags registers the benchmark flags on cmd, each name preceded by
+// flagPrefix. They are bound to the viper keys keyPrefix+flag name.
+func addBenchFlags(cmd *cobra.Command, flagPrefix, keyPrefix string) {
+	flags := cmd.Flags()
+	flags.String(flagPrefix+"url", core.DefaultBenchDownloadURL, fmt.Sprintf("URL downloaded through the tunnel; %s is replaced with the number of bytes.", core.BenchBytesPlaceholder))
+	flags.String(flagPrefix+"upload-url", core.DefaultBenchUploadURL, "URL uploaded to through the tunnel.")
+	flags.Int64(flagPrefix+"bytes", core.DefaultBenchBytes, "Bytes downloaded from each endpoint (0 to skip the download).")
+	flags.Int64(flagPrefix+"upload-bytes", core.DefaultBenchUploadBytes, "Bytes uploaded through each endpoint (0 to skip the upload).")
+	flags.Duration(flagPrefix+"timeout", core.DefaultBenchTimeout, "Maximum duration of the benchmark of each endpoint, including the handshake.")
+
+	for _, name := range []string{"url", "upload-url", "bytes", "upload-bytes", "timeout"} {
+		viper.BindPFlag(keyPrefix+flagPrefix+name, flags.Lookup(flagPrefix+name))
+	}
+}
+
+// benchOptions reads the flags registered by addBenchFlags.
+func benchOptions(flagPrefix, keyPrefix string) core.BenchOptions {
+	key := func(name string) string {
+		return keyPrefix + flagPrefix + name
+	}
+	return core.BenchOptions{
+		DownloadURL:   viper.GetString(key("url")),
+		UploadURL:     viper.GetString(key("upload-url")),
+		DownloadBytes: viper.GetInt64(key("bytes")),
+		UploadBytes:   viper.GetInt64(key("upload-bytes")),
+		Timeout:       viper.GetDuration(key("timeout")),
+	}
+}
+
+// benchmark measures the throughput of endpoints one after the other, so
+// that they do not compete for bandwidth, and stores it in the cache.
+func benchmark(ctx context.Context, ident *model.Identity, endpoints []string, opts core.BenchOptions) []benchResult {
+	c := cache.NewCache()
+
+	var results []benchResult
+	for _, endpoint := range endpoints {
+		if ctx.Err() != nil {
+			break
+		}
+
+		log.Infow("Benchmarking endpoint", zap.String("endpoint", endpoint))
+		res, err := core.Bench(ctx, ident, endpoint, opts)
+		result := benchResult{BenchResult: res}
+		if err != nil {
+			log.Warnw("Endpoint benchmark failed", zap.String("endpoint", endpoint), zap.Error(err))
+			result.Error = err.Error()
+		} else {
+			log.Infow("Endpoint benchmarked",
+				zap.String("endpoint", endpoint),
+				zap.Float64("download_mbps", res.Download),
+				zap.Float64("upload_mbps", res.Upload))
+			c.SaveThroughput(endpoint, res.Download, res.Upload)
+		}
+		results = append(results, result)
+	}
+
+	if err := c.SaveCache(); err != nil {
+		log.Warnw("Failed to save benchmark results to cache file", zap.Error(err))
+	}
+	return results
+}
+
+func runBench(cmd *cobra.Command, args []string) {
+	identity, err := cloudflare.LoadIdentity()
+	if err != nil {
+		fatal(fmt.Errorf("failed to load identity: %w", err))
+	}
+
+	opts := benchOptions("", "bench.")
+	opts.DNS, err = netip.ParseAddr(viper.GetString("bench.dns"))
+	if err != nil {
+		fatal(fmt.Errorf("invalid DNS address: %w", err))
+	}
+	opts.Obfuscation, err = obfuscationProfile("bench.obfuscation")
+	if err != nil {
+		fatal(err)
+	}
+	opts.Reserved, err = reservedBytes("bench.reserved", identity)
+	if err != nil {
+		fatal(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	results := benchmark(ctx, identity, args, opts)
+
+	if structuredOutput() {
+		if err := printStructured(results); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+
+	tbl := table.New("Endpoint", "Latency", "Download", "Upload", "Error")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	for _, r := range results {
+		tbl.AddRow(
+			r.Endpoint,
+			r.Latency.Round(time.Millisecond),
+			formatMbps(r.Download),
+			formatMbps(r.Upload),
+			r.Error,
+		)
+	}
+	tbl.Print()
+}
+
+// formatMbps formats a throughput, or "-" when it was not measured.
+func formatMbps(mbps float64) string {
+	if mbps == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f Mbps", mbps)
+}
@@ -1,37 +1,216 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"go.uber.org/zap"
 
 	"github.com/shahradelahi/cloudflare-warp/cloudflare"
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/model"
 	"github.com/shahradelahi/cloudflare-warp/core"
+	"github.com/shahradelahi/cloudflare-warp/core/export"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
 	"github.com/shahradelahi/cloudflare-warp/log"
 )
 
 var GenerateCmd = &cobra.Command{
 	Use:   "generate",
 	Short: "Generates and prints the WireGuard configuration",
-	Long:  `This command generates and prints the WireGuard configuration based on your WARP identity. The output can be redirected to a file to create a WireGuard configuration file.`,
-	Run:   generate,
+	Long: `This command generates and prints the WireGuard configuration based on your WARP identity. The output can be redirected to a file to create a WireGuard configuration file.
+Use --team or --team-token to enroll the device into a Cloudflare Zero Trust organization instead of creating a consumer account.
+Use --format to print a ready-to-use outbound for sing-box, Xray or Clash/mihomo instead of a WireGuard configuration.
+With --format amnezia, the AmneziaWG junk-packet parameters are taken from the obfuscation profile selected with --obfuscation.
+Use --qr to show the configuration as a QR code for the mobile WireGuard apps, or --qr-png to save it as an image.`,
+	Run: generate,
 }
 
-func init() {}
+func init() {
+	GenerateCmd.Flags().String("team", "", "Zero Trust organization (team) name to enroll the device into.")
+	GenerateCmd.Flags().String("team-token", "", "Zero Trust enrollment token (JWT) or the com.cloudflare.warp:// link containing it.")
+
+	GenerateCmd.Flags().String("format", string(export.FormatWireGuard), "Configuration format (wireguard, singbox, xray, clash, amnezia).")
+	GenerateCmd.Flags().Bool("qr", false, "Print the configuration as a QR code in the terminal instead of text.")
+	GenerateCmd.Flags().String("qr-png", "", "Write the configuration as a QR code PNG image to the given file.")
+	GenerateCmd.Flags().StringSlice("dns", nil, "DNS servers of the configuration (default 1.1.1.1, 1.0.0.1, 2606:4700:4700::1111, 2606:4700:4700::1001).")
+	GenerateCmd.Flags().String("endpoint", "", "Endpoint (host:port) to put in the configuration instead of the default one.")
+	GenerateCmd.Flags().Bool("best-endpoint", false, "Use the endpoint with the lowest RTT from the scanner cache.")
+
+	viper.BindPFlag("generate.team", GenerateCmd.Flags().Lookup("team"))
+	viper.BindPFlag("generate.team-token", GenerateCmd.Flags().Lookup("team-token"))
+	viper.BindPFlag("generate.format", GenerateCmd.Flags().Lookup("format"))
+	viper.BindPFlag("generate.qr", GenerateCmd.Flags().Lookup("qr"))
+	viper.BindPFlag("generate.qr-png", GenerateCmd.Flags().Lookup("qr-png"))
+	viper.BindPFlag("generate.dns", GenerateCmd.Flags().Lookup("dns"))
+	viper.BindPFlag("generate.endpoint", GenerateCmd.Flags().Lookup("endpoint"))
+	viper.BindPFlag("generate.best-endpoint", GenerateCmd.Flags().Lookup("best-endpoint"))
+
+	addObfuscationFlag(GenerateCmd, "obfuscation", "generate.obfuscation", statute.ObfuscationScannerDefault, "Junk-packet profile of the amnezia format")
+	addWireguardFlags(GenerateCmd, "generate.", strconv.Itoa(core.DefaultMTU))
+	addReservedFlag(GenerateCmd, "generate.reserved")
+}
 
 func generate(cmd *cobra.Command, args []string) {
-	ident, err := cloudflare.LoadOrCreateIdentity()
+	var (
+		ident *model.Identity
+		err   error
+	)
+
+	format, err := export.ParseFormat(viper.GetString("generate.format"))
 	if err != nil {
-		log.Fatalw("Failed to generate primary identity", zap.Error(err))
+		log.Fatalw("Invalid configuration format", zap.Error(err))
+	}
+
+	team, teamToken := viper.GetString("generate.team"), viper.GetString("generate.team-token")
+	if team != "" || teamToken != "" {
+		ident, err = enrollTeam(cmd.Context(), team, teamToken)
+		if err != nil {
+			log.Fatalw("Failed to enroll device into Zero Trust organization", zap.Error(describeAPIError(err)))
+		}
+	} else {
+		ident, err = cloudflare.LoadOrCreateIdentity(cmd.Context(), cloudflare.NewWarpAPI())
+		if err != nil {
+			log.Fatalw("Failed to generate primary identity", zap.Error(describeAPIError(err)))
+		}
 	}
 
-	wgConf := core.GenerateWireguardConfig(ident)
+	wgOpts, err := wireguardOptions("generate.")
+	if err != nil {
+		log.Fatalw("Invalid WireGuard options", zap.Error(err))
+	}
+	wgOpts.DNS, err = parseAddrs(viper.GetStringSlice("generate.dns"))
+	if err != nil {
+		log.Fatalw("Invalid DNS server", zap.Error(err))
+	}
+	wgOpts.Endpoint = viper.GetString("generate.endpoint")
+	wgOpts.BestEndpoint = viper.GetBool("generate.best-endpoint")
 
-	confStr, err := wgConf.String()
+	wgConf, err := core.GenerateWireguardConfig(ident, wgOpts)
 	if err != nil {
 		log.Fatalw("Failed to generate WireGuard configuration", zap.Error(err))
 	}
 
-	fmt.Println(confStr)
+	if autoMTU("generate.") {
+		var mtuOpts core.MTUOptions
+		if len(wgOpts.DNS) > 0 {
+			mtuOpts.DNS = wgOpts.DNS[0]
+		}
+		if mtuOpts.Reserved, err = reservedBytes("generate.reserved", ident); err != nil {
+			log.Fatalw("Invalid reserved bytes", zap.Error(err))
+		}
+		mtu, err := core.DiscoverMTU(cmd.Context(), ident, wgConf.Peers[0].Endpoint, mtuOpts)
+		if err != nil {
+			log.Warnw("MTU discovery failed; using the default MTU", zap.Error(err), zap.Int("mtu", core.DefaultMTU))
+		} else {
+			wgConf.Interface.MTU = mtu
+		}
+	}
+
+	qrTerminal, qrPNG := viper.GetBool("generate.qr"), viper.GetString("generate.qr-png")
+	wantQR := qrTerminal || qrPNG != ""
+	if wantQR && format != export.FormatWireGuard && format != export.FormatAmnezia {
+		log.Fatalw("QR codes are only supported for the wireguard and amnezia formats", zap.String("format", string(format)))
+	}
+
+	if format == export.FormatWireGuard && structuredOutput() && !wantQR {
+		if err := printStructured(wgConf); err != nil {
+			log.Fatalw("Failed to print WireGuard configuration", zap.Error(err))
+		}
+		return
+	}
+
+	var opts export.Options
+	switch format {
+	case export.FormatWireGuard:
+	case export.FormatAmnezia:
+		opts.Obfuscation, err = obfuscationProfile("generate.obfuscation")
+		if err != nil {
+			log.Fatalw("Failed to load obfuscation profile", zap.Error(err))
+		}
+	default:
+		if opts.Reserved, err = reservedBytes("generate.reserved", ident); err != nil {
+			log.Fatalw("Invalid reserved bytes", zap.Error(err))
+		}
+	}
+
+	data, err := export.Export(format, &wgConf, opts)
+	if err != nil {
+		log.Fatalw("Failed to generate configuration", zap.String("format", string(format)), zap.Error(err))
+	}
+	conf := strings.TrimRight(string(data), "\n")
+
+	if !wantQR {
+		fmt.Println(conf)
+		return
+	}
+
+	qr, err := newConfigQR(conf)
+	if err != nil {
+		log.Fatalw("Failed to create QR code", zap.Error(err))
+	}
+	if qrPNG != "" {
+		if err := qr.WriteFile(qrPNGModuleSize, qrPNG); err != nil {
+			log.Fatalw("Failed to write QR code image", zap.String("file", qrPNG), zap.Error(err))
+		}
+		log.Infow("QR code image written", zap.String("file", qrPNG))
+	}
+	if qrTerminal {
+		fmt.Print(renderQR(qr))
+	}
+}
+
+// enrollTeam registers a new Zero Trust device and saves it as the current
+// identity. When no token is given, the user is asked to sign in on the
+// organization's enrollment page and paste the resulting token.
+func enrollTeam(ctx context.Context, team, input string) (*model.Identity, error) {
+	if input == "" {
+		fmt.Fprintf(os.Stderr, "Open %s in a browser and sign in.\n", cloudflare.TeamEnrollURL(team))
+		fmt.Fprint(os.Stderr, "Paste the token (or the com.cloudflare.warp:// link) shown after signing in: ")
+
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("failed to read team token: %w", err)
+		}
+		input = line
+	}
+
+	token, err := cloudflare.ParseTeamToken(input)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenTeam, err := cloudflare.TeamFromToken(token)
+	switch {
+	case team == "" && err != nil:
+		return nil, fmt.Errorf("cannot determine the organization, pass it with --team: %w", err)
+	case team == "":
+		team = tokenTeam
+	case err == nil && tokenTeam != team:
+		return nil, fmt.Errorf("team token was issued for %q, not %q", tokenTeam, team)
+	}
+
+	if existing, err := cloudflare.LoadIdentity(); err == nil {
+		log.Warnw("Replacing the existing WARP identity with the Zero Trust enrollment", zap.String("registration_id", existing.ID))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Debugw("No usable existing identity found", zap.Error(err))
+	}
+
+	ident, err := cloudflare.CreateTeamIdentity(ctx, cloudflare.NewWarpAPI(), team, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ident.SaveIdentity(); err != nil {
+		return nil, fmt.Errorf("failed to save team identity: %w", err)
+	}
+
+	log.Infow("Device enrolled into Zero Trust organization", zap.String("team", team))
+	return &ident, nil
 }
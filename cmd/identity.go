@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/shahradelahi/cloudflare-warp/cloudflare"
+)
+
+var identityShortMsg = "Manages the local Cloudflare Warp identity"
+
+var IdentityCmd = &cobra.Command{
+	Use:   "identity",
+	Short: identityShortMsg,
+	Long:  FormatMessage(identityShortMsg, `Commands for maintaining the registration stored in the data directory.`),
+}
+
+var rotateKeyShortMsg = "Rotates the WireGuard key of the current device"
+
+var RotateKeyCmd = &cobra.Command{
+	Use:   "rotate-key",
+	Short: rotateKeyShortMsg,
+	Long: FormatMessage(rotateKeyShortMsg, `
+Generates a new WireGuard private key, registers its public key with Cloudflare
+and updates the local identity files. The registration ID, token and account are kept.`),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := rotateKey(cmd.Context()); err != nil {
+			fatal(err)
+		}
+	},
+}
+
+func init() {
+	IdentityCmd.AddCommand(RotateKeyCmd)
+}
+
+func rotateKey(ctx context.Context) error {
+	identity, err := cloudflare.LoadIdentity()
+	if err != nil {
+		if os.IsNotExist(err) || errors.Is(err, cloudflare.ErrNoPeers) {
+			return fmt.Errorf("WARP identity not found. Please run 'warp generate' to create one")
+		}
+		return err
+	}
+
+	if _, err := cloudflare.RotateKey(ctx, cloudflare.NewWarpAPI(), identity); err != nil {
+		return describeAPIError(err)
+	}
+
+	fmt.Println("WireGuard key rotated successfully.")
+	return nil
+}
@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+// addObfuscationFlag registers the profile flag named flag on cmd, bound to
+// the viper key, with def as the default profile.
+func addObfuscationFlag(cmd *cobra.Command, flag, key, def, usage string) {
+	cmd.Flags().String(flag, def,
+		fmt.Sprintf("%s: a built-in profile (%s) or the path of a JSON profile file.", usage, strings.Join(statute.ObfuscationProfileNames(), ", ")))
+	viper.BindPFlag(key, cmd.Flags().Lookup(flag))
+}
+
+// obfuscationProfile resolves the profile selected with --obfuscation.
+func obfuscationProfile(key string) (*statute.ObfuscationProfile, error) {
+	profile, err := statute.LookupObfuscationProfile(viper.GetString(key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid obfuscation profile: %w", err)
+	}
+	return profile, nil
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats accepted by the global --output flag.
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+func outputFormat() string {
+	return viper.GetString("output")
+}
+
+func validateOutputFormat() error {
+	switch outputFormat() {
+	case outputText, outputJSON, outputYAML:
+		return nil
+	default:
+		return fmt.Errorf("invalid output format %q (expected text, json or yaml)", outputFormat())
+	}
+}
+
+// structuredOutput reports whether results should be printed as data instead
+// of human-readable text.
+func structuredOutput() bool {
+	return outputFormat() != outputText
+}
+
+// printStructured writes v to stdout in the selected output format. YAML
+// output uses the same field names as JSON.
+func printStructured(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if outputFormat() == outputYAML {
+		data, err = jsonToYAML(data)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(os.Stdout, "---\n"+string(data))
+		return err
+	}
+
+	_, err = fmt.Fprintln(os.Stdout, string(data))
+	return err
+}
+
+// jsonToYAML re-encodes a JSON document as block-style YAML, keeping the key
+// order of the original document.
+func jsonToYAML(data []byte) ([]byte, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	resetStyle(&node)
+	return yaml.Marshal(&node)
+}
+
+func resetStyle(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!str" {
+		// Keep quoting for strings that would otherwise be read back as
+		// another type, e.g. "true" or "1.0".
+		node.Style = yaml.DoubleQuotedStyle
+		var probe interface{}
+		if err := yaml.Unmarshal([]byte(node.Value), &probe); err == nil {
+			if _, ok := probe.(string); ok {
+				node.Style = 0
+			}
+		}
+	} else {
+		node.Style = 0
+	}
+	for _, child := range node.Content {
+		resetStyle(child)
+	}
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	// qrMaxBytes is the capacity of a version 40 QR code at the low recovery
+	// level in byte mode.
+	qrMaxBytes = 2953
+	// qrPNGModuleSize is passed as the image size when writing PNG output.
+	// go-qrcode treats a negative size as a scale instead: each module is
+	// drawn 8 pixels wide and the image grows with the QR version, rather
+	// than squeezing a large config into a fixed image size.
+	qrPNGModuleSize = -8
+)
+
+func newConfigQR(content string) (*qrcode.QRCode, error) {
+	if len(content) > qrMaxBytes {
+		return nil, fmt.Errorf("configuration is %d bytes, which exceeds the QR code capacity of %d bytes; remove optional settings or transfer the file instead", len(content), qrMaxBytes)
+	}
+	// Mobile clients scan terminal codes reliably at the low recovery level,
+	// which keeps the code as small as possible.
+	return qrcode.New(content, qrcode.Low)
+}
+
+// renderQR draws the code with Unicode half blocks, two modules per character
+// cell. Light modules are drawn as blocks so the code reads correctly on dark
+// terminal backgrounds.
+func renderQR(qr *qrcode.QRCode) string {
+	bitmap := qr.Bitmap()
+
+	var b strings.Builder
+	for y := 0; y < len(bitmap); y += 2 {
+		for x := range bitmap[y] {
+			top := !bitmap[y][x]
+			bottom := y+1 < len(bitmap) && !bitmap[y+1][x]
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
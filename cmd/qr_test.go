@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testWireGuardConfig = `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 172.16.0.2/32
+DNS = 1.1.1.1
+
+[Peer]
+PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = engage.cloudflareclient.com:2408
+`
+
+func TestNewConfigQRCapacity(t *testing.T) {
+	_, err := newConfigQR(strings.Repeat("a", qrMaxBytes+1))
+	assert.ErrorContains(t, err, "exceeds the QR code capacity")
+
+	_, err = newConfigQR(strings.Repeat("a", qrMaxBytes))
+	assert.NoError(t, err, "content at the capacity limit should fit")
+}
+
+func TestRenderQR(t *testing.T) {
+	qr, err := newConfigQR(testWireGuardConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	size := len(qr.Bitmap())
+	lines := strings.Split(strings.TrimSuffix(renderQR(qr), "\n"), "\n")
+	assert.Len(t, lines, (size+1)/2, "each line holds two rows of modules")
+	for _, line := range lines {
+		assert.Equal(t, size, len([]rune(line)))
+	}
+
+	data, err := qr.PNG(qrPNGModuleSize)
+	if !assert.NoError(t, err) {
+		return
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, size*8, img.Bounds().Dx(), "a negative size scales each module to 8 pixels")
+}
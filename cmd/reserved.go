@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/model"
+	"github.com/shahradelahi/cloudflare-warp/log"
+)
+
+const (
+	reservedAuto = "auto"
+	reservedNone = "none"
+)
+
+// addReservedFlag registers --reserved on cmd, bound to the viper key.
+func addReservedFlag(cmd *cobra.Command, key string) {
+	cmd.Flags().String("reserved", reservedAuto,
+		`Reserved header bytes: "auto" derives them from the identity's client ID, "none" disables them, or give three bytes as "a,b,c" or base64.`)
+	viper.BindPFlag(key, cmd.Flags().Lookup("reserved"))
+}
+
+// parseReserved parses the value of --reserved. It returns nil for "auto" and
+// an empty slice for "none".
+func parseReserved(value string) ([]byte, error) {
+	switch value = strings.TrimSpace(value); value {
+	case "", reservedAuto:
+		return nil, nil
+	case reservedNone:
+		return []byte{}, nil
+	}
+
+	if parts := strings.Split(value, ","); len(parts) == 3 {
+		reserved := make([]byte, 0, 3)
+		for _, part := range parts {
+			b, err := strconv.ParseUint(strings.TrimSpace(part), 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid reserved byte %q", part)
+			}
+			reserved = append(reserved, byte(b))
+		}
+		return reserved, nil
+	}
+
+	reserved, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(reserved) != 3 {
+		return nil, fmt.Errorf("invalid reserved bytes %q: expected auto, none, a,b,c or 3 bytes of base64", value)
+	}
+	return reserved, nil
+}
+
+// reservedBytes resolves --reserved for ident. When derived from the client
+// ID and the identity has none, the bytes are omitted with a warning.
+func reservedBytes(key string, ident *model.Identity) ([]byte, error) {
+	reserved, err := parseReserved(viper.GetString(key))
+	if err != nil || reserved != nil {
+		return reserved, err
+	}
+
+	reserved, err = ident.Config.Reserved()
+	if err != nil {
+		log.Warnw("Omitting reserved bytes", zap.Error(err))
+		return nil, nil
+	}
+	return reserved, nil
+}
@@ -26,6 +26,11 @@ It can operate as a Socks5 or HTTP proxy.`,
 		}
 		log.SetLogger(log.Must(log.NewLeveled(logLevel)))
 
+		if err := validateOutputFormat(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
 		// Initialize data directory
 		dir := datadir.GetDataDirOrPath(viper.GetString("data-dir"))
 		if err := os.MkdirAll(dir, 0700); err != nil {
@@ -61,18 +66,22 @@ func init() {
 
 	rootCmd.PersistentFlags().String("data-dir", "", "Directory to store generated profiles and identity files.")
 	rootCmd.PersistentFlags().String("loglevel", "info", "SetDataDir the logging level (debug, info, warn, error, silent).")
+	rootCmd.PersistentFlags().StringP("output", "o", outputText, "Output format for command results (text, json, yaml). Logs are always written to stderr.")
 	rootCmd.Flags().Bool("version", false, "Display version number.")
 
 	viper.BindPFlag("data-dir", rootCmd.PersistentFlags().Lookup("data-dir"))
 	viper.BindPFlag("loglevel", rootCmd.PersistentFlags().Lookup("loglevel"))
+	viper.BindPFlag("output", rootCmd.PersistentFlags().Lookup("output"))
 	viper.BindPFlag("version", rootCmd.Flags().Lookup("version"))
 
 	// Add subcommands
 	rootCmd.AddCommand(RunCmd)
 	rootCmd.AddCommand(ScannerCmd)
+	rootCmd.AddCommand(BenchCmd)
 	rootCmd.AddCommand(GenerateCmd)
 	rootCmd.AddCommand(StatusCmd)
 	rootCmd.AddCommand(UpdateCmd)
+	rootCmd.AddCommand(IdentityCmd)
 }
 
 func initConfig() {
@@ -16,7 +16,9 @@ import (
 
 	"github.com/shahradelahi/cloudflare-warp/core"
 	"github.com/shahradelahi/cloudflare-warp/core/cache"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/engine"
 	"github.com/shahradelahi/cloudflare-warp/ipscanner/ipgenerator"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
 	"github.com/shahradelahi/cloudflare-warp/log"
 	"github.com/shahradelahi/cloudflare-warp/utils"
 )
@@ -35,10 +37,18 @@ func init() {
 	RunCmd.Flags().Bool("6", false, "Use IPv6 for random WARP endpoint selection.")
 	RunCmd.Flags().String("socks-addr", "", "Socks5 proxy bind address.")
 	RunCmd.Flags().String("http-addr", "", "HTTP proxy bind address.")
-	RunCmd.Flags().String("dns", "1.1.1.1", "DNS server address to use (e.g., 1.1.1.1).")
+	RunCmd.Flags().String("dns", core.DefaultDNS[0].String(), "DNS server address to use (e.g., 1.1.1.1).")
 	RunCmd.Flags().StringSliceP("endpoint", "e", []string{}, "Specify a custom WARP endpoint.")
 	RunCmd.Flags().Bool("scan", false, "Enable WARP IP scanning before connecting.")
 	RunCmd.Flags().Duration("scan-rtt", 1000*time.Millisecond, "Scanner RTT limit for endpoint selection (e.g., 1000ms).")
+	RunCmd.Flags().Int("scan-concurrency", engine.DefaultConcurrency, "Number of IPs the scanner probes at the same time.")
+	RunCmd.Flags().Int("scan-rate", 0, "Maximum handshakes the scanner sends per second, not counting the junk packets before each (0 for unlimited).")
+	RunCmd.Flags().Int("scan-count", core.DefaultScanCount, "Number of endpoints the scanner looks for before connecting.")
+	RunCmd.Flags().Duration("scan-timeout", core.DefaultScanTimeout, "Maximum duration of the scan.")
+	RunCmd.Flags().Int64("scan-max-probes", 0, "Maximum IPs the scanner probes (0 for unlimited).")
+	RunCmd.Flags().Int("scan-min-results", 1, "Fail when the scan stops with fewer endpoints than this.")
+	RunCmd.Flags().Bool("scan-verify", false, "Only use endpoints that forward data through the tunnel, not just answer handshakes.")
+	RunCmd.Flags().Duration("rotate-key-every", 0, "Rotate the WireGuard key at this interval and reconnect (e.g., 24h). Disabled when 0.")
 
 	viper.BindPFlag("4", RunCmd.Flags().Lookup("4"))
 	viper.BindPFlag("6", RunCmd.Flags().Lookup("6"))
@@ -48,6 +58,20 @@ func init() {
 	viper.BindPFlag("dns", RunCmd.Flags().Lookup("dns"))
 	viper.BindPFlag("scan", RunCmd.Flags().Lookup("scan"))
 	viper.BindPFlag("scan-rtt", RunCmd.Flags().Lookup("scan-rtt"))
+	viper.BindPFlag("scan-concurrency", RunCmd.Flags().Lookup("scan-concurrency"))
+	viper.BindPFlag("scan-rate", RunCmd.Flags().Lookup("scan-rate"))
+	viper.BindPFlag("scan-count", RunCmd.Flags().Lookup("scan-count"))
+	viper.BindPFlag("scan-timeout", RunCmd.Flags().Lookup("scan-timeout"))
+	viper.BindPFlag("scan-max-probes", RunCmd.Flags().Lookup("scan-max-probes"))
+	viper.BindPFlag("scan-min-results", RunCmd.Flags().Lookup("scan-min-results"))
+	viper.BindPFlag("scan-verify", RunCmd.Flags().Lookup("scan-verify"))
+	viper.BindPFlag("rotate-key-every", RunCmd.Flags().Lookup("rotate-key-every"))
+
+	addWireguardFlags(RunCmd, "", mtuAuto)
+	addObfuscationFlag(RunCmd, "obfuscation", "obfuscation", statute.ObfuscationOff, "Junk packets sent before each handshake of the tunnel")
+	addObfuscationFlag(RunCmd, "scan-obfuscation", "scan-obfuscation", statute.ObfuscationScannerDefault, "Junk packets sent before each handshake of the scanner")
+	addReservedFlag(RunCmd, "reserved")
+	addTargetFlags(RunCmd, "scan-", "")
 }
 
 func run(cmd *cobra.Command, args []string) {
@@ -94,6 +118,30 @@ func run(cmd *cobra.Command, args []string) {
 		fatal(fmt.Errorf("invalid DNS address: %w", err))
 	}
 
+	wgOpts, err := wireguardOptions("")
+	if err != nil {
+		fatal(err)
+	}
+
+	obfuscation, err := obfuscationProfile("obfuscation")
+	if err != nil {
+		fatal(err)
+	}
+	scanObfuscation, err := obfuscationProfile("scan-obfuscation")
+	if err != nil {
+		fatal(err)
+	}
+
+	reserved, err := parseReserved(viper.GetString("reserved"))
+	if err != nil {
+		fatal(err)
+	}
+
+	targets, err := resolveTargets("scan-", "")
+	if err != nil {
+		fatal(err)
+	}
+
 	endpoints := viper.GetStringSlice("endpoint")
 	userProvidedEndpoint := len(endpoints) > 0
 
@@ -103,17 +151,18 @@ func run(cmd *cobra.Command, args []string) {
 		Endpoints:            endpoints,
 		DnsAddr:              dnsAddr,
 		UserProvidedEndpoint: userProvidedEndpoint,
+		RotateKeyEvery:       viper.GetDuration("rotate-key-every"),
+		Wireguard:            wgOpts,
+		AutoMTU:              autoMTU(""),
+		Obfuscation:          obfuscation,
+		Reserved:             reserved,
 	}
 
 	c := cache.NewCache()
 
 	if viper.GetBool("scan") {
-		log.Infow("Scanner mode enabled", zap.Duration("max-rtt", viper.GetDuration("rtt")))
-		opts.Scan = &core.ScanOptions{
-			V4:     useV4,
-			V6:     useV6,
-			MaxRTT: viper.GetDuration("rtt"),
-		}
+		log.Infow("Scanner mode enabled", zap.Duration("max-rtt", viper.GetDuration("scan-rtt")))
+		opts.Scan = scanOptions(useV4, useV6, scanObfuscation, targets)
 	}
 
 	if len(opts.Endpoints) == 0 && !viper.GetBool("scan") {
@@ -129,11 +178,7 @@ func run(cmd *cobra.Command, args []string) {
 				}
 			} else {
 				log.Warnw("Not enough available endpoints found in cache; automatically enabling scanner mode to discover new endpoints.")
-				opts.Scan = &core.ScanOptions{
-					V4:     useV4,
-					V6:     useV6,
-					MaxRTT: viper.GetDuration("rtt"),
-				}
+				opts.Scan = scanOptions(useV4, useV6, scanObfuscation, targets)
 			}
 		} else {
 			opts.Endpoints = endpoints
@@ -156,3 +201,23 @@ func run(cmd *cobra.Command, args []string) {
 func fatal(err error) {
 	log.Fatalw("Application encountered a fatal error", zap.Error(err))
 }
+
+// scanOptions returns the options of the scan run before connecting.
+func scanOptions(useV4, useV6 bool, obfuscation *statute.ObfuscationProfile, targets scanTargets) *core.ScanOptions {
+	return &core.ScanOptions{
+		V4:          useV4,
+		V6:          useV6,
+		MaxRTT:      viper.GetDuration("scan-rtt"),
+		Obfuscation: obfuscation,
+		Concurrency: viper.GetInt("scan-concurrency"),
+		Rate:        viper.GetInt("scan-rate"),
+		Count:       viper.GetInt("scan-count"),
+		Timeout:     viper.GetDuration("scan-timeout"),
+		MaxProbes:   viper.GetInt64("scan-max-probes"),
+		MinResults:  viper.GetInt("scan-min-results"),
+		Verify:      viper.GetBool("scan-verify"),
+		CidrList:    targets.Cidrs,
+		Ports:       targets.Ports,
+		Exclude:     targets.Exclude,
+	}
+}
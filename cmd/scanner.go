@@ -4,8 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/netip"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,7 +20,12 @@ import (
 
 	"github.com/shahradelahi/cloudflare-warp/cloudflare"
 	"github.com/shahradelahi/cloudflare-warp/cloudflare/network"
+	"github.com/shahradelahi/cloudflare-warp/core"
+	"github.com/shahradelahi/cloudflare-warp/core/datadir"
 	"github.com/shahradelahi/cloudflare-warp/ipscanner"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/engine"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/ping"
 	"github.com/shahradelahi/cloudflare-warp/log"
 )
 
@@ -33,10 +42,98 @@ func init() {
 	ScannerCmd.Flags().BoolP("ipv4", "4", false, "Only scan for IPv4 WARP endpoints.")
 	ScannerCmd.Flags().BoolP("ipv6", "6", false, "Only scan for IPv6 WARP endpoints.")
 	ScannerCmd.Flags().Duration("rtt", 1000*time.Millisecond, "Maximum RTT (Round-Trip Time) for scanned IPs (e.g., 1000ms).")
+	ScannerCmd.Flags().Int("concurrency", engine.DefaultConcurrency, "Number of IPs probed at the same time.")
+	ScannerCmd.Flags().Int("rate", 0, "Maximum probes sent per second: WireGuard handshakes, not counting the junk packets before each, or connections and pings for the other probes (0 for unlimited).")
+	ScannerCmd.Flags().String("port-strategy", string(statute.PortsAll), "Ports probed on each IP: all, random (--port-count at random), fixed (--ports) or adaptive (favor ports that answer). Random and adaptive pick from --ports when given.")
+	ScannerCmd.Flags().Int("port-count", statute.DefaultPortCount, "Number of ports probed per IP by the random and adaptive strategies.")
+	ScannerCmd.Flags().Int("samples", 1, "Number of handshakes used to measure the RTT, jitter and loss of each endpoint found.")
+	ScannerCmd.Flags().Float64("jitter-weight", statute.DefaultScoreWeights.Jitter, "Weight of the RTT standard deviation in an endpoint's score.")
+	ScannerCmd.Flags().Duration("loss-penalty", statute.DefaultScoreWeights.Loss, "Score penalty for every percent of lost samples.")
+	ScannerCmd.Flags().String("probe", ping.ProbeWarp, fmt.Sprintf("Probe type: %s. Only warp finds WARP endpoints; tcp, tls and http-trace connect to port 443 (or the first of --ports) to rank Cloudflare edge IPs.", strings.Join(ping.ProbeNames(), ", ")))
+	ScannerCmd.Flags().String("probe-host", ping.DefaultProbeHost, "Server name of the tls and http-trace probes.")
+	ScannerCmd.Flags().String("mode", string(statute.ScanFlat), "Scan mode: flat probes addresses from every CIDR in turn, subnets ranks subnets by sampling them and then deep-scans the best.")
+	ScannerCmd.Flags().Int("subnet-bits", statute.DefaultSubnetOptions.Bits4, "Length of the IPv4 subnets ranked in subnets mode.")
+	ScannerCmd.Flags().Int("subnet-bits6", statute.DefaultSubnetOptions.Bits6, "Length of the IPv6 subnets ranked in subnets mode.")
+	ScannerCmd.Flags().Int("subnet-probes", statute.DefaultSubnetOptions.Probes, "Addresses sampled in each subnet in subnets mode.")
+	ScannerCmd.Flags().Int("max-subnets", statute.DefaultSubnetOptions.MaxPerCIDR, "Maximum subnets sampled per CIDR in subnets mode.")
+	ScannerCmd.Flags().Int("top-subnets", statute.DefaultSubnetOptions.Top, "Number of best subnets deep-scanned in subnets mode.")
+	ScannerCmd.Flags().Uint64("seed", 0, "Seed of the pseudo-random scan order, to repeat a scan (random when 0).")
+	ScannerCmd.Flags().Int("count", 0, "Stop after finding this many endpoints (0 to scan until interrupted).")
+	ScannerCmd.Flags().Duration("timeout", 0, "Stop the scan after this long (0 for no timeout).")
+	ScannerCmd.Flags().Int64("max-probes", 0, "Stop after probing this many IPs (0 for unlimited).")
+	ScannerCmd.Flags().Int("min-results", 0, "Fail when the scan stops with fewer endpoints than this.")
+	ScannerCmd.Flags().Bool("verify", false, "Only keep endpoints that forward data through the tunnel, not just answer handshakes.")
+	ScannerCmd.Flags().Bool("bench", false, "Measure the throughput of the best endpoints found through a real tunnel.")
+	ScannerCmd.Flags().Int("bench-top", 3, "Number of best endpoints benchmarked with --bench.")
+	ScannerCmd.Flags().Bool("resume", false, "Save the scan progress to the data directory and continue an interrupted scan of the same targets.")
 
 	viper.BindPFlag("scanner.ipv4", ScannerCmd.Flags().Lookup("ipv4"))
 	viper.BindPFlag("scanner.ipv6", ScannerCmd.Flags().Lookup("ipv6"))
 	viper.BindPFlag("scanner.rtt", ScannerCmd.Flags().Lookup("rtt"))
+	viper.BindPFlag("scanner.concurrency", ScannerCmd.Flags().Lookup("concurrency"))
+	viper.BindPFlag("scanner.rate", ScannerCmd.Flags().Lookup("rate"))
+	viper.BindPFlag("scanner.port-strategy", ScannerCmd.Flags().Lookup("port-strategy"))
+	viper.BindPFlag("scanner.port-count", ScannerCmd.Flags().Lookup("port-count"))
+	viper.BindPFlag("scanner.samples", ScannerCmd.Flags().Lookup("samples"))
+	viper.BindPFlag("scanner.jitter-weight", ScannerCmd.Flags().Lookup("jitter-weight"))
+	viper.BindPFlag("scanner.loss-penalty", ScannerCmd.Flags().Lookup("loss-penalty"))
+	viper.BindPFlag("scanner.probe", ScannerCmd.Flags().Lookup("probe"))
+	viper.BindPFlag("scanner.probe-host", ScannerCmd.Flags().Lookup("probe-host"))
+	viper.BindPFlag("scanner.mode", ScannerCmd.Flags().Lookup("mode"))
+	viper.BindPFlag("scanner.subnet-bits", ScannerCmd.Flags().Lookup("subnet-bits"))
+	viper.BindPFlag("scanner.subnet-bits6", ScannerCmd.Flags().Lookup("subnet-bits6"))
+	viper.BindPFlag("scanner.subnet-probes", ScannerCmd.Flags().Lookup("subnet-probes"))
+	viper.BindPFlag("scanner.max-subnets", ScannerCmd.Flags().Lookup("max-subnets"))
+	viper.BindPFlag("scanner.top-subnets", ScannerCmd.Flags().Lookup("top-subnets"))
+	viper.BindPFlag("scanner.seed", ScannerCmd.Flags().Lookup("seed"))
+	viper.BindPFlag("scanner.count", ScannerCmd.Flags().Lookup("count"))
+	viper.BindPFlag("scanner.timeout", ScannerCmd.Flags().Lookup("timeout"))
+	viper.BindPFlag("scanner.max-probes", ScannerCmd.Flags().Lookup("max-probes"))
+	viper.BindPFlag("scanner.min-results", ScannerCmd.Flags().Lookup("min-results"))
+	viper.BindPFlag("scanner.resume", ScannerCmd.Flags().Lookup("resume"))
+	viper.BindPFlag("scanner.verify", ScannerCmd.Flags().Lookup("verify"))
+	viper.BindPFlag("scanner.bench", ScannerCmd.Flags().Lookup("bench"))
+	viper.BindPFlag("scanner.bench-top", ScannerCmd.Flags().Lookup("bench-top"))
+
+	addObfuscationFlag(ScannerCmd, "obfuscation", "scanner.obfuscation", statute.ObfuscationScannerDefault, "Junk packets sent before each probe")
+	addReservedFlag(ScannerCmd, "scanner.reserved")
+	addTargetFlags(ScannerCmd, "", "scanner.")
+	addBenchFlags(ScannerCmd, "bench-", "scanner.")
+}
+
+// scanCheckpointFile is the file in the data directory that 'scanner --resume'
+// saves its progress to.
+const scanCheckpointFile = "scan-checkpoint.json"
+
+// scanResult is an entry of the array printed by 'scanner' with --output json|yaml.
+// Durations are given in nanoseconds, like in the endpoint cache, and Loss
+// in percent.
+type scanResult struct {
+	Addr      string        `json:"addr"`
+	Port      uint16        `json:"port"`
+	RTT       time.Duration `json:"rtt"`
+	MinRTT    time.Duration `json:"min_rtt"`
+	AvgRTT    time.Duration `json:"avg_rtt"`
+	MaxRTT    time.Duration `json:"max_rtt"`
+	StdDevRTT time.Duration `json:"stddev_rtt"`
+	Loss      float64       `json:"loss"`
+	Score     time.Duration `json:"score"`
+	CreatedAt time.Time     `json:"created_at"`
+	// Colo is the Cloudflare data center that answered the http-trace
+	// probe.
+	Colo string `json:"colo,omitempty"`
+	// Ports are all ports that answered, fastest first.
+	Ports []statute.PortResult `json:"ports,omitempty"`
+	// DownloadMbps and UploadMbps are set for the endpoints benchmarked
+	// with --bench.
+	DownloadMbps float64 `json:"download_mbps,omitempty"`
+	UploadMbps   float64 `json:"upload_mbps,omitempty"`
+}
+
+// subnetScanResult is printed by 'scanner --mode subnets' with --output json|yaml.
+type subnetScanResult struct {
+	Subnets   []statute.SubnetStats `json:"subnets"`
+	Endpoints []scanResult          `json:"endpoints"`
 }
 
 func runScanner(cmd *cobra.Command, args []string) {
@@ -49,6 +146,62 @@ func runScanner(cmd *cobra.Command, args []string) {
 		fatal(fmt.Errorf("failed to load identity: %w", err))
 	}
 
+	obfuscation, err := obfuscationProfile("scanner.obfuscation")
+	if err != nil {
+		fatal(err)
+	}
+
+	reserved, err := reservedBytes("scanner.reserved", identity)
+	if err != nil {
+		fatal(err)
+	}
+
+	targets, err := resolveTargets("", "scanner.")
+	if err != nil {
+		fatal(err)
+	}
+	strategy, err := statute.ParsePortStrategy(viper.GetString("scanner.port-strategy"))
+	if err != nil {
+		fatal(err)
+	}
+	mode, err := statute.ParseScanMode(viper.GetString("scanner.mode"))
+	if err != nil {
+		fatal(err)
+	}
+	for _, name := range []string{"subnet-probes", "max-subnets", "top-subnets"} {
+		if n := viper.GetInt("scanner." + name); n <= 0 {
+			fatal(fmt.Errorf("--%s must be greater than 0, got %d", name, n))
+		}
+	}
+	probe := viper.GetString("scanner.probe")
+	if _, err := ping.LookupProbe(probe); err != nil {
+		fatal(err)
+	}
+	cidrs := targets.Cidrs
+	if len(cidrs) == 0 {
+		// The WARP ranges only answer WireGuard; the other probes measure
+		// Cloudflare's anycast network instead.
+		cidrs = network.ScannerPrefixes()
+		if !ping.IsWarpProbe(probe) {
+			cidrs = statute.DefaultCFRanges()
+		}
+	}
+	if !ping.IsWarpProbe(probe) && (viper.GetBool("scanner.verify") || viper.GetBool("scanner.bench")) {
+		fatal(fmt.Errorf("--verify and --bench require the %s probe", ping.ProbeWarp))
+	}
+	var checkpoint string
+	if viper.GetBool("scanner.resume") {
+		if mode == statute.ScanSubnets {
+			fatal(errors.New("--resume is not supported in subnets mode"))
+		}
+		checkpoint = filepath.Join(datadir.GetDataDir(), scanCheckpointFile)
+	}
+	if len(targets.Ports) > 0 && strategy == statute.PortsAll {
+		strategy = statute.PortsFixed
+	} else if len(targets.Ports) == 0 && strategy == statute.PortsFixed {
+		fatal(errors.New("the fixed port strategy requires --ports"))
+	}
+
 	// Essentially doing XNOR to make sure that if they are both false
 	// or both true, just set them both true.
 	if v4 == v6 {
@@ -67,17 +220,52 @@ func runScanner(cmd *cobra.Command, args []string) {
 	log.Info("Starting IP scanning...")
 	log.Info("Press CTRL+C to stop the scanner at any time.")
 
-	// new scanner
-	scanner := ipscanner.NewScanner(
+	scanOpts := []ipscanner.Option{
 		ipscanner.WithWarpPrivateKey(identity.PrivateKey),
 		ipscanner.WithWarpPeerPublicKey(identity.Config.Peers[0].PublicKey),
 		ipscanner.WithUseIPv4(v4),
 		ipscanner.WithUseIPv6(v6),
 		ipscanner.WithMaxDesirableRTT(rtt),
-		ipscanner.WithCidrList(network.ScannerPrefixes()),
+		ipscanner.WithCidrList(cidrs),
+		ipscanner.WithExclude(targets.Exclude),
 		ipscanner.WithIPQueueSize(0xffff),
 		ipscanner.WithContext(ctx),
-	)
+		ipscanner.WithObfuscation(obfuscation),
+		ipscanner.WithWarpReserved(reserved),
+		ipscanner.WithConcurrency(viper.GetInt("scanner.concurrency")),
+		ipscanner.WithRate(viper.GetInt("scanner.rate")),
+		ipscanner.WithPortStrategy(strategy, viper.GetInt("scanner.port-count")),
+		ipscanner.WithPorts(targets.Ports),
+		ipscanner.WithSamples(viper.GetInt("scanner.samples")),
+		ipscanner.WithSeed(viper.GetUint64("scanner.seed")),
+		ipscanner.WithScoreWeights(statute.ScoreWeights{
+			Jitter: viper.GetFloat64("scanner.jitter-weight"),
+			Loss:   viper.GetDuration("scanner.loss-penalty"),
+		}),
+		ipscanner.WithScanMode(mode),
+		ipscanner.WithSubnetOptions(statute.SubnetOptions{
+			Bits4:      viper.GetInt("scanner.subnet-bits"),
+			Bits6:      viper.GetInt("scanner.subnet-bits6"),
+			Probes:     viper.GetInt("scanner.subnet-probes"),
+			MaxPerCIDR: viper.GetInt("scanner.max-subnets"),
+			Top:        viper.GetInt("scanner.top-subnets"),
+		}),
+		ipscanner.WithCount(viper.GetInt("scanner.count")),
+		ipscanner.WithTimeout(viper.GetDuration("scanner.timeout")),
+		ipscanner.WithMaxProbes(viper.GetInt64("scanner.max-probes")),
+		ipscanner.WithMinResults(viper.GetInt("scanner.min-results")),
+		ipscanner.WithCheckpoint(checkpoint),
+		ipscanner.WithProbe(probe),
+		ipscanner.WithProbeHost(viper.GetString("scanner.probe-host")),
+	}
+	if viper.GetBool("scanner.verify") {
+		src, err := netip.ParseAddr(identity.Config.Interface.Addresses.V4)
+		if err != nil || !src.Is4() {
+			fatal(errors.New("--verify requires an identity with an IPv4 tunnel address"))
+		}
+		scanOpts = append(scanOpts, ipscanner.WithVerify(statute.VerifyOptions{Source: src}))
+	}
+	scanner := ipscanner.NewScanner(scanOpts...)
 
 	if err := scanner.Run(); err != nil {
 		if !errors.Is(err, context.Canceled) {
@@ -88,20 +276,117 @@ func runScanner(cmd *cobra.Command, args []string) {
 	log.Info("IP scanning process completed.")
 
 	ipList := scanner.GetAvailableIPs()
+	subnets := scanner.GetSubnetStats()
 
-	if len(ipList) == 0 {
-		log.Info("No desirable IP endpoints were found during the scan.")
+	throughput := make(map[string]core.BenchResult)
+	if viper.GetBool("scanner.bench") && len(ipList) > 0 {
+		var endpoints []string
+		for _, info := range ipList[:min(viper.GetInt("scanner.bench-top"), len(ipList))] {
+			endpoints = append(endpoints, info.AddrPort.String())
+		}
+
+		opts := benchOptions("bench-", "scanner.")
+		opts.Obfuscation = obfuscation
+		opts.Reserved = reserved
+
+		// The scan may have been stopped with CTRL+C, so the benchmark
+		// listens for its own interrupt.
+		benchCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		for _, r := range benchmark(benchCtx, identity, endpoints, opts) {
+			throughput[r.Endpoint] = r.BenchResult
+		}
+		stop()
+	}
+
+	if structuredOutput() {
+		results := make([]scanResult, 0, len(ipList))
+		for _, info := range ipList {
+			results = append(results, scanResult{
+				Addr:      info.AddrPort.Addr().String(),
+				Port:      info.AddrPort.Port(),
+				RTT:       info.RTT,
+				MinRTT:    info.MinRTT,
+				AvgRTT:    info.AvgRTT,
+				MaxRTT:    info.MaxRTT,
+				StdDevRTT: info.StdDevRTT,
+				Loss:      info.Loss,
+				Score:     info.Score,
+				CreatedAt: info.CreatedAt,
+				Colo:      info.Colo,
+				Ports:     info.Ports,
+
+				DownloadMbps: throughput[info.AddrPort.String()].Download,
+				UploadMbps:   throughput[info.AddrPort.String()].Upload,
+			})
+		}
+		var out any = results
+		if mode == statute.ScanSubnets {
+			out = subnetScanResult{Subnets: subnets, Endpoints: results}
+		}
+		if err := printStructured(out); err != nil {
+			fatal(err)
+		}
 		return
 	}
 
 	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
 	columnFmt := color.New(color.FgYellow).SprintfFunc()
 
-	tbl := table.New("Address", "RTT (ping)", "Time")
+	if len(subnets) > 0 {
+		tbl := table.New("Subnet", "Score", "RTT (avg)", "Answered", "Deep scan")
+		tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+		for _, s := range subnets {
+			if s.Answered == 0 {
+				continue
+			}
+			tbl.AddRow(
+				s.Prefix,
+				s.Score.Round(time.Microsecond),
+				s.AvgRTT.Round(time.Microsecond),
+				fmt.Sprintf("%d/%d", s.Answered, s.Probed),
+				s.DeepScanned,
+			)
+		}
+		tbl.Print()
+		fmt.Println()
+	}
+
+	if len(ipList) == 0 {
+		log.Info("No desirable IP endpoints were found during the scan.")
+		return
+	}
+
+	columns := []any{"Address", "Score", "RTT (avg)", "Jitter", "Loss", "Ports", "Time"}
+	showColo := slices.ContainsFunc(ipList, func(info statute.IPInfo) bool {
+		return info.Colo != ""
+	})
+	if showColo {
+		columns = append(columns, "Colo")
+	}
+	if len(throughput) > 0 {
+		columns = append(columns, "Download", "Upload")
+	}
+	tbl := table.New(columns...)
 	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
 
 	for _, info := range ipList {
-		tbl.AddRow(info.AddrPort, info.RTT, info.CreatedAt.Format(time.DateTime))
+		row := []any{
+			info.AddrPort,
+			info.Score.Round(time.Microsecond),
+			info.AvgRTT.Round(time.Microsecond),
+			info.StdDevRTT.Round(time.Microsecond),
+			fmt.Sprintf("%.0f%%", info.Loss),
+			len(info.Ports),
+			info.CreatedAt.Format(time.DateTime),
+		}
+		if showColo {
+			row = append(row, info.Colo)
+		}
+		if len(throughput) > 0 {
+			r := throughput[info.AddrPort.String()]
+			row = append(row, formatMbps(r.Download), formatMbps(r.Upload))
+		}
+		tbl.AddRow(row...)
 	}
 
 	tbl.Print()
@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math"
+	"strconv"
 	"strings"
 
+	"github.com/shahradelahi/cloudflare-warp/cloudflare"
 	"github.com/shahradelahi/cloudflare-warp/cloudflare/model"
 )
 
@@ -34,14 +37,79 @@ func F32ToHumanReadable(number float32) string {
 	return fmt.Sprintf("%.2f B", number)
 }
 
+// ParseHumanReadable parses a byte size such as "512", "1.5GB" or "2GiB".
+// Decimal units (KB, MB, ...) use powers of 1000; binary units (KiB, MiB, ...)
+// and bare letters (K, M, ...) use powers of 1024.
+func ParseHumanReadable(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i == -1 {
+		i = len(s)
+	}
+
+	number, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	unit := strings.ToUpper(strings.TrimSpace(s[i:]))
+	base := 1024.0
+	switch {
+	case unit == "" || unit == "B":
+		return int64(number), nil
+	case strings.HasSuffix(unit, "IB"):
+		unit = strings.TrimSuffix(unit, "IB")
+	case strings.HasSuffix(unit, "B"):
+		unit = strings.TrimSuffix(unit, "B")
+		base = 1000
+	}
+
+	exp := strings.Index("KMGTPE", unit) + 1
+	if len(unit) != 1 || exp == 0 {
+		return 0, fmt.Errorf("invalid size unit in %q", s)
+	}
+
+	return int64(number * math.Pow(base, float64(exp))), nil
+}
+
 func PrintDeviceData(thisDevice *model.Identity, boundDevice *model.IdentityDevice) {
 	log.Println("=======================================")
 	log.Printf("% -13s : %s\n", "Device name", boundDevice.Name)
 	log.Printf("% -13s : %s\n", "Device model", thisDevice.Model)
 	log.Printf("% -13s : %t\n", "Device active", boundDevice.Active)
 	log.Printf("% -13s : %s\n", "Account type", thisDevice.Account.AccountType)
+	if thisDevice.Account.Organization != "" {
+		log.Printf("% -13s : %s\n", "Organization", thisDevice.Account.Organization)
+	}
 	log.Printf("% -13s : %s\n", "Role", thisDevice.Account.Role)
 	log.Printf("% -13s : %s\n", "Premium data", F32ToHumanReadable(float32(thisDevice.Account.PremiumData)))
 	log.Printf("% -13s : %s\n", "Quota", F32ToHumanReadable(float32(thisDevice.Account.Quota)))
 	log.Println("=======================================")
 }
+
+// describeAPIError adds a hint on how to resolve well-known WARP API failures.
+// Errors that are not recognised are returned unchanged.
+func describeAPIError(err error) error {
+	var hint string
+	switch {
+	case errors.Is(err, cloudflare.ErrUnauthorized), errors.Is(err, cloudflare.ErrNotFound):
+		hint = "The registration was revoked or deleted. Remove reg.json and conf.json from the data directory and run 'warp generate' to register again"
+	case errors.Is(err, cloudflare.ErrTooManyDevices):
+		hint = "The license is already bound to the maximum number of devices. Remove a device in the 1.1.1.1 app and try again"
+	case errors.Is(err, cloudflare.ErrInvalidLicense):
+		hint = "The license key was rejected. Only keys from the official 1.1.1.1 app are supported"
+	case errors.Is(err, cloudflare.ErrRateLimited):
+		hint = "Cloudflare is rate limiting requests. Try again later"
+		var apiErr *cloudflare.APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			hint = fmt.Sprintf("Cloudflare is rate limiting requests. Try again in %s", apiErr.RetryAfter)
+		}
+	case errors.Is(err, cloudflare.ErrServerError):
+		hint = "The WARP API is currently unavailable. Try again later"
+	default:
+		return err
+	}
+	return fmt.Errorf("%w. %s", err, hint)
+}
@@ -1,14 +1,20 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 
 	"github.com/shahradelahi/cloudflare-warp/cloudflare"
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/model"
 )
 
 var statusShortMsg = "Prints the status of the current Cloudflare Warp device"
@@ -16,35 +22,103 @@ var statusShortMsg = "Prints the status of the current Cloudflare Warp device"
 var StatusCmd = &cobra.Command{
 	Use:   "status",
 	Short: statusShortMsg,
-	Long:  FormatMessage(statusShortMsg, ``),
+	Long: FormatMessage(statusShortMsg, `
+Every run records the remaining WARP+ data in the data directory. With --watch the account
+is polled periodically, the depletion date is projected from past usage, and an alert is
+raised (warning log and/or webhook) once when the balance drops below --alert-below. With
+--alert-exit, every run exits with status 2 while the balance is below it.`),
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := status(); err != nil {
+		if err := status(cmd.Context()); err != nil {
+			if errors.Is(err, errUsageAlert) {
+				os.Exit(alertExitCode)
+			}
 			log.Fatal(err)
 		}
 	},
 }
 
-func status() error {
+func init() {
+	StatusCmd.Flags().Bool("watch", false, "Keep polling the account and report WARP+ data usage.")
+	StatusCmd.Flags().Duration("interval", 10*time.Minute, "Polling interval used with --watch (e.g., 10m).")
+	StatusCmd.Flags().String("alert-below", "", "Raise an alert when remaining WARP+ data drops below this size (e.g., 1GiB).")
+	StatusCmd.Flags().String("alert-webhook", "", "URL to POST a JSON alert to when the alert is raised.")
+	StatusCmd.Flags().Bool("alert-exit", false, "Exit with status 2 while remaining WARP+ data is below --alert-below.")
+
+	viper.BindPFlag("status.watch", StatusCmd.Flags().Lookup("watch"))
+	viper.BindPFlag("status.interval", StatusCmd.Flags().Lookup("interval"))
+	viper.BindPFlag("status.alert-below", StatusCmd.Flags().Lookup("alert-below"))
+	viper.BindPFlag("status.alert-webhook", StatusCmd.Flags().Lookup("alert-webhook"))
+	viper.BindPFlag("status.alert-exit", StatusCmd.Flags().Lookup("alert-exit"))
+}
+
+// statusResult is the document printed by 'status' with --output json|yaml.
+type statusResult struct {
+	Device      *model.Identity        `json:"device"`
+	BoundDevice *model.IdentityDevice  `json:"bound_device"`
+	Account     *model.IdentityAccount `json:"account"`
+}
+
+func status(ctx context.Context) error {
 	identity, err := cloudflare.LoadIdentity()
 	if err != nil {
-		if os.IsNotExist(err) || errors.Is(err, errors.New("identity contains 0 peers")) {
+		if os.IsNotExist(err) || errors.Is(err, cloudflare.ErrNoPeers) {
 			return fmt.Errorf("WARP identity not found. Please run 'warp generate' to create one")
 		}
 		return err
 	}
 
+	monitor, err := newUsageMonitor(identity.Account.ID)
+	if err != nil {
+		return err
+	}
+
 	warpAPI := cloudflare.NewWarpAPI()
 
-	thisDevice, err := warpAPI.GetSourceDevice(identity.Token, identity.ID)
+	result, err := fetchStatus(ctx, warpAPI, identity)
 	if err != nil {
 		return err
 	}
 
-	boundDevice, err := warpAPI.GetSourceBoundDevice(identity.Token, identity.ID)
-	if err != nil {
+	if structuredOutput() {
+		if err := printStructured(result); err != nil {
+			return err
+		}
+	} else {
+		PrintDeviceData(result.Device, result.BoundDevice)
+	}
+
+	if err := monitor.record(ctx, *result.Account); err != nil {
 		return err
 	}
 
-	PrintDeviceData(&thisDevice, boundDevice)
-	return nil
+	if !viper.GetBool("status.watch") {
+		return nil
+	}
+
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	return monitor.watch(ctx, warpAPI, identity, viper.GetDuration("status.interval"))
+}
+
+// fetchStatus queries the API for the current device, its bound device and
+// account.
+func fetchStatus(ctx context.Context, warpAPI *cloudflare.WarpAPI, identity *model.Identity) (statusResult, error) {
+	thisDevice, err := warpAPI.GetSourceDevice(ctx, identity.Token, identity.ID)
+	if err != nil {
+		return statusResult{}, describeAPIError(err)
+	}
+
+	// The organization is not always echoed back by the API; fall back to the
+	// one recorded when the device was enrolled.
+	if thisDevice.Account.Organization == "" {
+		thisDevice.Account.Organization = identity.Account.Organization
+	}
+
+	boundDevice, err := warpAPI.GetSourceBoundDevice(ctx, identity.Token, identity.ID)
+	if err != nil {
+		return statusResult{}, describeAPIError(err)
+	}
+
+	return statusResult{Device: &thisDevice, BoundDevice: boundDevice, Account: &thisDevice.Account}, nil
 }
@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// scanTargets are the addresses and ports selected with the target flags.
+type scanTargets struct {
+	// Cidrs are the prefixes to scan, nil for the built-in ones.
+	Cidrs []netip.Prefix
+	// Ports are the ports to probe, nil for the built-in ones.
+	Ports   []uint16
+	Exclude []netip.Prefix
+}
+
+// addTargetFlags registers --cidr, --cidr-file, --ports and --exclude on cmd,
+// each name preceded by flagPrefix. They are bound to the viper keys
+// keyPrefix+flag name.
+func addTargetFlags(cmd *cobra.Command, flagPrefix, keyPrefix string) {
+	flags := map[string]string{
+		"cidr":      "CIDR or IP to scan instead of the built-in ranges; can be repeated or comma-separated.",
+		"cidr-file": "File of CIDRs or IPs to scan, one per line; # starts a comment.",
+		"ports":     "Ports to probe instead of the built-in WARP ports, with ranges (e.g., 500,854-1000).",
+		"exclude":   "CIDR, IP or file of CIDRs and IPs to skip; can be repeated or comma-separated.",
+	}
+	for _, name := range []string{"cidr", "cidr-file", "ports", "exclude"} {
+		flag := flagPrefix + name
+		if name == "cidr-file" {
+			cmd.Flags().String(flag, "", flags[name])
+		} else {
+			cmd.Flags().StringSlice(flag, nil, flags[name])
+		}
+		viper.BindPFlag(keyPrefix+flag, cmd.Flags().Lookup(flag))
+	}
+}
+
+// resolveTargets resolves the flags registered by addTargetFlags.
+func resolveTargets(flagPrefix, keyPrefix string) (scanTargets, error) {
+	key := func(name string) string {
+		return keyPrefix + flagPrefix + name
+	}
+
+	var t scanTargets
+	for _, value := range viper.GetStringSlice(key("cidr")) {
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return t, err
+		}
+		t.Cidrs = append(t.Cidrs, prefix)
+	}
+	if path := viper.GetString(key("cidr-file")); path != "" {
+		prefixes, err := readPrefixFile(path)
+		if err != nil {
+			return t, err
+		}
+		if len(prefixes) == 0 {
+			return t, fmt.Errorf("%s lists no CIDR", path)
+		}
+		t.Cidrs = append(t.Cidrs, prefixes...)
+	}
+	t.Cidrs = dedupePrefixes(t.Cidrs)
+
+	ports, err := parsePorts(viper.GetStringSlice(key("ports")))
+	if err != nil {
+		return t, err
+	}
+	t.Ports = ports
+
+	for _, value := range viper.GetStringSlice(key("exclude")) {
+		if prefix, err := parsePrefix(value); err == nil {
+			t.Exclude = append(t.Exclude, prefix)
+			continue
+		}
+		prefixes, err := readPrefixFile(value)
+		if err != nil {
+			return t, fmt.Errorf("invalid exclusion %q: not a CIDR, an IP or a readable file: %w", value, err)
+		}
+		t.Exclude = append(t.Exclude, prefixes...)
+	}
+	t.Exclude = dedupePrefixes(t.Exclude)
+
+	return t, nil
+}
+
+// parsePrefix parses a CIDR, or an IP as a single-address prefix.
+func parsePrefix(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", value)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR or IP %q", value)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// readPrefixFile reads a file of CIDRs and IPs, one per line. Blank lines and
+// text after # are ignored.
+func readPrefixFile(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		prefix, err := parsePrefix(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, scanner.Err()
+}
+
+// dedupePrefixes drops the prefixes that are equal to or contained in
+// another, so that no address is scanned twice. The others keep their order.
+func dedupePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	var kept []netip.Prefix
+	for i, prefix := range prefixes {
+		covered := false
+		for j, other := range prefixes {
+			if j == i || other.Bits() > prefix.Bits() || !other.Contains(prefix.Addr()) {
+				continue
+			}
+			// Of equal prefixes, only the first is kept.
+			if other.Bits() < prefix.Bits() || j < i {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			kept = append(kept, prefix)
+		}
+	}
+	return kept
+}
+
+// parsePorts parses a list of UDP ports and port ranges such as 854-1000,
+// dropping duplicates.
+func parsePorts(values []string) ([]uint16, error) {
+	var ports []uint16
+	seen := make(map[uint16]bool)
+	for _, value := range values {
+		first, last, isRange := strings.Cut(strings.TrimSpace(value), "-")
+		if !isRange {
+			last = first
+		}
+		from, err := parsePort(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", value)
+		}
+		to, err := parsePort(last)
+		if err != nil || to < from {
+			return nil, fmt.Errorf("invalid port range %q", value)
+		}
+		for port := uint32(from); port <= uint32(to); port++ {
+			if !seen[uint16(port)] {
+				seen[uint16(port)] = true
+				ports = append(ports, uint16(port))
+			}
+		}
+	}
+	return ports, nil
+}
+
+func parsePort(value string) (uint16, error) {
+	port, err := strconv.ParseUint(strings.TrimSpace(value), 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port %q", value)
+	}
+	return uint16(port), nil
+}
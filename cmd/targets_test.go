@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    []uint16
+		wantErr bool
+	}{
+		{name: "none", values: nil, want: nil},
+		{name: "single", values: []string{"2408"}, want: []uint16{2408}},
+		{name: "range", values: []string{"854-857"}, want: []uint16{854, 855, 856, 857}},
+		{name: "list and range", values: []string{"500", " 1000-1001 "}, want: []uint16{500, 1000, 1001}},
+		{name: "duplicates", values: []string{"500-502", "501", "500"}, want: []uint16{500, 501, 502}},
+		{name: "upper bound", values: []string{"65535"}, want: []uint16{65535}},
+		{name: "reversed range", values: []string{"1000-854"}, wantErr: true},
+		{name: "port 0", values: []string{"0"}, wantErr: true},
+		{name: "range from 0", values: []string{"0-10"}, wantErr: true},
+		{name: "out of range", values: []string{"65536"}, wantErr: true},
+		{name: "not a number", values: []string{"http"}, wantErr: true},
+		{name: "open range", values: []string{"500-"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePorts(tt.values)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestReadPrefixFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []netip.Prefix
+		wantErr string
+	}{
+		{
+			name:    "comments and blank lines",
+			content: "# WARP ranges\n162.159.192.0/24\n\n  162.159.195.1  # a single IP\n#2606:4700::/48\n",
+			want: []netip.Prefix{
+				netip.MustParsePrefix("162.159.192.0/24"),
+				netip.MustParsePrefix("162.159.195.1/32"),
+			},
+		},
+		{
+			name:    "masked and IPv6",
+			content: "162.159.192.7/24\n2606:4700:d0::a29f:c001\n",
+			want: []netip.Prefix{
+				netip.MustParsePrefix("162.159.192.0/24"),
+				netip.MustParsePrefix("2606:4700:d0::a29f:c001/128"),
+			},
+		},
+		{
+			name:    "only comments",
+			content: "# nothing here\n",
+			want:    nil,
+		},
+		{
+			name:    "invalid line",
+			content: "162.159.192.0/24\nnot-a-cidr\n",
+			wantErr: ":2: invalid CIDR or IP",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cidrs.txt")
+			assert.NoError(t, os.WriteFile(path, []byte(tt.content), 0644))
+
+			got, err := readPrefixFile(path)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := readPrefixFile(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.Error(t, err)
+}
+
+func TestDedupePrefixes(t *testing.T) {
+	prefixes := func(values ...string) []netip.Prefix {
+		var out []netip.Prefix
+		for _, v := range values {
+			out = append(out, netip.MustParsePrefix(v))
+		}
+		return out
+	}
+
+	tests := []struct {
+		name  string
+		input []netip.Prefix
+		want  []netip.Prefix
+	}{
+		{
+			name:  "keeps input order",
+			input: prefixes("188.114.96.0/24", "162.159.192.0/22", "2606:4700:d0::/48"),
+			want:  prefixes("188.114.96.0/24", "162.159.192.0/22", "2606:4700:d0::/48"),
+		},
+		{
+			name:  "drops contained prefixes",
+			input: prefixes("162.159.192.0/24", "188.114.96.0/24", "162.159.192.0/22", "162.159.193.7/32"),
+			want:  prefixes("188.114.96.0/24", "162.159.192.0/22"),
+		},
+		{
+			name:  "keeps the first of equal prefixes",
+			input: prefixes("162.159.192.0/24", "188.114.96.0/24", "162.159.192.0/24"),
+			want:  prefixes("162.159.192.0/24", "188.114.96.0/24"),
+		},
+		{
+			name:  "adjacent prefixes are kept",
+			input: prefixes("162.159.193.0/24", "162.159.192.0/24"),
+			want:  prefixes("162.159.193.0/24", "162.159.192.0/24"),
+		},
+		{
+			name:  "families do not contain each other",
+			input: prefixes("::/0", "0.0.0.0/0", "1.1.1.1/32"),
+			want:  prefixes("::/0", "0.0.0.0/0"),
+		},
+		{
+			name:  "empty",
+			input: nil,
+			want:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, dedupePrefixes(tt.input))
+		})
+	}
+}
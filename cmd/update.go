@@ -1,16 +1,15 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"go.uber.org/zap"
 
 	"github.com/shahradelahi/cloudflare-warp/cloudflare"
-	"github.com/shahradelahi/cloudflare-warp/log"
 )
 
 var updateShortMsg = "Updates the Cloudflare Warp device configuration"
@@ -20,7 +19,7 @@ var UpdateCmd = &cobra.Command{
 	Short: updateShortMsg,
 	Long:  FormatMessage(updateShortMsg, `Updates device name and/or license key.`),
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := runUpdate(); err != nil {
+		if err := runUpdate(cmd.Context()); err != nil {
 			fmt.Println(err)
 		}
 	},
@@ -33,7 +32,7 @@ func init() {
 	viper.BindPFlag("update.license", UpdateCmd.Flags().Lookup("license"))
 }
 
-func runUpdate() error {
+func runUpdate(ctx context.Context) error {
 	name := viper.GetString("update.name")
 	license := viper.GetString("update.license")
 
@@ -43,7 +42,7 @@ func runUpdate() error {
 
 	identity, err := cloudflare.LoadIdentity()
 	if err != nil {
-		if os.IsNotExist(err) || errors.Is(err, errors.New("identity contains 0 peers")) {
+		if os.IsNotExist(err) || errors.Is(err, cloudflare.ErrNoPeers) {
 			return fmt.Errorf("WARP identity not found. Please run 'warp generate' to create one")
 		}
 		return err
@@ -54,9 +53,9 @@ func runUpdate() error {
 
 	// Update device name if provided
 	if name != "" {
-		_, err = warpAPI.UpdateSourceDevice(identity.Token, identity.ID, map[string]interface{}{"name": name})
+		_, err = warpAPI.UpdateSourceDevice(ctx, identity.Token, identity.ID, map[string]interface{}{"name": name})
 		if err != nil {
-			return fmt.Errorf("failed to update device name: %w", err)
+			return fmt.Errorf("failed to update device name: %w", describeAPIError(err))
 		}
 		fmt.Println("Device name updated successfully.")
 		updated = true
@@ -65,9 +64,9 @@ func runUpdate() error {
 	// Update license if provided
 	if license != "" {
 		// Generate configs
-		identity, err = cloudflare.CreateOrUpdateIdentity(license)
+		identity, err = cloudflare.CreateOrUpdateIdentity(ctx, warpAPI, license)
 		if err != nil {
-			log.Fatalw("Failed to generate primary identity", zap.Error(err))
+			return fmt.Errorf("failed to update license: %w", describeAPIError(err))
 		}
 
 		fmt.Println("License updated successfully.")
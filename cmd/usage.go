@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/shahradelahi/cloudflare-warp/cloudflare"
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/model"
+	"github.com/shahradelahi/cloudflare-warp/core/usage"
+	"github.com/shahradelahi/cloudflare-warp/log"
+)
+
+// alertExitCode is the exit status used by --alert-exit so scripts can tell a
+// low-quota alert apart from other failures.
+const alertExitCode = 2
+
+// errUsageAlert is returned by the status command when --alert-exit is set and
+// the remaining data is below the threshold, so it can exit with
+// alertExitCode after cleaning up.
+var errUsageAlert = errors.New("remaining WARP+ data is below the alert threshold")
+
+type usageMonitor struct {
+	accountID string
+	history   *usage.History
+	watcher   *usage.Watcher
+	webhook   string
+	exit      bool
+}
+
+func newUsageMonitor(accountID string) (*usageMonitor, error) {
+	var threshold int64
+	if s := viper.GetString("status.alert-below"); s != "" {
+		var err error
+		threshold, err = ParseHumanReadable(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --alert-below value: %w", err)
+		}
+	}
+
+	history, err := usage.Load()
+	if err != nil {
+		log.Warnw("Failed to load usage history; starting with an empty history", zap.Error(err))
+	}
+	history.SetAccount(accountID)
+
+	return &usageMonitor{
+		accountID: accountID,
+		history:   history,
+		watcher:   &usage.Watcher{Threshold: threshold, Below: history.Below},
+		webhook:   viper.GetString("status.alert-webhook"),
+		exit:      viper.GetBool("status.alert-exit"),
+	}, nil
+}
+
+// record stores a sample of the account counters and raises an alert when
+// the remaining premium data crosses below the configured threshold. It
+// returns errUsageAlert when --alert-exit is set and the data is below the
+// threshold, whether or not this sample is the one that crossed it.
+func (m *usageMonitor) record(ctx context.Context, account model.IdentityAccount) error {
+	sample := usage.Sample{
+		Time:        time.Now(),
+		PremiumData: account.PremiumData,
+		Quota:       account.Quota,
+		Usage:       account.Usage,
+	}
+
+	m.history.Add(sample)
+	raised := m.watcher.Check(sample)
+	m.history.Below = m.watcher.Below
+	if err := m.history.Save(); err != nil {
+		log.Warnw("Failed to save usage history", zap.Error(err))
+	}
+
+	fields := []interface{}{zap.String("premium_data", F32ToHumanReadable(float32(sample.PremiumData)))}
+	projection, ok := m.history.Project()
+	if ok {
+		fields = append(fields,
+			zap.String("rate", F32ToHumanReadable(float32(projection.Rate*3600))+"/h"),
+			zap.Time("projected_depletion", projection.Depletion),
+		)
+	}
+	log.Infow("WARP+ data usage", fields...)
+
+	if raised {
+		m.alert(ctx, sample, projection, ok)
+	}
+
+	// The crossing state only silences repeated alerts; the exit status
+	// reports the current balance so every run of a script sees it.
+	if m.exit && m.watcher.Below {
+		return errUsageAlert
+	}
+	return nil
+}
+
+// alert logs the crossing and delivers the webhook.
+func (m *usageMonitor) alert(ctx context.Context, sample usage.Sample, projection usage.Projection, projected bool) {
+	alert := usage.Alert{
+		Event:       usage.AlertEvent,
+		AccountID:   m.accountID,
+		PremiumData: sample.PremiumData,
+		Threshold:   m.watcher.Threshold,
+		Time:        sample.Time,
+	}
+	if projected {
+		alert.Depletion = &projection.Depletion
+	}
+
+	log.Warnw("Remaining WARP+ data is below the alert threshold",
+		zap.String("premium_data", F32ToHumanReadable(float32(alert.PremiumData))),
+		zap.String("threshold", F32ToHumanReadable(float32(alert.Threshold))),
+	)
+
+	if m.webhook != "" {
+		if err := usage.SendWebhook(ctx, m.webhook, alert); err != nil {
+			log.Errorw("Failed to deliver usage alert webhook", zap.Error(err))
+		}
+	}
+}
+
+// watch polls the account every interval until ctx is cancelled. With
+// --output, each poll prints the same statusResult document as the first run.
+func (m *usageMonitor) watch(ctx context.Context, warpAPI *cloudflare.WarpAPI, identity *model.Identity, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid --interval value: %s", interval)
+	}
+
+	log.Infow("Watching WARP+ data usage", zap.Duration("interval", interval))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			result, err := fetchStatus(ctx, warpAPI, identity)
+			if err != nil {
+				log.Errorw("Failed to fetch WARP status", zap.Error(err))
+				continue
+			}
+			if structuredOutput() {
+				if err := printStructured(result); err != nil {
+					return err
+				}
+			}
+			if err := m.record(ctx, *result.Account); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+
+	"github.com/shahradelahi/wiresocks"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/shahradelahi/cloudflare-warp/core"
+)
+
+// mtuAuto is the --mtu value that probes the path MTU.
+const mtuAuto = "auto"
+
+// addWireguardFlags registers the WireGuard generation flags shared by
+// 'generate' and 'run', bound to viper keys starting with prefix.
+func addWireguardFlags(cmd *cobra.Command, prefix, defaultMTU string) {
+	flags := cmd.Flags()
+	flags.String("mtu", defaultMTU, "MTU of the WireGuard interface, or 'auto' to probe the path to the endpoint.")
+	flags.StringSlice("allowed-ips", nil, "Destinations routed through the tunnel (default 0.0.0.0/0, ::/0).")
+	flags.Bool("exclude-private", false, "Exclude private and link-local networks from the allowed IPs.")
+	flags.Int("keepalive", 0, "Persistent keepalive interval in seconds, negative to disable (default 25 for generate, 5 for run).")
+	flags.Bool("ipv4-only", false, "Only use the IPv4 interface address, routes and DNS servers.")
+	flags.Bool("ipv6-only", false, "Only use the IPv6 interface address, routes and DNS servers.")
+
+	for _, name := range []string{"mtu", "allowed-ips", "exclude-private", "keepalive", "ipv4-only", "ipv6-only"} {
+		viper.BindPFlag(prefix+name, flags.Lookup(name))
+	}
+}
+
+// wireguardOptions reads the flags registered by addWireguardFlags.
+func wireguardOptions(prefix string) (core.WireguardOptions, error) {
+	opts := core.WireguardOptions{
+		ExcludePrivate: viper.GetBool(prefix + "exclude-private"),
+		KeepAlive:      viper.GetInt(prefix + "keepalive"),
+		IPv4Only:       viper.GetBool(prefix + "ipv4-only"),
+		IPv6Only:       viper.GetBool(prefix + "ipv6-only"),
+	}
+
+	if !autoMTU(prefix) {
+		mtu, err := strconv.Atoi(viper.GetString(prefix + "mtu"))
+		if err != nil || mtu < 576 || mtu > 65535 {
+			return opts, fmt.Errorf("invalid MTU %q (expected auto or a number between 576 and 65535)", viper.GetString(prefix+"mtu"))
+		}
+		opts.MTU = mtu
+	}
+	if opts.IPv4Only && opts.IPv6Only {
+		return opts, fmt.Errorf("can't use --ipv4-only and --ipv6-only at the same time")
+	}
+
+	for _, s := range viper.GetStringSlice(prefix + "allowed-ips") {
+		allowed, err := wiresocks.ParsePrefixOrAddr(s)
+		if err != nil {
+			return opts, fmt.Errorf("invalid allowed IP %q: %w", s, err)
+		}
+		opts.AllowedIPs = append(opts.AllowedIPs, allowed)
+	}
+
+	return opts, nil
+}
+
+// autoMTU reports whether the MTU should be discovered by probing.
+func autoMTU(prefix string) bool {
+	return viper.GetString(prefix+"mtu") == mtuAuto
+}
+
+func parseAddrs(values []string) ([]netip.Addr, error) {
+	addrs := make([]netip.Addr, 0, len(values))
+	for _, s := range values {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", s, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
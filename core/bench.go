@@ -0,0 +1,266 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shahradelahi/wiresocks"
+	"go.uber.org/zap"
+
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/model"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+	"github.com/shahradelahi/cloudflare-warp/log"
+)
+
+const (
+	// DefaultBenchDownloadURL and DefaultBenchUploadURL are Cloudflare's
+	// speed test endpoints.
+	DefaultBenchDownloadURL = "https://speed.cloudflare.com/__down?bytes=" + BenchBytesPlaceholder
+	DefaultBenchUploadURL   = "https://speed.cloudflare.com/__up"
+	DefaultBenchBytes       = 10_000_000
+	DefaultBenchUploadBytes = 5_000_000
+	DefaultBenchTimeout     = 30 * time.Second
+
+	// BenchBytesPlaceholder in a benchmark URL is replaced with the number
+	// of bytes to transfer.
+	BenchBytesPlaceholder = "{bytes}"
+)
+
+// BenchOptions configures Bench.
+type BenchOptions struct {
+	// DownloadURL is fetched and UploadURL posted to through the tunnel.
+	// The defaults are used when empty.
+	DownloadURL string
+	UploadURL   string
+	// DownloadBytes and UploadBytes are the amounts transferred. The
+	// download or upload is skipped when 0.
+	DownloadBytes int64
+	UploadBytes   int64
+	// Timeout bounds the whole benchmark of an endpoint, including the
+	// handshake. DefaultBenchTimeout when 0.
+	Timeout time.Duration
+	// DNS resolves the endpoint and is the tunnel's DNS server unless
+	// Wireguard.DNS is set. The first of DefaultDNS when unset.
+	DNS netip.Addr
+	// Obfuscation and Reserved are applied to the tunnel like in Engine.
+	Obfuscation *statute.ObfuscationProfile
+	Reserved    []byte
+	Wireguard   WireguardOptions
+}
+
+// BenchResult is the throughput measured through an endpoint.
+type BenchResult struct {
+	Endpoint string `json:"endpoint"`
+	// Latency is the time to the first byte of the download.
+	Latency time.Duration `json:"latency"`
+	// Download and Upload are in megabits per second.
+	Download float64 `json:"download_mbps"`
+	Upload   float64 `json:"upload_mbps"`
+}
+
+// Bench brings up a WireGuard session with endpoint and measures the
+// throughput of downloads and uploads through it. The session is torn down
+// before Bench returns.
+func Bench(ctx context.Context, ident *model.Identity, endpoint string, opts BenchOptions) (BenchResult, error) {
+	result := BenchResult{Endpoint: endpoint}
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultBenchTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	wgOpts := opts.Wireguard
+	wgOpts.Endpoint = endpoint
+	if len(wgOpts.DNS) == 0 && opts.DNS.IsValid() {
+		wgOpts.DNS = []netip.Addr{opts.DNS}
+	}
+	if opts.Obfuscation.Enabled() || len(opts.Reserved) > 0 {
+		r, err := startRelay(ctx, endpoint, resolver(opts.DNS), opts.Obfuscation, opts.Reserved)
+		if err != nil {
+			return result, err
+		}
+		defer r.Close()
+		wgOpts.Endpoint = r.Addr().String()
+	}
+
+	conf, err := GenerateWireguardConfig(ident, wgOpts)
+	if err != nil {
+		return result, err
+	}
+
+	proxyAddr, err := freeLoopbackAddr()
+	if err != nil {
+		return result, err
+	}
+	ws, err := wiresocks.NewWireSocks(
+		wiresocks.WithContext(ctx),
+		wiresocks.WithWireguardConfig(&conf),
+		wiresocks.WithProxyConfig(&wiresocks.ProxyConfig{HttpBindAddr: &proxyAddr}),
+	)
+	if err != nil {
+		return result, err
+	}
+
+	var runErr error
+	done := make(chan struct{})
+	go func() {
+		runErr = ws.Run()
+		close(done)
+	}()
+	defer func() {
+		ws.Stop()
+		<-done
+	}()
+
+	log.Debugw("Waiting for the benchmark tunnel", zap.String("endpoint", endpoint))
+	if err := waitListening(ctx, proxyAddr, done); err != nil {
+		select {
+		case <-done:
+			if runErr != nil {
+				err = runErr
+			}
+		default:
+		}
+		return result, fmt.Errorf("failed to bring up the tunnel: %w", err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: proxyAddr.String()}),
+	}}
+
+	if opts.DownloadBytes > 0 {
+		downloadURL := opts.DownloadURL
+		if downloadURL == "" {
+			downloadURL = DefaultBenchDownloadURL
+		}
+		result.Latency, result.Download, err = benchDownload(ctx, client, downloadURL, opts.DownloadBytes)
+		if err != nil {
+			return result, fmt.Errorf("download failed: %w", err)
+		}
+	}
+	if opts.UploadBytes > 0 {
+		uploadURL := opts.UploadURL
+		if uploadURL == "" {
+			uploadURL = DefaultBenchUploadURL
+		}
+		result.Upload, err = benchUpload(ctx, client, uploadURL, opts.UploadBytes)
+		if err != nil {
+			return result, fmt.Errorf("upload failed: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// benchDownload fetches up to n bytes from rawURL and returns the time to
+// the first byte and the throughput of the rest in Mbps.
+func benchDownload(ctx context.Context, client *http.Client, rawURL string, n int64) (time.Duration, float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, benchURL(rawURL, n), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	firstByte := time.Now()
+	read, err := io.Copy(io.Discard, io.LimitReader(resp.Body, n))
+	if err != nil {
+		return 0, 0, err
+	}
+	if read == 0 {
+		return 0, 0, errors.New("empty response")
+	}
+	return firstByte.Sub(start), mbps(read, time.Since(firstByte)), nil
+}
+
+// benchUpload posts n bytes to rawURL and returns the throughput in Mbps.
+func benchUpload(ctx context.Context, client *http.Client, rawURL string, n int64) (float64, error) {
+	body := io.LimitReader(zeroReader{}, n)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, benchURL(rawURL, n), body)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return mbps(n, time.Since(start)), nil
+}
+
+func benchURL(rawURL string, n int64) string {
+	return strings.ReplaceAll(rawURL, BenchBytesPlaceholder, strconv.FormatInt(n, 10))
+}
+
+func mbps(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		elapsed = time.Nanosecond
+	}
+	return float64(bytes) * 8 / elapsed.Seconds() / 1e6
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// freeLoopbackAddr returns a loopback address with a TCP port that was free
+// a moment ago.
+func freeLoopbackAddr() (netip.AddrPort, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	defer ln.Close()
+	return netip.ParseAddrPort(ln.Addr().String())
+}
+
+// waitListening waits until addr accepts TCP connections, done is closed or
+// ctx is done.
+func waitListening(ctx context.Context, addr netip.AddrPort, done <-chan struct{}) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		conn, err := net.DialTimeout("tcp", addr.String(), time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return errors.New("tunnel stopped")
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBenchTransfers(t *testing.T) {
+	var uploaded int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/down":
+			n, _ := strconv.Atoi(r.URL.Query().Get("bytes"))
+			w.Write(make([]byte, n))
+		case "/up":
+			uploaded, _ = io.Copy(io.Discard, r.Body)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	latency, download, err := benchDownload(context.Background(), srv.Client(), srv.URL+"/down?bytes="+BenchBytesPlaceholder, 1<<20)
+	assert.NoError(t, err)
+	assert.Positive(t, latency)
+	assert.Positive(t, download)
+
+	upload, err := benchUpload(context.Background(), srv.Client(), srv.URL+"/up", 1<<20)
+	assert.NoError(t, err)
+	assert.Positive(t, upload)
+	assert.Equal(t, int64(1<<20), uploaded)
+
+	_, _, err = benchDownload(context.Background(), srv.Client(), srv.URL+"/missing", 1<<20)
+	assert.Error(t, err)
+}
+
+func TestMbps(t *testing.T) {
+	assert.InDelta(t, 8.0, mbps(1_000_000, time.Second), 1e-9)
+}
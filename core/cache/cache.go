@@ -28,6 +28,10 @@ type Endpoint struct {
 	RTT       time.Duration `json:"rtt"`
 	Timestamp time.Time     `json:"timestamp"`
 	Failures  int           `json:"failures"`
+	// DownloadMbps and UploadMbps are the throughput measured through the
+	// endpoint by a benchmark, if any.
+	DownloadMbps float64 `json:"download_mbps,omitempty"`
+	UploadMbps   float64 `json:"upload_mbps,omitempty"`
 }
 
 // Cache stores the cached endpoints.
@@ -68,6 +72,29 @@ func (c *Cache) SaveEndpoint(address string, rtt time.Duration) {
 	})
 }
 
+// SaveThroughput records the benchmarked throughput of an endpoint, adding
+// the endpoint to the cache if needed.
+func (c *Cache) SaveThroughput(address string, download, upload float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i, endpoint := range c.Endpoints {
+		if endpoint.Address == address {
+			c.Endpoints[i].DownloadMbps = download
+			c.Endpoints[i].UploadMbps = upload
+			c.Endpoints[i].Timestamp = time.Now()
+			return
+		}
+	}
+
+	c.Endpoints = append(c.Endpoints, Endpoint{
+		Address:      address,
+		Timestamp:    time.Now(),
+		DownloadMbps: download,
+		UploadMbps:   upload,
+	})
+}
+
 // GetBestEndpoint retrieves the endpoint with the lowest RTT that has not failed more than maxFailures.
 func (c *Cache) GetBestEndpoint() (*Endpoint, error) {
 	c.mutex.Lock()
@@ -145,6 +172,28 @@ func (c *Cache) RecordFailure(address string) {
 	}
 }
 
+// MarkBad records that an endpoint answers handshakes but does not forward
+// data. It is kept with maxFailures failures, so that it is not picked again
+// until a later scan saves it.
+func (c *Cache) MarkBad(address string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i, endpoint := range c.Endpoints {
+		if endpoint.Address == address {
+			c.Endpoints[i].Failures = maxFailures
+			c.Endpoints[i].Timestamp = time.Now()
+			return
+		}
+	}
+
+	c.Endpoints = append(c.Endpoints, Endpoint{
+		Address:   address,
+		Timestamp: time.Now(),
+		Failures:  maxFailures,
+	})
+}
+
 // RecordSuccess resets the failure count for a given endpoint.
 func (c *Cache) RecordSuccess(address string) {
 	c.mutex.Lock()
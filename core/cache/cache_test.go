@@ -43,6 +43,22 @@ func TestSaveEndpoint(t *testing.T) {
 	assert.Equal(t, 50*time.Millisecond, c.Endpoints[0].RTT)
 }
 
+func TestSaveThroughput(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	c.SaveEndpoint("1.1.1.1:2408", 100*time.Millisecond)
+	c.SaveThroughput("1.1.1.1:2408", 42.5, 10)
+	assert.Equal(t, 1, len(c.Endpoints))
+	assert.Equal(t, 100*time.Millisecond, c.Endpoints[0].RTT)
+	assert.Equal(t, 42.5, c.Endpoints[0].DownloadMbps)
+	assert.Equal(t, 10.0, c.Endpoints[0].UploadMbps)
+
+	c.SaveThroughput("1.0.0.1:500", 7, 0)
+	assert.Equal(t, 2, len(c.Endpoints))
+	assert.Equal(t, 7.0, c.Endpoints[1].DownloadMbps)
+}
+
 func TestRecordFailureAndSuccess(t *testing.T) {
 	c, cleanup := setupTestCache(t)
 	defer cleanup()
@@ -61,6 +77,21 @@ func TestRecordFailureAndSuccess(t *testing.T) {
 	assert.Equal(t, 0, c.Endpoints[0].Failures)
 }
 
+func TestMarkBad(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	c.SaveEndpoint("1.1.1.1:2408", 100*time.Millisecond)
+	c.MarkBad("1.1.1.1:2408")
+	c.MarkBad("1.0.0.1:2408")
+	assert.Equal(t, 2, len(c.Endpoints))
+	assert.Empty(t, c.GetAllEndpoints())
+
+	// A later scan that finds the endpoint working again clears the mark
+	c.SaveEndpoint("1.1.1.1:2408", 100*time.Millisecond)
+	assert.Equal(t, 1, len(c.GetAllEndpoints()))
+}
+
 func TestEndpointRemoval(t *testing.T) {
 	c, cleanup := setupTestCache(t)
 	defer cleanup()
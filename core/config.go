@@ -2,6 +2,9 @@ package core
 
 import (
 	"net/netip"
+	"time"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
 )
 
 // Config holds the configuration for the WARP engine.
@@ -12,4 +15,20 @@ type Config struct {
 	DnsAddr              netip.Addr
 	Scan                 *ScanOptions
 	UserProvidedEndpoint bool
+	// RotateKeyEvery, when non-zero, rotates the WireGuard key at this
+	// interval and reconnects the tunnel with the new key.
+	RotateKeyEvery time.Duration
+	// Wireguard customizes the tunnel configuration. The endpoint is chosen
+	// by the engine, and DNS defaults to DnsAddr.
+	Wireguard WireguardOptions
+	// AutoMTU probes the path to each endpoint for the largest working MTU
+	// instead of using Wireguard.MTU. Results are cached per endpoint.
+	AutoMTU bool
+	// Obfuscation, when set, routes the tunnel through a local relay that
+	// sends the profile's junk packets before each handshake initiation.
+	Obfuscation *statute.ObfuscationProfile
+	// Reserved overrides the reserved header bytes written to the scanner's
+	// and the tunnel's packets. They are derived from the identity's client
+	// ID when nil, and left zero when empty.
+	Reserved []byte
 }
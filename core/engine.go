@@ -3,22 +3,34 @@ package core
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/netip"
+	"time"
 
 	"github.com/shahradelahi/wiresocks"
 	"go.uber.org/zap"
 
 	"github.com/shahradelahi/cloudflare-warp/cloudflare"
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/model"
 	cache2 "github.com/shahradelahi/cloudflare-warp/core/cache"
+	"github.com/shahradelahi/cloudflare-warp/core/relay"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
 	"github.com/shahradelahi/cloudflare-warp/log"
+	"github.com/shahradelahi/cloudflare-warp/utils"
 )
 
+// tunnelKeepAlive is the keepalive interval of the proxy tunnel unless one is
+// configured; it is shorter than in generated configurations to keep NAT
+// mappings alive while idle.
+const tunnelKeepAlive = 5
+
 // Engine is the main engine for running WARP.
 type Engine struct {
 	ctx    context.Context
 	opts   Config
 	cancel context.CancelFunc
 	cache  *cache2.Cache
+	api    *cloudflare.WarpAPI
 }
 
 // NewEngine creates a new WARP engine.
@@ -29,6 +41,7 @@ func NewEngine(ctx context.Context, opts Config) *Engine {
 		opts:   opts,
 		cancel: cancel,
 		cache:  cache2.NewCache(),
+		api:    cloudflare.NewWarpAPI(),
 	}
 }
 
@@ -71,10 +84,11 @@ func (e *Engine) Run() error {
 				if e.opts.UserProvidedEndpoint {
 					return err
 				}
-			} else {
-				// connection successful, wait for context to be done
-				<-e.ctx.Done()
+			} else if e.ctx.Err() != nil {
 				return nil
+			} else {
+				// the session was closed for a key rotation, reconnect to the same endpoint
+				log.Info("Reconnecting to WARP with the rotated key")
 			}
 		}
 	}
@@ -82,7 +96,7 @@ func (e *Engine) Run() error {
 
 func (e *Engine) getScannerEndpoints() ([]string, error) {
 	// make primary identity
-	ident, err := cloudflare.LoadOrCreateIdentity()
+	ident, err := cloudflare.LoadOrCreateIdentity(e.ctx, e.api)
 	if err != nil {
 		log.Errorw("Failed to load/create primary identity", zap.Error(err))
 		return nil, err
@@ -94,6 +108,12 @@ func (e *Engine) getScannerEndpoints() ([]string, error) {
 	// Reading the public key from the 'Peer' section
 	e.opts.Scan.PublicKey = ident.Config.Peers[0].PublicKey
 
+	e.opts.Scan.Reserved = e.reserved(ident)
+
+	if e.opts.Scan.Verify {
+		e.opts.Scan.VerifySource, _ = netip.ParseAddr(ident.Config.Interface.Addresses.V4)
+	}
+
 	res, err := RunScan(e.ctx, *e.opts.Scan)
 	if err != nil {
 		return nil, err
@@ -119,23 +139,47 @@ func (e *Engine) Stop() {
 
 func (e *Engine) runWarp(endpoint string) error {
 	// make primary identity
-	ident, err := cloudflare.LoadOrCreateIdentity()
+	ident, err := cloudflare.LoadOrCreateIdentity(e.ctx, e.api)
 	if err != nil {
 		log.Errorw("Failed to load primary identity", zap.Error(err))
 		return err
 	}
 
-	conf := GenerateWireguardConfig(ident)
+	wgOpts := e.opts.Wireguard
+	wgOpts.Endpoint = endpoint
+	if len(wgOpts.DNS) == 0 {
+		wgOpts.DNS = []netip.Addr{e.opts.DnsAddr}
+	}
+	if wgOpts.KeepAlive == 0 {
+		wgOpts.KeepAlive = tunnelKeepAlive
+	}
 
-	// Set up DNS Address
-	conf.Interface.DNS = []netip.Addr{e.opts.DnsAddr}
+	reserved := e.reserved(ident)
+	if e.opts.AutoMTU {
+		mtu, err := DiscoverMTU(e.ctx, ident, endpoint, MTUOptions{
+			DNS:         e.opts.DnsAddr,
+			Obfuscation: e.opts.Obfuscation,
+			Reserved:    reserved,
+		})
+		if err != nil {
+			log.Warnw("MTU discovery failed; using the default MTU", zap.Error(err), zap.Int("mtu", DefaultMTU))
+			mtu = DefaultMTU
+		}
+		wgOpts.MTU = mtu
+	}
 
-	// Enable keepalive on all peers in config
-	for i, peer := range conf.Peers {
-		peer.Endpoint = endpoint
-		peer.KeepAlive = 5
+	if e.needsRelay() {
+		r, err := e.startRelay(endpoint, reserved)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		wgOpts.Endpoint = r.Addr().String()
+	}
 
-		conf.Peers[i] = peer
+	conf, err := GenerateWireguardConfig(ident, wgOpts)
+	if err != nil {
+		return err
 	}
 
 	proxyOpts := wiresocks.ProxyConfig{
@@ -143,7 +187,105 @@ func (e *Engine) runWarp(endpoint string) error {
 		HttpBindAddr:  e.opts.HttpBindAddress,
 	}
 
-	return e.startProxy(e.ctx, &conf, &proxyOpts)
+	ctx := e.ctx
+	if e.opts.RotateKeyEvery > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(e.ctx)
+		defer cancel()
+
+		stop := e.scheduleKeyRotation(ctx, ident, cancel)
+		defer stop()
+	}
+
+	return e.startProxy(ctx, &conf, &proxyOpts)
+}
+
+// reserved returns the reserved header bytes to use with ident.
+func (e *Engine) reserved(ident *model.Identity) []byte {
+	if e.opts.Reserved != nil {
+		return e.opts.Reserved
+	}
+	reserved, err := ident.Config.Reserved()
+	if err != nil {
+		log.Warnw("Omitting reserved bytes", zap.Error(err))
+		return nil
+	}
+	return reserved
+}
+
+// needsRelay reports whether the tunnel goes through a relay: to send the
+// profile's junk packets, or to write reserved bytes set explicitly. Reserved
+// bytes derived from the identity alone do not justify the extra hop.
+func (e *Engine) needsRelay() bool {
+	return e.opts.Obfuscation.Enabled() || len(e.opts.Reserved) > 0
+}
+
+// startRelay starts a relay to endpoint that applies the obfuscation profile
+// to the tunnel's handshakes and writes the reserved bytes.
+func (e *Engine) startRelay(endpoint string, reserved []byte) (*relay.Relay, error) {
+	return startRelay(e.ctx, endpoint, resolver(e.opts.DnsAddr), e.opts.Obfuscation, reserved)
+}
+
+// startRelay starts a relay to endpoint, resolved with the dns server.
+func startRelay(ctx context.Context, endpoint, dns string, obfuscation *statute.ObfuscationProfile, reserved []byte) (*relay.Relay, error) {
+	addr, err := utils.ParseResolveAddressPort(endpoint, false, dns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve endpoint %s: %w", endpoint, err)
+	}
+
+	r, err := relay.Listen(ctx, relay.Config{
+		Endpoint:    addr,
+		Obfuscation: obfuscation,
+		Reserved:    reserved,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start relay: %w", err)
+	}
+	log.Debugw("Relaying tunnel traffic", zap.String("relay", r.Addr().String()), zap.String("endpoint", addr.String()), zap.String("obfuscation", obfuscation.GetName()))
+	return r, nil
+}
+
+// scheduleKeyRotation rotates the identity's key after RotateKeyEvery and then
+// calls done so the current session is torn down. A failed rotation is retried
+// after another interval without interrupting the session. Nothing is
+// scheduled once ctx, the session's context, is done, and stop waits for a
+// rotation in progress so it never outlives the session.
+func (e *Engine) scheduleKeyRotation(ctx context.Context, ident *model.Identity, done context.CancelFunc) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		timer := time.NewTimer(e.opts.RotateKeyEvery)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+
+			// The engine's context is used so that ending the session does
+			// not abort a rotation the server may already have applied.
+			if _, err := cloudflare.RotateKey(e.ctx, e.api, ident); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Errorw("Failed to rotate WARP key; keeping the current key", zap.Error(err))
+				timer.Reset(e.opts.RotateKeyEvery)
+				continue
+			}
+			done()
+			return
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-finished
+	}
 }
 
 // startProxy starts the proxy servers and waits for the context to be done.
@@ -175,5 +317,8 @@ func (e *Engine) startProxy(ctx context.Context, conf *wiresocks.Configuration,
 	}
 
 	<-ctx.Done()
+	if err := context.Cause(ctx); !errors.Is(err, context.Canceled) {
+		return err
+	}
 	return nil
 }
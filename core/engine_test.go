@@ -0,0 +1,85 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shahradelahi/cloudflare-warp/cloudflare"
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/warptest"
+	"github.com/shahradelahi/cloudflare-warp/core/datadir"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+func TestScheduleKeyRotation(t *testing.T) {
+	srv := warptest.NewServer()
+	defer srv.Close()
+	datadir.SetDataDir(t.TempDir())
+
+	e := NewEngine(context.Background(), Config{RotateKeyEvery: 20 * time.Millisecond})
+	defer e.Stop()
+	e.api = cloudflare.NewWarpAPI(cloudflare.WithBaseURL(srv.URL), cloudflare.WithHTTPClient(srv.Client()))
+
+	ident, err := cloudflare.LoadOrCreateIdentity(e.ctx, e.api)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(e.ctx)
+	stop := e.scheduleKeyRotation(ctx, ident, cancel)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session was not torn down after the rotation")
+	}
+	stop()
+
+	reg, _ := srv.Registration(ident.ID)
+	assert.NotEqual(t, ident.Key, reg.Key, "the key was rotated")
+
+	// A failing rotation is retried until the session ends; stop then waits
+	// for the scheduler instead of leaving it to retry on a dead session.
+	srv.FailNext(http.StatusForbidden, 1000)
+	ctx, cancel = context.WithCancel(e.ctx)
+	stop = e.scheduleKeyRotation(ctx, ident, cancel)
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, ctx.Err(), "a failed rotation keeps the session")
+
+	cancel()
+	returned := make(chan struct{})
+	go func() {
+		stop()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop did not return after the session ended")
+	}
+}
+
+func TestNeedsRelay(t *testing.T) {
+	off, err := statute.LookupObfuscationProfile(statute.ObfuscationOff)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		config Config
+		want   bool
+	}{
+		{name: "defaults", config: Config{}, want: false},
+		{name: "off profile", config: Config{Obfuscation: off}, want: false},
+		{name: "junk profile", config: Config{Obfuscation: statute.DefaultObfuscationProfile()}, want: true},
+		{name: "explicit reserved bytes", config: Config{Obfuscation: off, Reserved: []byte{1, 2, 3}}, want: true},
+		{name: "zero reserved bytes", config: Config{Reserved: []byte{}}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Engine{opts: tt.config}
+			assert.Equal(t, tt.want, e.needsRelay())
+		})
+	}
+}
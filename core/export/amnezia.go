@@ -0,0 +1,90 @@
+package export
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/shahradelahi/wiresocks"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+const (
+	// amneziaMaxJunkCount and amneziaMaxJunkSize are the limits AmneziaWG
+	// clients accept for Jc and Jmax.
+	amneziaMaxJunkCount = 128
+	amneziaMaxJunkSize  = 1280
+	// amneziaMaxSignatures is the number of I1-I5 signature packets.
+	amneziaMaxSignatures = 5
+)
+
+// amnezia renders an AmneziaWG configuration. Cloudflare's servers speak plain
+// WireGuard, so only the client-side junk parameters (Jc, Jmin, Jmax and the
+// I1-I5 signature packets) are taken from the profile; S1, S2 and H1-H4 keep
+// the values that leave handshake messages unchanged.
+func amnezia(conf *wiresocks.Configuration, opts Options) ([]byte, error) {
+	profile := opts.Obfuscation
+	if profile == nil {
+		profile = statute.DefaultObfuscationProfile()
+	}
+
+	s, err := conf.String()
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	for _, line := range amneziaParams(profile) {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+
+	// The parameters belong to the [Interface] section, which ends where the
+	// first [Peer] section starts.
+	i := strings.Index(s, "\n[Peer]")
+	if i < 0 {
+		i = len(s)
+	}
+	return []byte(s[:i] + b.String() + s[i:]), nil
+}
+
+func amneziaParams(profile *statute.ObfuscationProfile) []string {
+	headerLen := 0
+	for _, h := range profile.Headers {
+		headerLen = max(headerLen, h.Len())
+	}
+
+	jc := 0
+	if profile.Enabled() {
+		jc = min(max(profile.JunkCount.Min, 1), amneziaMaxJunkCount)
+	}
+	jmin := min(headerLen+profile.JunkSize.Min, amneziaMaxJunkSize-1)
+	jmax := min(max(headerLen+profile.JunkSize.Max, jmin+1), amneziaMaxJunkSize)
+
+	params := []string{
+		fmt.Sprintf("Jc = %d", jc),
+		fmt.Sprintf("Jmin = %d", jmin),
+		fmt.Sprintf("Jmax = %d", jmax),
+		"S1 = 0",
+		"S2 = 0",
+		"H1 = 1",
+		"H2 = 2",
+		"H3 = 3",
+		"H4 = 4",
+	}
+
+	if !profile.Enabled() {
+		return params
+	}
+	for i, h := range profile.Headers {
+		if i == amneziaMaxSignatures {
+			break
+		}
+		sig := h.String()
+		if profile.JunkSize.Max > 0 {
+			sig += fmt.Sprintf("<r %d>", profile.JunkSize.Max)
+		}
+		params = append(params, fmt.Sprintf("I%d = %s", i+1, sig))
+	}
+	return params
+}
@@ -0,0 +1,59 @@
+package export
+
+import (
+	"gopkg.in/yaml.v3"
+
+	"github.com/shahradelahi/wiresocks"
+)
+
+// clashConfig is a Clash/mihomo configuration fragment holding the WireGuard
+// proxy.
+type clashConfig struct {
+	Proxies []clashProxy `yaml:"proxies"`
+}
+
+type clashProxy struct {
+	Name       string   `yaml:"name"`
+	Type       string   `yaml:"type"`
+	Server     string   `yaml:"server"`
+	Port       uint16   `yaml:"port"`
+	IP         string   `yaml:"ip,omitempty"`
+	IPv6       string   `yaml:"ipv6,omitempty"`
+	PrivateKey string   `yaml:"private-key"`
+	PublicKey  string   `yaml:"public-key"`
+	AllowedIPs []string `yaml:"allowed-ips"`
+	Reserved   []int    `yaml:"reserved,omitempty,flow"`
+	UDP        bool     `yaml:"udp"`
+	MTU        int      `yaml:"mtu,omitempty"`
+	KeepAlive  int      `yaml:"persistent-keepalive,omitempty"`
+}
+
+func clash(conf *wiresocks.Configuration, opts Options) ([]byte, error) {
+	p, err := newPeer(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := clashProxy{
+		Name:       opts.Tag,
+		Type:       "wireguard",
+		Server:     p.Host,
+		Port:       p.Port,
+		PrivateKey: p.PrivateKey,
+		PublicKey:  p.PublicKey,
+		AllowedIPs: p.AllowedIPs,
+		Reserved:   reservedInts(opts.Reserved),
+		UDP:        true,
+		MTU:        p.MTU,
+		KeepAlive:  p.KeepAlive,
+	}
+	for _, prefix := range p.Addresses {
+		if prefix.Addr().Is4() {
+			proxy.IP = prefix.Addr().String()
+		} else {
+			proxy.IPv6 = prefix.Addr().String()
+		}
+	}
+
+	return yaml.Marshal(clashConfig{Proxies: []clashProxy{proxy}})
+}
@@ -0,0 +1,157 @@
+// Package export converts a WireGuard configuration into the outbound formats
+// of third-party proxy clients.
+package export
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/shahradelahi/wiresocks"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+// Format is the name of a client configuration format.
+type Format string
+
+const (
+	FormatWireGuard Format = "wireguard"
+	FormatSingBox   Format = "singbox"
+	FormatXray      Format = "xray"
+	FormatClash     Format = "clash"
+	FormatAmnezia   Format = "amnezia"
+)
+
+// Formats lists the supported formats.
+var Formats = []Format{FormatWireGuard, FormatSingBox, FormatXray, FormatClash, FormatAmnezia}
+
+// DefaultTag is the outbound name used when Options.Tag is empty.
+const DefaultTag = "warp"
+
+// Options controls the generated client configuration.
+type Options struct {
+	// Tag is the outbound name (tag in sing-box and Xray, name in Clash).
+	Tag string
+	// Reserved holds the three reserved header bytes derived from the
+	// identity's client_id. It is omitted when empty.
+	Reserved []byte
+	// Obfuscation supplies the junk-packet parameters of AmneziaWG
+	// configurations. The scanner's default profile is used when nil.
+	Obfuscation *statute.ObfuscationProfile
+}
+
+// ParseFormat validates a format name.
+func ParseFormat(s string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == s {
+			return f, nil
+		}
+	}
+	names := make([]string, len(Formats))
+	for i, f := range Formats {
+		names[i] = string(f)
+	}
+	return "", fmt.Errorf("unknown format %q (expected %s)", s, strings.Join(names, ", "))
+}
+
+// Export renders conf in the given format.
+func Export(format Format, conf *wiresocks.Configuration, opts Options) ([]byte, error) {
+	if conf.Interface == nil || len(conf.Peers) == 0 {
+		return nil, fmt.Errorf("configuration needs an interface and at least one peer")
+	}
+	if opts.Tag == "" {
+		opts.Tag = DefaultTag
+	}
+
+	switch format {
+	case FormatWireGuard:
+		s, err := conf.String()
+		return []byte(s), err
+	case FormatSingBox:
+		return singBox(conf, opts)
+	case FormatXray:
+		return xray(conf, opts)
+	case FormatClash:
+		return clash(conf, opts)
+	case FormatAmnezia:
+		return amnezia(conf, opts)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// peer holds the values shared by every exporter, with keys in base64 as
+// expected by the clients.
+type peer struct {
+	PrivateKey string
+	PublicKey  string
+	Host       string
+	Port       uint16
+	Addresses  []netip.Prefix
+	AllowedIPs []string
+	KeepAlive  int
+	MTU        int
+}
+
+func newPeer(conf *wiresocks.Configuration) (*peer, error) {
+	p := conf.Peers[0]
+
+	priv, err := wiresocks.EncodeHexToBase64(conf.Interface.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	pub, err := wiresocks.EncodeHexToBase64(p.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer public key: %w", err)
+	}
+
+	host, portStr, err := net.SplitHostPort(p.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %w", p.Endpoint, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint port %q: %w", portStr, err)
+	}
+
+	allowed := make([]string, len(p.AllowedIPs))
+	for i, prefix := range p.AllowedIPs {
+		allowed[i] = prefix.String()
+	}
+
+	return &peer{
+		PrivateKey: priv,
+		PublicKey:  pub,
+		Host:       host,
+		Port:       uint16(port),
+		Addresses:  conf.Interface.Addresses,
+		AllowedIPs: allowed,
+		KeepAlive:  p.KeepAlive,
+		MTU:        conf.Interface.MTU,
+	}, nil
+}
+
+// addresses returns the interface addresses as single-host prefixes.
+func (p *peer) addresses() []string {
+	out := make([]string, len(p.Addresses))
+	for i, prefix := range p.Addresses {
+		out[i] = netip.PrefixFrom(prefix.Addr(), prefix.Addr().BitLen()).String()
+	}
+	return out
+}
+
+// reservedInts converts the reserved bytes to numbers, so JSON and YAML
+// encoders emit them as arrays instead of base64 strings.
+func reservedInts(b []byte) []int {
+	if len(b) == 0 {
+		return nil
+	}
+	out := make([]int, len(b))
+	for i, v := range b {
+		out[i] = int(v)
+	}
+	return out
+}
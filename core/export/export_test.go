@@ -0,0 +1,152 @@
+package export
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shahradelahi/wiresocks"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+const (
+	testPrivateKey = "aGVsbG8gd29ybGQgaGVsbG8gd29ybGQgaGVsbG8gd28="
+	testPublicKey  = "bmZRhmVvtrZSd0aZmuoRbt7ZKzwg7CRm7wUNMzTPpGY="
+)
+
+func testConfig(t *testing.T) *wiresocks.Configuration {
+	priv, err := wiresocks.EncodeBase64ToHex(testPrivateKey)
+	assert.NoError(t, err)
+	pub, err := wiresocks.EncodeBase64ToHex(testPublicKey)
+	assert.NoError(t, err)
+
+	return &wiresocks.Configuration{
+		Interface: &wiresocks.InterfaceConfig{
+			PrivateKey: priv,
+			Addresses: []netip.Prefix{
+				netip.MustParsePrefix("172.16.0.2/32"),
+				netip.MustParsePrefix("2606:4700:110:8a36::2/128"),
+			},
+			MTU: 1280,
+		},
+		Peers: []wiresocks.PeerConfig{{
+			PublicKey:  pub,
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")},
+			KeepAlive:  25,
+			Endpoint:   "162.159.192.1:2408",
+		}},
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	f, err := ParseFormat("singbox")
+	assert.NoError(t, err)
+	assert.Equal(t, FormatSingBox, f)
+
+	_, err = ParseFormat("openvpn")
+	assert.Error(t, err)
+}
+
+func TestSingBox(t *testing.T) {
+	data, err := Export(FormatSingBox, testConfig(t), Options{Reserved: []byte{1, 2, 3}})
+	assert.NoError(t, err)
+
+	var out singBoxConfig
+	assert.NoError(t, json.Unmarshal(data, &out))
+	assert.Len(t, out.Endpoints, 1)
+
+	ep := out.Endpoints[0]
+	assert.Equal(t, DefaultTag, ep.Tag)
+	assert.Equal(t, testPrivateKey, ep.PrivateKey)
+	assert.Equal(t, []string{"172.16.0.2/32", "2606:4700:110:8a36::2/128"}, ep.Address)
+	assert.Equal(t, 1280, ep.MTU)
+	assert.Equal(t, "162.159.192.1", ep.Peers[0].Address)
+	assert.Equal(t, uint16(2408), ep.Peers[0].Port)
+	assert.Equal(t, testPublicKey, ep.Peers[0].PublicKey)
+	assert.Equal(t, []int{1, 2, 3}, ep.Peers[0].Reserved)
+}
+
+func TestXray(t *testing.T) {
+	data, err := Export(FormatXray, testConfig(t), Options{Tag: "cf"})
+	assert.NoError(t, err)
+
+	var out xrayConfig
+	assert.NoError(t, json.Unmarshal(data, &out))
+	assert.Equal(t, "cf", out.Outbounds[0].Tag)
+
+	s := out.Outbounds[0].Settings
+	assert.Equal(t, testPrivateKey, s.SecretKey)
+	assert.Equal(t, "162.159.192.1:2408", s.Peers[0].Endpoint)
+	assert.Nil(t, s.Reserved, "reserved is omitted without a client_id")
+}
+
+func TestClash(t *testing.T) {
+	data, err := Export(FormatClash, testConfig(t), Options{Reserved: []byte{0, 255, 16}})
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "reserved: [0, 255, 16]")
+
+	var out clashConfig
+	assert.NoError(t, yaml.Unmarshal(data, &out))
+
+	p := out.Proxies[0]
+	assert.Equal(t, "172.16.0.2", p.IP)
+	assert.Equal(t, "2606:4700:110:8a36::2", p.IPv6)
+	assert.Equal(t, testPublicKey, p.PublicKey)
+	assert.Equal(t, "162.159.192.1", p.Server)
+	assert.Equal(t, uint16(2408), p.Port)
+}
+
+func TestExportInvalidEndpoint(t *testing.T) {
+	conf := testConfig(t)
+	conf.Peers[0].Endpoint = "engage.cloudflareclient.com"
+
+	_, err := Export(FormatSingBox, conf, Options{})
+	assert.Error(t, err)
+}
+
+func TestAmnezia(t *testing.T) {
+	data, err := Export(FormatAmnezia, testConfig(t), Options{})
+	assert.NoError(t, err)
+
+	conf := string(data)
+	assert.Contains(t, conf, "Jc = 20\nJmin = 28\nJmax = 138\nS1 = 0\nS2 = 0\nH1 = 1\nH2 = 2\nH3 = 3\nH4 = 4\n")
+	assert.Contains(t, conf, "I1 = <b 0xdc0000000108><r 8><b 0x000044d0><r 120>\n")
+	assert.Contains(t, conf, "I5 = <b 0xd00000000108>")
+	assert.NotContains(t, conf, "I6 =")
+	assert.Less(t, strings.Index(conf, "Jc ="), strings.Index(conf, "[Peer]"), "parameters belong to [Interface]")
+
+	off, err := statute.LookupObfuscationProfile(statute.ObfuscationOff)
+	assert.NoError(t, err)
+	data, err = Export(FormatAmnezia, testConfig(t), Options{Obfuscation: off})
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "Jc = 0\n")
+	assert.NotContains(t, string(data), "I1 =")
+}
+
+func TestCustomObfuscationProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profile.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{
+		"junk_count": {"min": 4, "max": 8},
+		"junk_size": {"min": 40, "max": 70},
+		"junk_delay_ms": {"min": 0, "max": 10},
+		"headers": ["<b 0xc7000000><r 4>"]
+	}`), 0600))
+
+	profile, err := statute.LookupObfuscationProfile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, path, profile.Name)
+
+	data, err := Export(FormatAmnezia, testConfig(t), Options{Obfuscation: profile})
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "Jc = 4\nJmin = 48\nJmax = 78\n")
+	assert.Contains(t, string(data), "I1 = <b 0xc7000000><r 4><r 70>\n")
+
+	_, err = statute.LookupObfuscationProfile("no-such-profile")
+	assert.Error(t, err)
+}
@@ -0,0 +1,56 @@
+package export
+
+import (
+	"encoding/json"
+
+	"github.com/shahradelahi/wiresocks"
+)
+
+// singBoxConfig is a sing-box configuration fragment holding the WireGuard
+// endpoint (sing-box 1.11 and later).
+type singBoxConfig struct {
+	Endpoints []singBoxEndpoint `json:"endpoints"`
+}
+
+type singBoxEndpoint struct {
+	Type       string        `json:"type"`
+	Tag        string        `json:"tag"`
+	MTU        int           `json:"mtu,omitempty"`
+	Address    []string      `json:"address"`
+	PrivateKey string        `json:"private_key"`
+	Peers      []singBoxPeer `json:"peers"`
+}
+
+type singBoxPeer struct {
+	Address                     string   `json:"address"`
+	Port                        uint16   `json:"port"`
+	PublicKey                   string   `json:"public_key"`
+	AllowedIPs                  []string `json:"allowed_ips"`
+	PersistentKeepaliveInterval int      `json:"persistent_keepalive_interval,omitempty"`
+	Reserved                    []int    `json:"reserved,omitempty"`
+}
+
+func singBox(conf *wiresocks.Configuration, opts Options) ([]byte, error) {
+	p, err := newPeer(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(singBoxConfig{
+		Endpoints: []singBoxEndpoint{{
+			Type:       "wireguard",
+			Tag:        opts.Tag,
+			MTU:        p.MTU,
+			Address:    p.addresses(),
+			PrivateKey: p.PrivateKey,
+			Peers: []singBoxPeer{{
+				Address:                     p.Host,
+				Port:                        p.Port,
+				PublicKey:                   p.PublicKey,
+				AllowedIPs:                  p.AllowedIPs,
+				PersistentKeepaliveInterval: p.KeepAlive,
+				Reserved:                    reservedInts(opts.Reserved),
+			}},
+		}},
+	}, "", "  ")
+}
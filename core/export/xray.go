@@ -0,0 +1,61 @@
+package export
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+
+	"github.com/shahradelahi/wiresocks"
+)
+
+// xrayConfig is an Xray configuration fragment holding the WireGuard outbound.
+type xrayConfig struct {
+	Outbounds []xrayOutbound `json:"outbounds"`
+}
+
+type xrayOutbound struct {
+	Protocol string       `json:"protocol"`
+	Tag      string       `json:"tag"`
+	Settings xraySettings `json:"settings"`
+}
+
+type xraySettings struct {
+	SecretKey string     `json:"secretKey"`
+	Address   []string   `json:"address"`
+	Peers     []xrayPeer `json:"peers"`
+	Reserved  []int      `json:"reserved,omitempty"`
+	MTU       int        `json:"mtu,omitempty"`
+}
+
+type xrayPeer struct {
+	PublicKey  string   `json:"publicKey"`
+	AllowedIPs []string `json:"allowedIPs"`
+	Endpoint   string   `json:"endpoint"`
+	KeepAlive  int      `json:"keepAlive,omitempty"`
+}
+
+func xray(conf *wiresocks.Configuration, opts Options) ([]byte, error) {
+	p, err := newPeer(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(xrayConfig{
+		Outbounds: []xrayOutbound{{
+			Protocol: "wireguard",
+			Tag:      opts.Tag,
+			Settings: xraySettings{
+				SecretKey: p.PrivateKey,
+				Address:   p.addresses(),
+				Peers: []xrayPeer{{
+					PublicKey:  p.PublicKey,
+					AllowedIPs: p.AllowedIPs,
+					Endpoint:   net.JoinHostPort(p.Host, strconv.Itoa(int(p.Port))),
+					KeepAlive:  p.KeepAlive,
+				}},
+				Reserved: reservedInts(opts.Reserved),
+				MTU:      p.MTU,
+			},
+		}},
+	}, "", "  ")
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"go.uber.org/zap"
+
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/model"
+	"github.com/shahradelahi/cloudflare-warp/core/mtu"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/ping"
+	"github.com/shahradelahi/cloudflare-warp/log"
+	"github.com/shahradelahi/cloudflare-warp/utils"
+)
+
+// MTUOptions configures the handshakes sent by DiscoverMTU. They should match
+// the tunnel's, otherwise the peer may ignore the probes and discovery fails.
+type MTUOptions struct {
+	// DNS resolves the endpoint. It defaults to the first of DefaultDNS.
+	DNS         netip.Addr
+	Obfuscation *statute.ObfuscationProfile
+	Reserved    []byte
+}
+
+// DiscoverMTU returns the tunnel MTU for endpoint, probing the path unless a
+// recent result is cached in the data directory.
+func DiscoverMTU(ctx context.Context, ident *model.Identity, endpoint string, opts MTUOptions) (int, error) {
+	if cached, ok := mtu.Cached(endpoint); ok {
+		log.Debugw("Using cached tunnel MTU", zap.String("endpoint", endpoint), zap.Int("mtu", cached))
+		return cached, nil
+	}
+
+	addr, err := utils.ParseResolveAddressPort(endpoint, false, resolver(opts.DNS))
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve endpoint %s: %w", endpoint, err)
+	}
+	src, err := netip.ParseAddr(ident.Config.Interface.Addresses.V4)
+	if err != nil {
+		return 0, fmt.Errorf("identity has no IPv4 interface address: %w", err)
+	}
+
+	log.Infow("Probing tunnel MTU", zap.String("endpoint", endpoint))
+	value, err := mtu.Discover(ctx, addr, ping.SessionConfig{
+		PrivateKey:    ident.PrivateKey,
+		PeerPublicKey: ident.Config.Peers[0].PublicKey,
+		Obfuscation:   opts.Obfuscation,
+		Reserved:      opts.Reserved,
+	}, src)
+	if err != nil {
+		return 0, err
+	}
+	log.Infow("Discovered tunnel MTU", zap.String("endpoint", endpoint), zap.Int("mtu", value))
+
+	if err := mtu.Store(endpoint, value); err != nil {
+		log.Warnw("Failed to cache tunnel MTU", zap.Error(err))
+	}
+	return value, nil
+}
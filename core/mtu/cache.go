@@ -0,0 +1,92 @@
+package mtu
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/shahradelahi/cloudflare-warp/core/datadir"
+)
+
+const (
+	fileName = "mtu.json"
+	// cacheTTL is how long a discovered MTU is reused before probing again.
+	cacheTTL = 24 * time.Hour
+)
+
+// entry is a discovered MTU.
+type entry struct {
+	MTU  int       `json:"mtu"`
+	Time time.Time `json:"time"`
+}
+
+var mutex sync.Mutex
+
+// Cached returns the MTU discovered for endpoint within the last cacheTTL.
+func Cached(endpoint string) (int, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	entries, err := load()
+	if err != nil {
+		return 0, false
+	}
+	e, ok := entries[endpoint]
+	if !ok || time.Since(e.Time) > cacheTTL {
+		return 0, false
+	}
+	return e.MTU, true
+}
+
+// Store records the MTU discovered for endpoint.
+func Store(endpoint string, mtu int) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	entries, err := load()
+	if err != nil {
+		entries = make(map[string]entry)
+	}
+	entries[endpoint] = entry{MTU: mtu, Time: time.Now()}
+
+	filePath, err := cachePath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, data, 0644)
+}
+
+func load() (map[string]entry, error) {
+	filePath, err := cachePath()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]entry)
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func cachePath() (string, error) {
+	dir := datadir.GetDataDir()
+	if dir == "" {
+		return "", fmt.Errorf("data directory not set")
+	}
+	return filepath.Join(dir, fileName), nil
+}
@@ -0,0 +1,111 @@
+// Package mtu discovers the largest tunnel MTU a path to a WARP endpoint can
+// carry.
+package mtu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/ping"
+	"github.com/shahradelahi/cloudflare-warp/log"
+)
+
+const (
+	// Min is the smallest MTU WireGuard supports with IPv6 inside the tunnel
+	// and the fallback when discovery fails.
+	Min = 1280
+
+	// linkMTU is the MTU assumed for the local link.
+	linkMTU = 1500
+
+	udpHeaderSize  = 8
+	ipv4HeaderSize = 20
+	ipv6HeaderSize = 40
+
+	probeTimeout  = time.Second
+	probeAttempts = 2
+)
+
+// ProbeTarget is the address pinged through the tunnel while probing.
+var ProbeTarget = netip.MustParseAddr("1.1.1.1")
+
+// Max returns the largest MTU a tunnel to endpoint can have on a link with a
+// 1500-byte MTU.
+func Max(endpoint netip.AddrPort) int {
+	overhead := ping.TransportOverhead + udpHeaderSize + ipv4HeaderSize
+	if endpoint.Addr().Is6() && !endpoint.Addr().Is4In6() {
+		overhead = ping.TransportOverhead + udpHeaderSize + ipv6HeaderSize
+	}
+	return linkMTU - overhead
+}
+
+// Discover binary-searches the largest inner packet size that reaches
+// ProbeTarget through a WireGuard session with endpoint. Outer packets are
+// sent with the DF bit set, so sizes that need fragmentation anywhere on the
+// path fail. src is the tunnel's IPv4 interface address.
+func Discover(ctx context.Context, endpoint netip.AddrPort, config ping.SessionConfig, src netip.Addr) (int, error) {
+	config.DontFragment = true
+	s, err := ping.DialSession(ctx, endpoint, config)
+	if err != nil {
+		return 0, fmt.Errorf("handshake failed: %w", err)
+	}
+	defer s.Close()
+
+	ok, err := probe(ctx, s, src, Min)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("no reply from %s through the tunnel at the minimum MTU %d", ProbeTarget, Min)
+	}
+
+	lo, hi := Min, Max(endpoint)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		ok, err := probe(ctx, s, src, mid)
+		if err != nil {
+			return 0, err
+		}
+		log.Debugw("MTU probe", zap.Int("size", mid), zap.Bool("ok", ok))
+		if ok {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, nil
+}
+
+// probe reports whether an echo of the given size makes the round trip. Only
+// failures unrelated to the packet size are returned as errors.
+func probe(ctx context.Context, s *ping.Session, src netip.Addr, size int) (bool, error) {
+	for attempt := 0; attempt < probeAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		_, err := s.Echo(src, ProbeTarget, size, probeTimeout)
+		switch {
+		case err == nil:
+			return true, nil
+		case errors.Is(err, ping.ErrPacketTooBig), errors.Is(err, syscall.EMSGSIZE):
+			return false, nil
+		case errors.Is(err, context.DeadlineExceeded) || isTimeout(err):
+			continue
+		default:
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
@@ -0,0 +1,66 @@
+package mtu
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shahradelahi/cloudflare-warp/core/datadir"
+	"github.com/shahradelahi/cloudflare-warp/internal/wgtest"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/ping"
+)
+
+var clientAddr = netip.MustParseAddr("172.16.0.2")
+
+func TestMax(t *testing.T) {
+	assert.Equal(t, 1440, Max(netip.MustParseAddrPort("162.159.192.1:2408")))
+	assert.Equal(t, 1420, Max(netip.MustParseAddrPort("[2606:4700:d0::a29f:c001]:2408")))
+}
+
+func TestDiscover(t *testing.T) {
+	privateKey, publicKey, err := wgtest.KeyPair()
+	assert.NoError(t, err)
+
+	peer, err := wgtest.NewPeer(publicKey, 1500)
+	assert.NoError(t, err)
+	defer peer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The loopback path carries any size, so the search ends at the largest
+	// MTU of a 1500-byte link.
+	got, err := Discover(ctx, peer.Endpoint, ping.SessionConfig{
+		PrivateKey:    privateKey,
+		PeerPublicKey: peer.PublicKey,
+	}, clientAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, Max(peer.Endpoint), got)
+
+	// A peer that does not know the client never completes the handshake.
+	otherKey, _, err := wgtest.KeyPair()
+	assert.NoError(t, err)
+	_, err = Discover(ctx, peer.Endpoint, ping.SessionConfig{
+		PrivateKey:    otherKey,
+		PeerPublicKey: peer.PublicKey,
+	}, clientAddr)
+	assert.Error(t, err)
+}
+
+func TestCache(t *testing.T) {
+	datadir.SetDataDir(t.TempDir())
+
+	_, ok := Cached("162.159.192.1:2408")
+	assert.False(t, ok)
+
+	assert.NoError(t, Store("162.159.192.1:2408", 1400))
+	got, ok := Cached("162.159.192.1:2408")
+	assert.True(t, ok)
+	assert.Equal(t, 1400, got)
+
+	_, ok = Cached("162.159.192.2:2408")
+	assert.False(t, ok)
+}
@@ -0,0 +1,264 @@
+// Package relay forwards a local WireGuard client's UDP traffic to a WARP
+// endpoint, shaping the packets on the way: junk packets from an obfuscation
+// profile are sent before each handshake initiation, and the reserved header
+// bytes carry the WARP client ID.
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/ping"
+	"github.com/shahradelahi/cloudflare-warp/log"
+)
+
+// WireGuard message types and the sizes of handshake messages.
+const (
+	messageInitiation = 1
+	messageResponse   = 2
+	messageCookie     = 3
+	messageTransport  = 4
+
+	initiationSize    = 148
+	responseSize      = 92
+	cookieSize        = 64
+	minTransportSize  = 32
+	maxDatagramLength = 65535
+)
+
+// Config configures a relay.
+type Config struct {
+	// Endpoint is the WARP endpoint packets are forwarded to.
+	Endpoint netip.AddrPort
+	// Obfuscation selects the junk packets sent before each handshake
+	// initiation. No junk is sent when nil.
+	Obfuscation *statute.ObfuscationProfile
+	// Reserved is written to the reserved header bytes of outgoing messages
+	// and cleared from incoming ones, which plain WireGuard rejects otherwise.
+	Reserved []byte
+}
+
+// Relay is a UDP forwarder between a local WireGuard client and an endpoint.
+type Relay struct {
+	config Config
+	local  *net.UDPConn
+	remote *net.UDPConn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// client is the address of the local WireGuard client, learned from the
+	// packets it sends.
+	client atomic.Pointer[net.UDPAddr]
+
+	// The junk of a handshake is sent ahead of its initiation, so that the
+	// full profile goes out without holding back WireGuard's retransmissions.
+	// junkReady is set once the junk was sent and no initiation followed it
+	// yet, and pending is the newest initiation waiting for the junk.
+	junkMu    sync.Mutex
+	junkReady bool
+	pending   []byte
+}
+
+// Listen starts a relay on a random loopback port. Point the WireGuard peer's
+// endpoint at Addr.
+func Listen(ctx context.Context, config Config) (*Relay, error) {
+	if len(config.Reserved) != 0 && len(config.Reserved) != 3 {
+		return nil, fmt.Errorf("reserved must be 3 bytes, got %d", len(config.Reserved))
+	}
+
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(config.Endpoint))
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &Relay{
+		config: config,
+		local:  local,
+		remote: remote,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	r.wg.Add(2)
+	go r.forwardOutgoing()
+	go r.forwardIncoming()
+	if config.Obfuscation.Enabled() {
+		r.prepareJunk()
+	}
+	go func() {
+		<-ctx.Done()
+		r.local.Close()
+		r.remote.Close()
+	}()
+
+	return r, nil
+}
+
+// Addr returns the local address the relay listens on.
+func (r *Relay) Addr() netip.AddrPort {
+	return r.local.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// Close stops the relay and waits for its goroutines to exit.
+func (r *Relay) Close() error {
+	r.cancel()
+	r.wg.Wait()
+	return nil
+}
+
+func (r *Relay) forwardOutgoing() {
+	defer r.wg.Done()
+
+	buf := make([]byte, maxDatagramLength)
+	for {
+		n, addr, err := r.local.ReadFromUDP(buf)
+		if err != nil {
+			if !r.closed(err) {
+				log.Debugw("Relay failed to read from client", zap.Error(err))
+			}
+			return
+		}
+		r.client.Store(addr)
+
+		packet := buf[:n]
+		if !isWireGuardMessage(packet) {
+			// The client's own junk packets are dropped so that only the
+			// profile decides what precedes a handshake.
+			continue
+		}
+		copy(packet[1:4], r.config.Reserved)
+
+		if packet[0] == messageInitiation && r.config.Obfuscation.Enabled() {
+			r.sendObfuscatedInitiation(append([]byte(nil), packet...))
+			continue
+		}
+
+		if _, err := r.remote.Write(packet); err != nil && !r.closed(err) {
+			log.Debugw("Relay failed to write to endpoint", zap.Error(err))
+		}
+	}
+}
+
+// sendObfuscatedInitiation forwards the initiation right away if the junk for
+// it was already sent, and starts sending the junk for the next handshake.
+// Otherwise the initiation waits for the junk in progress, replacing any
+// initiation already waiting, so that only the newest is forwarded.
+func (r *Relay) sendObfuscatedInitiation(initiation []byte) {
+	r.junkMu.Lock()
+	if !r.junkReady {
+		r.pending = initiation
+		r.junkMu.Unlock()
+		return
+	}
+	r.junkReady = false
+	r.junkMu.Unlock()
+
+	r.writeInitiation(initiation)
+	r.prepareJunk()
+}
+
+// prepareJunk sends the profile's junk packets in the background, then
+// forwards the initiation waiting for them, if any, or marks the junk ready
+// for the next one. Only one junk sequence is in progress at a time.
+func (r *Relay) prepareJunk() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		for {
+			if err := ping.SendRandomPackets(r.ctx, r.remote, r.config.Obfuscation); err != nil {
+				if r.closed(err) {
+					return
+				}
+				log.Debugw("Relay failed to send junk packets", zap.Error(err))
+			}
+
+			r.junkMu.Lock()
+			initiation := r.pending
+			r.pending = nil
+			r.junkReady = initiation == nil
+			r.junkMu.Unlock()
+
+			if initiation == nil {
+				return
+			}
+			r.writeInitiation(initiation)
+		}
+	}()
+}
+
+func (r *Relay) writeInitiation(initiation []byte) {
+	if _, err := r.remote.Write(initiation); err != nil && !r.closed(err) {
+		log.Debugw("Relay failed to write handshake initiation", zap.Error(err))
+	}
+}
+
+func (r *Relay) forwardIncoming() {
+	defer r.wg.Done()
+
+	buf := make([]byte, maxDatagramLength)
+	for {
+		n, err := r.remote.Read(buf)
+		if err != nil {
+			if !r.closed(err) {
+				log.Debugw("Relay failed to read from endpoint", zap.Error(err))
+				continue
+			}
+			return
+		}
+
+		client := r.client.Load()
+		if client == nil {
+			continue
+		}
+
+		packet := buf[:n]
+		if len(packet) >= 4 && packet[0] >= messageInitiation && packet[0] <= messageTransport {
+			packet[1], packet[2], packet[3] = 0, 0, 0
+		}
+		if _, err := r.local.WriteToUDP(packet, client); err != nil && !r.closed(err) {
+			log.Debugw("Relay failed to write to client", zap.Error(err))
+		}
+	}
+}
+
+func (r *Relay) closed(err error) bool {
+	return r.ctx.Err() != nil || errors.Is(err, net.ErrClosed)
+}
+
+// isWireGuardMessage reports whether packet looks like a WireGuard message:
+// a known type, three zero reserved bytes and a matching size.
+func isWireGuardMessage(packet []byte) bool {
+	if len(packet) < 4 || packet[1] != 0 || packet[2] != 0 || packet[3] != 0 {
+		return false
+	}
+	switch packet[0] {
+	case messageInitiation:
+		return len(packet) == initiationSize
+	case messageResponse:
+		return len(packet) == responseSize
+	case messageCookie:
+		return len(packet) == cookieSize
+	case messageTransport:
+		return len(packet) >= minTransportSize
+	default:
+		return false
+	}
+}
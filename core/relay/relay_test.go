@@ -0,0 +1,234 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shahradelahi/cloudflare-warp/internal/wgtest"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/ping"
+)
+
+func testProfile(t *testing.T, junk int) *statute.ObfuscationProfile {
+	header, err := statute.ParseTemplate("<b 0xc7000000><r 4>")
+	assert.NoError(t, err)
+	return &statute.ObfuscationProfile{
+		Name:      "test",
+		JunkCount: statute.Range{Min: junk, Max: junk},
+		JunkSize:  statute.Range{Min: 10, Max: 20},
+		Headers:   []statute.Template{header},
+	}
+}
+
+func TestRelayTunnel(t *testing.T) {
+	privateKey, publicKey, err := wgtest.KeyPair()
+	assert.NoError(t, err)
+	peer, err := wgtest.NewPeer(publicKey, 1500)
+	assert.NoError(t, err)
+	defer peer.Close()
+
+	r, err := Listen(context.Background(), Config{Endpoint: peer.Endpoint, Obfuscation: testProfile(t, 3)})
+	assert.NoError(t, err)
+	defer r.Close()
+
+	s, err := ping.DialSession(context.Background(), r.Addr(), ping.SessionConfig{
+		PrivateKey:    privateKey,
+		PeerPublicKey: peer.PublicKey,
+	})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.Echo(netip.MustParseAddr("172.16.0.2"), wgtest.PeerAddr, 100, 2*time.Second)
+	assert.NoError(t, err)
+}
+
+func TestRelayObfuscation(t *testing.T) {
+	endpoint, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer endpoint.Close()
+
+	r, err := Listen(context.Background(), Config{
+		Endpoint:    endpoint.LocalAddr().(*net.UDPAddr).AddrPort(),
+		Obfuscation: testProfile(t, 3),
+	})
+	assert.NoError(t, err)
+	defer r.Close()
+
+	client, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(r.Addr()))
+	assert.NoError(t, err)
+	defer client.Close()
+
+	initiation := make([]byte, initiationSize)
+	initiation[0] = messageInitiation
+
+	_, err = client.Write([]byte("not a wireguard message"))
+	assert.NoError(t, err)
+	_, err = client.Write(initiation)
+	assert.NoError(t, err)
+
+	buf := make([]byte, 2048)
+	endpoint.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 3; i++ {
+		n, err := endpoint.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0xc7, 0, 0, 0}, buf[:4], "junk packets start with the profile header")
+		assert.GreaterOrEqual(t, n, 18)
+	}
+	n, err := endpoint.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, initiation, buf[:n], "the initiation follows the junk packets")
+}
+
+func TestIsWireGuardMessage(t *testing.T) {
+	transport := make([]byte, 64)
+	transport[0] = messageTransport
+	assert.True(t, isWireGuardMessage(transport))
+
+	transport[2] = 1
+	assert.False(t, isWireGuardMessage(transport))
+
+	short := make([]byte, initiationSize-1)
+	short[0] = messageInitiation
+	assert.False(t, isWireGuardMessage(short))
+}
+
+func TestRelayReserved(t *testing.T) {
+	endpoint, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer endpoint.Close()
+
+	reserved := []byte{0xa1, 0xb2, 0xc3}
+	r, err := Listen(context.Background(), Config{
+		Endpoint: endpoint.LocalAddr().(*net.UDPAddr).AddrPort(),
+		Reserved: reserved,
+	})
+	assert.NoError(t, err)
+	defer r.Close()
+
+	client, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(r.Addr()))
+	assert.NoError(t, err)
+	defer client.Close()
+
+	transport := make([]byte, 64)
+	transport[0] = messageTransport
+	_, err = client.Write(transport)
+	assert.NoError(t, err)
+
+	buf := make([]byte, 2048)
+	endpoint.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := endpoint.ReadFromUDP(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, reserved, buf[1:4], "outgoing messages carry the reserved bytes")
+	assert.Equal(t, transport[4:], buf[4:n])
+
+	_, err = endpoint.WriteToUDP(buf[:n], from)
+	assert.NoError(t, err)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err = client.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, transport, buf[:n], "incoming messages have the reserved bytes cleared")
+
+	_, err = Listen(context.Background(), Config{Endpoint: r.Addr(), Reserved: []byte{1}})
+	assert.Error(t, err)
+}
+
+func TestRelayNewestInitiation(t *testing.T) {
+	endpoint, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer endpoint.Close()
+
+	profile := testProfile(t, 5)
+	profile.JunkDelay = statute.Range{Min: 50, Max: 50}
+
+	r, err := Listen(context.Background(), Config{
+		Endpoint:    endpoint.LocalAddr().(*net.UDPAddr).AddrPort(),
+		Obfuscation: profile,
+	})
+	assert.NoError(t, err)
+	defer r.Close()
+
+	client, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(r.Addr()))
+	assert.NoError(t, err)
+	defer client.Close()
+
+	stale := make([]byte, initiationSize)
+	stale[0] = messageInitiation
+	newest := append([]byte(nil), stale...)
+	newest[4] = 1
+
+	_, err = client.Write(stale)
+	assert.NoError(t, err)
+	_, err = client.Write(newest)
+	assert.NoError(t, err)
+
+	// The whole profile is sent, then only the newest initiation.
+	buf := make([]byte, 2048)
+	endpoint.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 5; i++ {
+		_, err := endpoint.Read(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, byte(0xc7), buf[0], "junk packet %d", i)
+	}
+	n, err := endpoint.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, newest, buf[:n], "only the newest initiation is forwarded")
+
+	// The junk of the next handshake is sent ahead of it, so its initiation
+	// is forwarded without waiting for the profile's delays.
+	for i := 0; i < 5; i++ {
+		_, err := endpoint.Read(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, byte(0xc7), buf[0], "junk packet %d", i)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	_, err = client.Write(stale)
+	assert.NoError(t, err)
+	n, err = endpoint.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, stale, buf[:n])
+	assert.Less(t, time.Since(start), 50*time.Millisecond, "the initiation is not held back by the junk delays")
+}
+
+func TestRelayCloseDuringJunk(t *testing.T) {
+	endpoint, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer endpoint.Close()
+
+	profile := testProfile(t, 1)
+	profile.JunkDelay = statute.Range{Min: 10000, Max: 10000}
+
+	r, err := Listen(context.Background(), Config{
+		Endpoint:    endpoint.LocalAddr().(*net.UDPAddr).AddrPort(),
+		Obfuscation: profile,
+	})
+	assert.NoError(t, err)
+
+	client, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(r.Addr()))
+	assert.NoError(t, err)
+	defer client.Close()
+
+	initiation := make([]byte, initiationSize)
+	initiation[0] = messageInitiation
+	_, err = client.Write(initiation)
+	assert.NoError(t, err)
+
+	// Wait for the junk packet so the relay is sleeping when it is closed.
+	endpoint.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = endpoint.Read(make([]byte, 2048))
+	assert.NoError(t, err)
+
+	start := time.Now()
+	assert.NoError(t, r.Close())
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "closing does not wait for the junk delay")
+}
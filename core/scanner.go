@@ -3,68 +3,124 @@ package core
 import (
 	"context"
 	"errors"
+	"net/netip"
 	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/shahradelahi/cloudflare-warp/cloudflare/network"
 	"github.com/shahradelahi/cloudflare-warp/ipscanner"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
 	"github.com/shahradelahi/cloudflare-warp/log"
 )
 
+const (
+	// DefaultScanCount is the number of endpoints RunScan returns by
+	// default.
+	DefaultScanCount = 2
+	// DefaultScanTimeout bounds RunScan by default.
+	DefaultScanTimeout = time.Minute
+)
+
 type ScanOptions struct {
 	V4         bool
 	V6         bool
 	MaxRTT     time.Duration
 	PrivateKey string
 	PublicKey  string
+	Reserved   []byte
+	// Obfuscation is the junk-packet profile of the probes. The scanner's
+	// default is used when nil.
+	Obfuscation *statute.ObfuscationProfile
+	// Concurrency is the number of addresses probed at the same time, and
+	// Rate the handshakes sent per second. Defaults when 0.
+	Concurrency int
+	Rate        int
+	// Count is the number of endpoints returned; the scan stops once they
+	// are found. Timeout and MaxProbes bound the scan, and it fails when
+	// fewer than MinResults endpoints were found by then. DefaultScanCount,
+	// DefaultScanTimeout, unlimited and 1 when 0.
+	Count      int
+	Timeout    time.Duration
+	MaxProbes  int64
+	MinResults int
+	// CidrList and Ports replace the built-in WARP ranges and ports when
+	// set, and the addresses of Exclude are skipped.
+	CidrList []netip.Prefix
+	Ports    []uint16
+	Exclude  []netip.Prefix
+	// Verify drops the endpoints that answer handshakes but do not carry
+	// an ICMP echo from VerifySource, the identity's IPv4 tunnel address,
+	// and marks them bad in the cache.
+	Verify       bool
+	VerifySource netip.Addr
 }
 
 func RunScan(ctx context.Context, opts ScanOptions) (result []ipscanner.IPInfo, err error) {
-	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
-	defer cancel()
+	obfuscation := opts.Obfuscation
+	if obfuscation == nil {
+		obfuscation = statute.DefaultObfuscationProfile()
+	}
+	count := opts.Count
+	if count <= 0 {
+		count = DefaultScanCount
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultScanTimeout
+	}
+	cidrs := opts.CidrList
+	if len(cidrs) == 0 {
+		cidrs = network.ScannerPrefixes()
+	}
 
-	scanner := ipscanner.NewScanner(
+	scanOpts := []ipscanner.Option{
+		ipscanner.WithContext(ctx),
+		ipscanner.WithObfuscation(obfuscation),
 		ipscanner.WithWarpPrivateKey(opts.PrivateKey),
 		ipscanner.WithWarpPeerPublicKey(opts.PublicKey),
+		ipscanner.WithWarpReserved(opts.Reserved),
 		ipscanner.WithUseIPv4(opts.V4),
 		ipscanner.WithUseIPv6(opts.V6),
 		ipscanner.WithMaxDesirableRTT(opts.MaxRTT),
-		ipscanner.WithCidrList(network.ScannerPrefixes()),
-	)
-
-	go func() {
-		if err := scanner.Run(); err != nil {
-			log.Errorw("IP scanner encountered a fatal error during execution", zap.Error(err))
+		ipscanner.WithCidrList(cidrs),
+		ipscanner.WithExclude(opts.Exclude),
+		ipscanner.WithRate(opts.Rate),
+		ipscanner.WithCount(count),
+		ipscanner.WithIPQueueSize(max(count, opts.MinResults)),
+		ipscanner.WithTimeout(timeout),
+		ipscanner.WithMaxProbes(opts.MaxProbes),
+		ipscanner.WithMinResults(max(opts.MinResults, 1)),
+	}
+	if opts.Concurrency > 0 {
+		scanOpts = append(scanOpts, ipscanner.WithConcurrency(opts.Concurrency))
+	}
+	if len(opts.Ports) > 0 {
+		scanOpts = append(scanOpts, ipscanner.WithPortStrategy(statute.PortsFixed, 0), ipscanner.WithPorts(opts.Ports))
+	}
+	if opts.Verify {
+		if !opts.VerifySource.Is4() {
+			return nil, errors.New("endpoint verification requires the identity's IPv4 tunnel address")
 		}
-	}()
-	defer scanner.Stop()
+		scanOpts = append(scanOpts, ipscanner.WithVerify(statute.VerifyOptions{Source: opts.VerifySource}))
+	}
+	scanner := ipscanner.NewScanner(scanOpts...)
 
 	startTime := time.Now()
 	log.Info("Initiating IP scan process...")
 
-	progressTicker := time.NewTicker(5 * time.Second)
-	defer progressTicker.Stop()
-
-	checkTicker := time.NewTicker(250 * time.Millisecond)
-	defer checkTicker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, errors.New("scan canceled or timed out")
-		case <-progressTicker.C:
-			elapsed := time.Since(startTime).Round(time.Second)
-			log.Infow("IP scan in progress", zap.Duration("elapsed_time", elapsed))
-		case <-checkTicker.C:
-			ipList := scanner.GetAvailableIPs()
-			if len(ipList) > 1 {
-				result = ipList[:2]
-				elapsed := time.Since(startTime).Round(time.Second)
-				log.Infow("IP scan completed successfully", zap.Int("endpoints_found", len(result)), zap.Duration("duration", elapsed))
-				log.Debugw("Found endpoints", "endpoints", result)
-				return result, nil
-			}
-		}
+	err = scanner.Run()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	result = scanner.GetAvailableIPs()
+	result = result[:min(count, len(result))]
+	elapsed := time.Since(startTime).Round(time.Second)
+	log.Infow("IP scan completed successfully", zap.Int("endpoints_found", len(result)), zap.Duration("duration", elapsed))
+	log.Debugw("Found endpoints", "endpoints", result)
+	return result, nil
 }
@@ -0,0 +1,76 @@
+package usage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Alert is raised when the remaining premium data drops below a threshold.
+type Alert struct {
+	Event       string     `json:"event"`
+	AccountID   string     `json:"account_id"`
+	PremiumData int64      `json:"premium_data"`
+	Threshold   int64      `json:"threshold"`
+	Time        time.Time  `json:"time"`
+	Depletion   *time.Time `json:"projected_depletion,omitempty"`
+}
+
+// AlertEvent is the event name sent with low-quota alerts.
+const AlertEvent = "warp.premium_data.low"
+
+// Watcher tracks whether the balance is below the threshold so an alert is
+// raised once per crossing instead of on every poll. Below should be restored
+// from and saved to the History between runs; after Check it reports whether
+// the checked sample is below the threshold.
+type Watcher struct {
+	Threshold int64
+	Below     bool
+}
+
+// Check returns true when the sample crosses below the threshold.
+func (w *Watcher) Check(s Sample) bool {
+	if w.Threshold <= 0 {
+		return false
+	}
+	if s.PremiumData >= w.Threshold {
+		w.Below = false
+		return false
+	}
+	if w.Below {
+		return false
+	}
+	w.Below = true
+	return true
+}
+
+// SendWebhook posts the alert as JSON to the given URL.
+func SendWebhook(ctx context.Context, url string, alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/shahradelahi/cloudflare-warp/core/datadir"
+	"github.com/shahradelahi/cloudflare-warp/utils"
+)
+
+const (
+	// maxSamples bounds the history kept on disk.
+	maxSamples = 2048
+	fileName   = "usage.json"
+)
+
+// Sample is a point-in-time reading of the account's WARP+ data counters.
+type Sample struct {
+	Time        time.Time `json:"time"`
+	PremiumData int64     `json:"premium_data"`
+	Quota       int64     `json:"quota"`
+	Usage       int64     `json:"usage"`
+}
+
+// Projection is an estimate of when the remaining premium data runs out.
+type Projection struct {
+	// Rate is the average consumption in bytes per second.
+	Rate float64
+	// Depletion is the projected time at which no premium data is left.
+	Depletion time.Time
+}
+
+// History stores the samples recorded for the current account.
+type History struct {
+	AccountID string   `json:"account_id,omitempty"`
+	Samples   []Sample `json:"samples"`
+	// Below is the alert state of the Watcher, kept on disk so that one-shot
+	// runs raise the alert once per crossing rather than on every run.
+	Below bool `json:"below,omitempty"`
+	mutex sync.Mutex
+}
+
+// SetAccount keys the history to accountID. Samples and alert state recorded
+// for a different account are discarded.
+func (h *History) SetAccount(accountID string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.AccountID == accountID {
+		return
+	}
+	h.AccountID = accountID
+	h.Samples = nil
+	h.Below = false
+}
+
+// Add appends a sample, dropping the oldest ones beyond maxSamples.
+func (h *History) Add(s Sample) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.Samples = append(h.Samples, s)
+	if len(h.Samples) > maxSamples {
+		h.Samples = h.Samples[len(h.Samples)-maxSamples:]
+	}
+}
+
+// Project estimates when premium data will run out from the samples recorded
+// since the last top-up. It returns false if there is not enough data or the
+// balance is not decreasing.
+func (h *History) Project() (Projection, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.Samples) < 2 {
+		return Projection{}, false
+	}
+
+	// A growing balance means data was added (e.g. a referral or a new
+	// license); only consumption after that point is representative.
+	start := 0
+	for i := 1; i < len(h.Samples); i++ {
+		if h.Samples[i].PremiumData > h.Samples[i-1].PremiumData {
+			start = i
+		}
+	}
+
+	first, last := h.Samples[start], h.Samples[len(h.Samples)-1]
+	elapsed := last.Time.Sub(first.Time).Seconds()
+	consumed := first.PremiumData - last.PremiumData
+	if elapsed <= 0 || consumed <= 0 {
+		return Projection{}, false
+	}
+
+	rate := float64(consumed) / elapsed
+	remaining := time.Duration(float64(last.PremiumData) / rate * float64(time.Second))
+
+	return Projection{
+		Rate:      rate,
+		Depletion: last.Time.Add(remaining),
+	}, true
+}
+
+// Load reads the usage history from the data directory. A missing file yields
+// an empty history.
+func Load() (*History, error) {
+	h := &History{}
+
+	filePath, err := historyPath()
+	if err != nil {
+		return h, err
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return h, nil
+		}
+		return h, err
+	}
+
+	if err := json.Unmarshal(data, h); err != nil {
+		return &History{}, err
+	}
+	return h, nil
+}
+
+// Save writes the usage history to the data directory.
+func (h *History) Save() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	filePath, err := historyPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(filePath, data, 0644)
+}
+
+func historyPath() (string, error) {
+	dir := datadir.GetDataDir()
+	if dir == "" {
+		return "", fmt.Errorf("data directory not set")
+	}
+	return filepath.Join(dir, fileName), nil
+}
@@ -0,0 +1,107 @@
+package usage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shahradelahi/cloudflare-warp/core/datadir"
+)
+
+const gib = 1 << 30
+
+func TestProject(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := &History{}
+
+	_, ok := h.Project()
+	assert.False(t, ok, "an empty history has no projection")
+
+	h.Add(Sample{Time: start, PremiumData: 10 * gib})
+	h.Add(Sample{Time: start.Add(time.Hour), PremiumData: 9 * gib})
+
+	p, ok := h.Project()
+	assert.True(t, ok)
+	assert.InDelta(t, float64(gib)/3600, p.Rate, 1)
+	assert.Equal(t, start.Add(10*time.Hour), p.Depletion)
+
+	// A top-up restarts the projection from the new balance.
+	h.Add(Sample{Time: start.Add(2 * time.Hour), PremiumData: 20 * gib})
+	_, ok = h.Project()
+	assert.False(t, ok, "a single sample after a top-up has no projection")
+
+	h.Add(Sample{Time: start.Add(4 * time.Hour), PremiumData: 16 * gib})
+	p, ok = h.Project()
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(12*time.Hour), p.Depletion)
+}
+
+func TestWatcherCheck(t *testing.T) {
+	w := &Watcher{Threshold: gib}
+
+	assert.False(t, w.Check(Sample{PremiumData: 2 * gib}))
+	assert.True(t, w.Check(Sample{PremiumData: gib / 2}), "crossing the threshold raises an alert")
+	assert.False(t, w.Check(Sample{PremiumData: gib / 4}), "staying below does not raise it again")
+	assert.False(t, w.Check(Sample{PremiumData: 3 * gib}))
+	assert.True(t, w.Check(Sample{PremiumData: gib / 2}), "a new crossing raises it again")
+
+	disabled := &Watcher{}
+	assert.False(t, disabled.Check(Sample{PremiumData: 0}))
+}
+
+func TestLoadAndSave(t *testing.T) {
+	datadir.SetDataDir(t.TempDir())
+
+	h, err := Load()
+	assert.NoError(t, err)
+	assert.Empty(t, h.Samples)
+
+	for i := 0; i < maxSamples+10; i++ {
+		h.Add(Sample{Time: time.Unix(int64(i), 0).UTC(), PremiumData: int64(i)})
+	}
+	assert.Len(t, h.Samples, maxSamples)
+	assert.NoError(t, h.Save())
+
+	loaded, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, h.Samples, loaded.Samples)
+	assert.Equal(t, int64(10), loaded.Samples[0].PremiumData, "oldest samples should be dropped")
+}
+
+func TestAlertStatePersists(t *testing.T) {
+	datadir.SetDataDir(t.TempDir())
+
+	h, err := Load()
+	assert.NoError(t, err)
+	h.SetAccount("account-1")
+
+	w := &Watcher{Threshold: gib, Below: h.Below}
+	assert.True(t, w.Check(Sample{PremiumData: gib / 2}))
+	h.Below = w.Below
+	assert.NoError(t, h.Save())
+
+	// A later run restores the state and does not raise the alert again.
+	h, err = Load()
+	assert.NoError(t, err)
+	h.SetAccount("account-1")
+	w = &Watcher{Threshold: gib, Below: h.Below}
+	assert.False(t, w.Check(Sample{PremiumData: gib / 4}), "the crossing was already reported by a previous run")
+	assert.True(t, w.Below, "the balance is still reported as below the threshold")
+}
+
+func TestSetAccount(t *testing.T) {
+	h := &History{}
+	h.SetAccount("account-1")
+	h.Add(Sample{PremiumData: gib})
+	h.Below = true
+
+	h.SetAccount("account-1")
+	assert.Len(t, h.Samples, 1, "the same account keeps its history")
+	assert.True(t, h.Below)
+
+	h.SetAccount("account-2")
+	assert.Equal(t, "account-2", h.AccountID)
+	assert.Empty(t, h.Samples, "samples of another account are discarded")
+	assert.False(t, h.Below)
+}
@@ -1,42 +1,243 @@
 package core
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"net/netip"
 
 	"github.com/shahradelahi/wiresocks"
 
 	"github.com/shahradelahi/cloudflare-warp/cloudflare/model"
+	"github.com/shahradelahi/cloudflare-warp/core/cache"
 )
 
-func GenerateWireguardConfig(i *model.Identity) wiresocks.Configuration {
-	priv, _ := wiresocks.EncodeBase64ToHex(i.PrivateKey)
-	pub, _ := wiresocks.EncodeBase64ToHex(i.Config.Peers[0].PublicKey)
+const (
+	DefaultMTU       = 1280
+	DefaultKeepAlive = 25
 
+	// zeroPresharedKey is used because WARP peers do not use a preshared key.
+	zeroPresharedKey = "0000000000000000000000000000000000000000000000000000000000000000"
+)
+
+// DefaultDNS are Cloudflare's public resolvers.
+var DefaultDNS = []netip.Addr{
+	netip.MustParseAddr("1.1.1.1"),
+	netip.MustParseAddr("1.0.0.1"),
+	netip.MustParseAddr("2606:4700:4700::1111"),
+	netip.MustParseAddr("2606:4700:4700::1001"),
+}
+
+// resolver returns the DNS server used to resolve endpoint hostnames: dns if
+// set, else the first of DefaultDNS.
+func resolver(dns netip.Addr) string {
+	if !dns.IsValid() {
+		dns = DefaultDNS[0]
+	}
+	return dns.String()
+}
+
+// PrivateRanges are the destinations excluded from AllowedIPs when
+// WireguardOptions.ExcludePrivate is set: private, link-local and unique
+// local networks.
+var PrivateRanges = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// WireguardOptions customizes the configuration built by
+// GenerateWireguardConfig. The zero value yields the defaults.
+type WireguardOptions struct {
+	// MTU of the tunnel interface. DefaultMTU when 0.
+	MTU int
+	// DNS servers. DefaultDNS when empty.
+	DNS []netip.Addr
+	// AllowedIPs routed through the tunnel. All addresses when empty.
+	AllowedIPs []netip.Prefix
+	// ExcludePrivate removes PrivateRanges from AllowedIPs.
+	ExcludePrivate bool
+	// KeepAlive is the persistent keepalive interval in seconds.
+	// DefaultKeepAlive when 0, disabled when negative.
+	KeepAlive int
+	// IPv4Only and IPv6Only restrict the interface addresses, AllowedIPs and
+	// DNS servers to one address family.
+	IPv4Only bool
+	IPv6Only bool
+	// Endpoint replaces the identity's endpoint (host:port).
+	Endpoint string
+	// BestEndpoint uses the lowest-RTT endpoint from the scanner cache when
+	// Endpoint is empty.
+	BestEndpoint bool
+}
+
+// GenerateWireguardConfig builds the WireGuard configuration of an identity.
+func GenerateWireguardConfig(i *model.Identity, opts WireguardOptions) (wiresocks.Configuration, error) {
+	if opts.IPv4Only && opts.IPv6Only {
+		return wiresocks.Configuration{}, errors.New("IPv4-only and IPv6-only are mutually exclusive")
+	}
+	if len(i.Config.Peers) == 0 {
+		return wiresocks.Configuration{}, errors.New("identity has no peers")
+	}
+
+	priv, err := wiresocks.EncodeBase64ToHex(i.PrivateKey)
+	if err != nil {
+		return wiresocks.Configuration{}, fmt.Errorf("invalid private key: %w", err)
+	}
+	pub, err := wiresocks.EncodeBase64ToHex(i.Config.Peers[0].PublicKey)
+	if err != nil {
+		return wiresocks.Configuration{}, fmt.Errorf("invalid peer public key: %w", err)
+	}
+
+	var addresses []netip.Prefix
+	for _, s := range []string{i.Config.Interface.Addresses.V4, i.Config.Interface.Addresses.V6} {
+		if s == "" {
+			continue
+		}
+		addr, err := wiresocks.ParsePrefixOrAddr(s)
+		if err != nil {
+			return wiresocks.Configuration{}, fmt.Errorf("invalid interface address: %w", err)
+		}
+		if opts.allowsFamily(addr.Addr()) {
+			addresses = append(addresses, addr)
+		}
+	}
+	if len(addresses) == 0 {
+		return wiresocks.Configuration{}, errors.New("identity has no interface address of the requested family")
+	}
+
+	mtu := opts.MTU
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+
+	dns := opts.DNS
+	if len(dns) == 0 {
+		dns = DefaultDNS
+	}
 	var dnsAddrs []netip.Addr
-	for _, dns := range []string{"1.1.1.1", "1.0.0.1", "2606:4700:4700::1112", "2606:4700:4700::1112"} {
-		addr := netip.MustParseAddr(dns)
-		dnsAddrs = append(dnsAddrs, addr)
+	for _, addr := range dns {
+		if opts.allowsFamily(addr) && !containsAddr(dnsAddrs, addr) {
+			dnsAddrs = append(dnsAddrs, addr)
+		}
+	}
+
+	allowed := opts.AllowedIPs
+	if len(allowed) == 0 {
+		allowed = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	}
+	var allowedIPs []netip.Prefix
+	for _, prefix := range allowed {
+		if opts.allowsFamily(prefix.Addr()) {
+			allowedIPs = append(allowedIPs, prefix.Masked())
+		}
+	}
+	if opts.ExcludePrivate {
+		allowedIPs = ExcludePrefixes(allowedIPs, PrivateRanges)
+	}
+
+	keepAlive := opts.KeepAlive
+	switch {
+	case keepAlive == 0:
+		keepAlive = DefaultKeepAlive
+	case keepAlive < 0:
+		keepAlive = 0
+	}
+
+	endpoint, err := opts.endpoint(i)
+	if err != nil {
+		return wiresocks.Configuration{}, err
 	}
 
 	return wiresocks.Configuration{
 		Interface: &wiresocks.InterfaceConfig{
 			PrivateKey: priv,
-			Addresses: []netip.Prefix{
-				wiresocks.MustParsePrefixOrAddr(i.Config.Interface.Addresses.V4),
-				wiresocks.MustParsePrefixOrAddr(i.Config.Interface.Addresses.V6),
-			},
-			MTU: 1280,
-			DNS: dnsAddrs,
+			Addresses:  addresses,
+			MTU:        mtu,
+			DNS:        dnsAddrs,
 		},
 		Peers: []wiresocks.PeerConfig{{
 			PublicKey:    pub,
-			PreSharedKey: "0000000000000000000000000000000000000000000000000000000000000000",
-			AllowedIPs: []netip.Prefix{
-				netip.MustParsePrefix("0.0.0.0/0"),
-				netip.MustParsePrefix("::/0"),
-			},
-			KeepAlive: 25,
-			Endpoint:  i.Config.Peers[0].Endpoint.Host,
+			PreSharedKey: zeroPresharedKey,
+			AllowedIPs:   allowedIPs,
+			KeepAlive:    keepAlive,
+			Endpoint:     endpoint,
 		}},
+	}, nil
+}
+
+func (o *WireguardOptions) allowsFamily(addr netip.Addr) bool {
+	switch {
+	case o.IPv4Only:
+		return addr.Is4()
+	case o.IPv6Only:
+		return addr.Is6()
+	default:
+		return true
 	}
 }
+
+func (o *WireguardOptions) endpoint(i *model.Identity) (string, error) {
+	if o.Endpoint != "" {
+		if _, _, err := net.SplitHostPort(o.Endpoint); err != nil {
+			return "", fmt.Errorf("invalid endpoint %q: %w", o.Endpoint, err)
+		}
+		return o.Endpoint, nil
+	}
+
+	if o.BestEndpoint {
+		best, err := cache.NewCache().GetBestEndpoint()
+		if err != nil {
+			return "", fmt.Errorf("no cached endpoint, run a scan first: %w", err)
+		}
+		return best.Address, nil
+	}
+
+	return i.Config.Peers[0].Endpoint.Host, nil
+}
+
+func containsAddr(addrs []netip.Addr, addr netip.Addr) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// ExcludePrefixes returns the address space covered by prefixes minus the
+// excluded ranges, as the smallest list of CIDR prefixes.
+func ExcludePrefixes(prefixes, exclude []netip.Prefix) []netip.Prefix {
+	result := prefixes
+	for _, e := range exclude {
+		var next []netip.Prefix
+		for _, p := range result {
+			next = append(next, subtractPrefix(p, e.Masked())...)
+		}
+		result = next
+	}
+	return result
+}
+
+// subtractPrefix removes e from p by splitting p in halves until no half
+// overlaps e.
+func subtractPrefix(p, e netip.Prefix) []netip.Prefix {
+	if !p.Overlaps(e) {
+		return []netip.Prefix{p}
+	}
+	if e.Bits() <= p.Bits() {
+		// e covers all of p
+		return nil
+	}
+
+	lower := netip.PrefixFrom(p.Addr(), p.Bits()+1)
+	upperAddr := p.Addr().AsSlice()
+	upperAddr[p.Bits()/8] |= 0x80 >> (p.Bits() % 8)
+	upperBase, _ := netip.AddrFromSlice(upperAddr)
+	upper := netip.PrefixFrom(upperBase, p.Bits()+1)
+
+	return append(subtractPrefix(lower, e), subtractPrefix(upper, e)...)
+}
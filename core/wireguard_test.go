@@ -0,0 +1,97 @@
+package core
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/model"
+)
+
+func testIdentity() *model.Identity {
+	return &model.Identity{
+		PrivateKey: "aGVsbG8gd29ybGQgaGVsbG8gd29ybGQgaGVsbG8gd28=",
+		Config: model.IdentityConfig{
+			Peers: []model.IdentityConfigPeer{{
+				PublicKey: "bmZRhmVvtrZSd0aZmuoRbt7ZKzwg7CRm7wUNMzTPpGY=",
+				Endpoint:  model.IdentityConfigPeerEndpoint{Host: "engage.cloudflareclient.com:2408"},
+			}},
+			Interface: model.IdentityConfigInterface{
+				Addresses: model.IdentityConfigInterfaceAddresses{
+					V4: "172.16.0.2",
+					V6: "2606:4700:110:8a36::2",
+				},
+			},
+		},
+	}
+}
+
+func prefixes(s ...string) []netip.Prefix {
+	out := make([]netip.Prefix, len(s))
+	for i, p := range s {
+		out[i] = netip.MustParsePrefix(p)
+	}
+	return out
+}
+
+func TestGenerateWireguardConfigDefaults(t *testing.T) {
+	conf, err := GenerateWireguardConfig(testIdentity(), WireguardOptions{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, DefaultMTU, conf.Interface.MTU)
+	assert.Equal(t, DefaultDNS, conf.Interface.DNS)
+	assert.Equal(t, prefixes("172.16.0.2/32", "2606:4700:110:8a36::2/128"), conf.Interface.Addresses)
+	assert.Equal(t, prefixes("0.0.0.0/0", "::/0"), conf.Peers[0].AllowedIPs)
+	assert.Equal(t, DefaultKeepAlive, conf.Peers[0].KeepAlive)
+	assert.Equal(t, "engage.cloudflareclient.com:2408", conf.Peers[0].Endpoint)
+}
+
+func TestGenerateWireguardConfigOptions(t *testing.T) {
+	conf, err := GenerateWireguardConfig(testIdentity(), WireguardOptions{
+		MTU:        1420,
+		DNS:        []netip.Addr{netip.MustParseAddr("9.9.9.9"), netip.MustParseAddr("9.9.9.9"), netip.MustParseAddr("2620:fe::fe")},
+		AllowedIPs: prefixes("0.0.0.0/0", "::/0"),
+		KeepAlive:  -1,
+		IPv4Only:   true,
+		Endpoint:   "162.159.192.1:500",
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1420, conf.Interface.MTU)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("9.9.9.9")}, conf.Interface.DNS)
+	assert.Equal(t, prefixes("172.16.0.2/32"), conf.Interface.Addresses)
+	assert.Equal(t, prefixes("0.0.0.0/0"), conf.Peers[0].AllowedIPs)
+	assert.Equal(t, 0, conf.Peers[0].KeepAlive)
+	assert.Equal(t, "162.159.192.1:500", conf.Peers[0].Endpoint)
+
+	_, err = GenerateWireguardConfig(testIdentity(), WireguardOptions{IPv4Only: true, IPv6Only: true})
+	assert.Error(t, err)
+	_, err = GenerateWireguardConfig(testIdentity(), WireguardOptions{Endpoint: "162.159.192.1"})
+	assert.Error(t, err)
+}
+
+func TestExcludePrefixes(t *testing.T) {
+	got := ExcludePrefixes(prefixes("10.0.0.0/8"), prefixes("10.0.0.0/9"))
+	assert.Equal(t, prefixes("10.128.0.0/9"), got)
+
+	got = ExcludePrefixes(prefixes("192.168.0.0/22"), prefixes("192.168.1.0/24"))
+	assert.Equal(t, prefixes("192.168.0.0/24", "192.168.2.0/23"), got)
+
+	got = ExcludePrefixes(prefixes("0.0.0.0/0", "::/0"), PrivateRanges)
+	assert.Contains(t, got, netip.MustParsePrefix("0.0.0.0/5"))
+	assert.Contains(t, got, netip.MustParsePrefix("11.0.0.0/8"))
+	assert.Contains(t, got, netip.MustParsePrefix("::/1"))
+	for _, p := range got {
+		for _, private := range PrivateRanges {
+			assert.False(t, p.Overlaps(private), "%s overlaps %s", p, private)
+		}
+	}
+
+	assert.Empty(t, ExcludePrefixes(prefixes("10.1.0.0/16"), prefixes("10.0.0.0/8")))
+}
+
+func TestResolver(t *testing.T) {
+	assert.Equal(t, "1.1.1.1", resolver(netip.Addr{}), "an unset server falls back to DefaultDNS")
+	assert.Equal(t, "9.9.9.9", resolver(netip.MustParseAddr("9.9.9.9")))
+}
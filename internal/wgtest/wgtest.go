@@ -0,0 +1,107 @@
+// Package wgtest runs a local WireGuard peer for tests. The peer answers ICMP
+// echo requests sent to PeerAddr through the tunnel.
+package wgtest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/amnezia-vpn/amneziawg-go/conn"
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/amnezia-vpn/amneziawg-go/tun/netstack"
+	"golang.org/x/crypto/curve25519"
+)
+
+// PeerAddr is the address of the peer inside the tunnel.
+var PeerAddr = netip.MustParseAddr("1.1.1.1")
+
+// Peer is a WireGuard server listening on the loopback interface.
+type Peer struct {
+	// Endpoint is the UDP address the peer listens on.
+	Endpoint netip.AddrPort
+	// PublicKey is the peer's public key in base64.
+	PublicKey string
+
+	dev *device.Device
+}
+
+// KeyPair returns a new private key and its public key, both in base64.
+func KeyPair() (privateKey, publicKey string, err error) {
+	var priv, pub [32]byte
+	if _, err := rand.Read(priv[:]); err != nil {
+		return "", "", err
+	}
+	curve25519.ScalarBaseMult(&pub, &priv)
+	return base64.StdEncoding.EncodeToString(priv[:]), base64.StdEncoding.EncodeToString(pub[:]), nil
+}
+
+// NewPeer starts a peer that accepts the client with the given base64 public
+// key and an MTU of mtu inside the tunnel.
+func NewPeer(clientPublicKey string, mtu int) (*Peer, error) {
+	privateKey, publicKey, err := KeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	tunDev, _, err := netstack.CreateNetTUN([]netip.Addr{PeerAddr}, nil, mtu)
+	if err != nil {
+		return nil, err
+	}
+
+	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+
+	var request strings.Builder
+	fmt.Fprintf(&request, "private_key=%s\n", toHex(privateKey))
+	request.WriteString("listen_port=0\n")
+	fmt.Fprintf(&request, "public_key=%s\n", toHex(clientPublicKey))
+	request.WriteString("allowed_ip=0.0.0.0/0\n")
+	if err := dev.IpcSet(request.String()); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return nil, err
+	}
+
+	port, err := listenPort(dev)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+
+	return &Peer{
+		Endpoint:  netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port),
+		PublicKey: publicKey,
+		dev:       dev,
+	}, nil
+}
+
+// Close stops the peer.
+func (p *Peer) Close() {
+	p.dev.Close()
+}
+
+func listenPort(dev *device.Device) (uint16, error) {
+	state, err := dev.IpcGet()
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(state, "\n") {
+		if v, ok := strings.CutPrefix(line, "listen_port="); ok {
+			var port uint16
+			_, err := fmt.Sscan(v, &port)
+			return port, err
+		}
+	}
+	return 0, fmt.Errorf("listen port not reported")
+}
+
+func toHex(key string) string {
+	b, _ := base64.StdEncoding.DecodeString(key)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,218 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/ipgenerator"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/ping"
+	"github.com/shahradelahi/cloudflare-warp/utils"
+)
+
+// checkpointInterval is how often the progress of a scan is saved.
+const checkpointInterval = 10 * time.Second
+
+// checkpoint is the progress of a flat scan saved to disk, enough to resume
+// it: the seed and the position in each prefix fix the addresses left to
+// probe.
+type checkpoint struct {
+	Seed uint64 `json:"seed"`
+	// Fingerprint identifies the settings the results were found with, see
+	// fingerprint.
+	Fingerprint string           `json:"fingerprint"`
+	Prefixes    []prefixPosition `json:"prefixes"`
+	Processed   int64            `json:"processed"`
+	Failed      int64            `json:"failed"`
+	Results     []statute.IPInfo `json:"results"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+}
+
+type prefixPosition struct {
+	Prefix netip.Prefix `json:"prefix"`
+	// Position is the number of addresses of the prefix handed out in the
+	// pseudo-random order, and Retry the indices of those among them whose
+	// probe did not finish.
+	Position uint64   `json:"position"`
+	Retry    []uint64 `json:"retry,omitempty"`
+}
+
+// loadCheckpoint reads the checkpoint at path. It returns nil when there is
+// none.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// save writes the checkpoint to path, replacing the previous one only once
+// it is complete.
+func (cp *checkpoint) save(path string) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(path, data, 0644)
+}
+
+// fingerprint hashes the scan settings that decide which addresses are
+// probed and which results are kept besides the targets and the seed: the
+// probe, the ports, the exclusions, the RTT limit, the sample count, the
+// obfuscation profile, the reserved bytes and the identity key. A checkpoint
+// is only resumed by a scan with the same fingerprint, so that its results
+// stay consistent.
+func fingerprint(opts *statute.ScannerOptions) string {
+	probe := opts.Probe
+	if probe == "" {
+		probe = ping.ProbeWarp
+	}
+	exclude := slices.Clone(opts.Exclude)
+	slices.SortFunc(exclude, func(a, b netip.Prefix) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	obfuscation := opts.Obfuscation
+	if !obfuscation.Enabled() {
+		obfuscation = nil
+	}
+	identity := sha256.Sum256([]byte(opts.WarpPrivateKey))
+
+	h := sha256.New()
+	json.NewEncoder(h).Encode(struct {
+		Probe           string                      `json:"probe"`
+		ProbeHost       string                      `json:"probe_host"`
+		Ports           []uint16                    `json:"ports"`
+		PortStrategy    statute.PortStrategy        `json:"port_strategy"`
+		PortCount       int                         `json:"port_count"`
+		Exclude         []netip.Prefix              `json:"exclude"`
+		MaxDesirableRTT time.Duration               `json:"max_desirable_rtt"`
+		Samples         int                         `json:"samples"`
+		Obfuscation     *statute.ObfuscationProfile `json:"obfuscation"`
+		Reserved        []byte                      `json:"reserved"`
+		Identity        []byte                      `json:"identity"`
+	}{
+		Probe:           probe,
+		ProbeHost:       opts.ProbeHost,
+		Ports:           opts.Ports,
+		PortStrategy:    opts.PortStrategy,
+		PortCount:       opts.PortCount,
+		Exclude:         exclude,
+		MaxDesirableRTT: opts.MaxDesirableRTT,
+		Samples:         max(opts.Samples, 1),
+		Obfuscation:     obfuscation,
+		Reserved:        opts.WarpReserved,
+		Identity:        identity[:],
+	})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// positions returns the position of every prefix of the checkpoint if it
+// covers exactly cidrs, and false otherwise.
+func (cp *checkpoint) positions(cidrs []netip.Prefix) (map[netip.Prefix]prefixPosition, bool) {
+	positions := make(map[netip.Prefix]prefixPosition, len(cp.Prefixes))
+	for _, p := range cp.Prefixes {
+		positions[p.Prefix] = p
+	}
+	if len(positions) != len(cidrs) {
+		return nil, false
+	}
+	for _, cidr := range cidrs {
+		if _, ok := positions[cidr]; !ok {
+			return nil, false
+		}
+	}
+	return positions, true
+}
+
+// cursor iterates over a prefix and tracks how far the scan got. Addresses
+// are handed out in order but finish in any order, so besides the position
+// it keeps the addresses in flight, which are probed again on resume.
+type cursor struct {
+	prefix netip.Prefix
+
+	mu       sync.Mutex
+	addrs    ipgenerator.IPRange
+	next     uint64
+	retry    []uint64
+	inFlight map[uint64]struct{}
+}
+
+func newCursor(prefix netip.Prefix, seed uint64, from prefixPosition) *cursor {
+	addrs, _ := ipgenerator.NewIPRange(prefix, ipgenerator.WithSeed(seed))
+	addrs.Seek(from.Position)
+	return &cursor{
+		prefix:   prefix,
+		addrs:    addrs,
+		next:     from.Position,
+		retry:    append([]uint64(nil), from.Retry...),
+		inFlight: make(map[uint64]struct{}),
+	}
+}
+
+// take returns the next address to probe and its index in the prefix, and
+// marks it in flight until done is called.
+func (c *cursor) take() (netip.Addr, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var (
+		addr  netip.Addr
+		index uint64
+		ok    bool
+	)
+	if len(c.retry) > 0 {
+		index, c.retry = c.retry[0], c.retry[1:]
+		addrs := c.addrs
+		addrs.Seek(index)
+		addr, ok = addrs.Next()
+	} else {
+		index = c.next
+		addr, ok = c.addrs.Next()
+		if ok {
+			c.next++
+		}
+	}
+	if ok {
+		c.inFlight[index] = struct{}{}
+	}
+	return addr, index, ok
+}
+
+// done marks the address at index as probed.
+func (c *cursor) done(index uint64) {
+	c.mu.Lock()
+	delete(c.inFlight, index)
+	c.mu.Unlock()
+}
+
+// position returns what to save in a checkpoint.
+func (c *cursor) position() prefixPosition {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := prefixPosition{Prefix: c.prefix, Position: c.next}
+	p.Retry = append(p.Retry, c.retry...)
+	for index := range c.inFlight {
+		p.Retry = append(p.Retry, index)
+	}
+	slices.Sort(p.Retry)
+	return p
+}
@@ -3,31 +3,103 @@ package engine
 import (
 	"context"
 	"errors"
+	"math/rand/v2"
 	"net/netip"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/shahradelahi/cloudflare-warp/core/cache"
 	"github.com/shahradelahi/cloudflare-warp/ipscanner/ipgenerator"
 	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
 	"github.com/shahradelahi/cloudflare-warp/ipscanner/ping"
 	"github.com/shahradelahi/cloudflare-warp/log"
 )
 
+// DefaultConcurrency is the number of addresses probed at the same time when
+// ScannerOptions.Concurrency is not set.
+const DefaultConcurrency = 16
+
+const progressInterval = 5 * time.Second
+
+// Stats are the scan counters.
+type Stats struct {
+	Processed int64
+	Failed    int64
+	Found     int
+}
+
 type Engine struct {
-	options    *statute.ScannerOptions
-	generators []*ipgenerator.IpGenerator
+	options *statute.ScannerOptions
+	cidrs   []netip.Prefix
+	exclude *exclusions
+	seed    uint64
+
+	// checkpoint is the path progress is saved to, if any, and resume the
+	// checkpoint the scan continues from.
+	checkpoint string
+	resume     *checkpoint
+	cursors    []*cursor
 
 	ipQueue *IPQueue
 	ping    *ping.Ping
+	// probe measures one address. It is the WARP pinger outside of tests.
+	probe func(ctx context.Context, addr netip.Addr) (statute.IPInfo, error)
+	// verify checks that a desirable endpoint forwards data. Endpoints are
+	// not verified when nil.
+	verify func(ctx context.Context, addr netip.AddrPort) error
+	// cache receives the endpoints found. Only the WARP probe finds WARP
+	// endpoints, so it is nil for the others.
+	cache *cache.Cache
+
+	processed atomic.Int64
+	failed    atomic.Int64
+	// scheduled counts the addresses handed to the workers and desirable
+	// the endpoints found below MaxDesirableRTT, for the stop criteria.
+	scheduled atomic.Int64
+	desirable atomic.Int64
+
+	subnetsMu sync.Mutex
+	subnets   []*statute.SubnetStats
 
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
+// source yields the addresses of a prefix, all belonging to subnet when it
+// is set. Sources of a checkpointed scan iterate with a cursor instead of
+// next.
+type source struct {
+	next   func() (netip.Addr, bool)
+	subnet *statute.SubnetStats
+	cursor *cursor
+}
+
+// target is an address to probe.
+type target struct {
+	addr   netip.Addr
+	subnet *statute.SubnetStats
+	cursor *cursor
+	index  uint64
+}
+
 func NewScannerEngine(ctx context.Context, opts *statute.ScannerOptions) (*Engine, error) {
-	var generators []*ipgenerator.IpGenerator
+	if _, err := ping.LookupProbe(opts.Probe); err != nil {
+		return nil, err
+	}
+	if opts.Verify != nil && !ping.IsWarpProbe(opts.Probe) {
+		return nil, errors.New("endpoint verification requires the warp probe")
+	}
+	if err := opts.Subnets.Validate(); err != nil {
+		return nil, err
+	}
+
+	exclude := newExclusions(opts.Exclude)
+	var cidrs []netip.Prefix
 	for _, cidr := range opts.CidrList {
 		if !opts.UseIPv6 && cidr.Addr().Is6() {
 			continue
@@ -35,82 +107,418 @@ func NewScannerEngine(ctx context.Context, opts *statute.ScannerOptions) (*Engin
 		if !opts.UseIPv4 && cidr.Addr().Is4() {
 			continue
 		}
-
-		gen, err := ipgenerator.NewIpGenerator([]netip.Prefix{cidr})
-		if err != nil {
-			return nil, errors.New("failed to create IP generator")
+		if !cidr.IsValid() {
+			continue
+		}
+		if exclude.covers(cidr) {
+			log.Debugw("Skipping excluded CIDR", zap.Stringer("cidr", cidr))
+			continue
 		}
-		generators = append(generators, gen)
+		cidrs = append(cidrs, cidr)
+	}
+	if len(cidrs) == 0 {
+		return nil, errors.New("no CIDR left to scan")
 	}
 
+	checkpointPath := opts.Checkpoint
+	if checkpointPath != "" && opts.Mode == statute.ScanSubnets {
+		log.Warn("Checkpoints are not supported in subnets mode")
+		checkpointPath = ""
+	}
+	var resume *checkpoint
+	if checkpointPath != "" {
+		resume = resumable(opts, checkpointPath, cidrs)
+	}
+
+	seed := opts.Seed
+	if resume != nil {
+		seed = resume.Seed
+	} else if seed == 0 {
+		seed = rand.Uint64()
+	}
+	log.Infow("Scanning addresses in pseudo-random order", zap.Uint64("seed", seed))
+
 	childCtx, cancel := context.WithCancel(ctx)
 
-	return &Engine{
-		options:    opts,
-		generators: generators,
+	e := &Engine{
+		options: opts,
+		cidrs:   cidrs,
+		exclude: exclude,
+		seed:    seed,
+
+		checkpoint: checkpointPath,
+		resume:     resume,
 
 		ipQueue: NewIPQueue(opts),
 
 		ping:   ping.NewPinger(opts),
 		ctx:    childCtx,
 		cancel: cancel,
-	}, nil
+	}
+	e.probe = e.ping.DoPing
+	if ping.IsWarpProbe(opts.Probe) {
+		e.cache = opts.Cache
+	}
+	if opts.Verify != nil {
+		e.verify = e.ping.Verify
+	}
+	return e, nil
 }
 
+// Run probes addresses with a pool of workers until the prefixes are
+// exhausted or the engine is shut down.
 func (e *Engine) Run() {
+	defer e.ping.Close()
 	e.ipQueue.Init()
 
-	processedIPs := 0
-	progressTicker := time.NewTicker(5 * time.Second)
+	if e.options.Mode == statute.ScanSubnets {
+		e.runSubnets()
+	} else {
+		e.runFlat()
+	}
+	log.Info("Scanner Done")
+}
+
+// resumable returns the checkpoint at path if it is that of a scan of cidrs
+// with a compatible seed and the same settings.
+func resumable(opts *statute.ScannerOptions, path string, cidrs []netip.Prefix) *checkpoint {
+	cp, err := loadCheckpoint(path)
+	if err != nil {
+		log.Warnw("Failed to load the scan checkpoint; starting over", zap.String("path", path), zap.Error(err))
+		return nil
+	}
+	if cp == nil {
+		return nil
+	}
+	if _, ok := cp.positions(cidrs); !ok || (opts.Seed != 0 && opts.Seed != cp.Seed) {
+		log.Warnw("The scan checkpoint is for other targets or another seed; starting over", zap.String("path", path))
+		return nil
+	}
+	if cp.Fingerprint != fingerprint(opts) {
+		log.Warnw("The scan checkpoint was saved with other probe, port, exclusion, RTT, sample, obfuscation, reserved or identity settings; starting over", zap.String("path", path))
+		return nil
+	}
+	return cp
+}
+
+// runFlat probes the addresses of every CIDR in turn, continuing from the
+// checkpoint if there is one.
+func (e *Engine) runFlat() {
+	var positions map[netip.Prefix]prefixPosition
+	if e.resume != nil {
+		positions, _ = e.resume.positions(e.cidrs)
+		e.processed.Store(e.resume.Processed)
+		e.failed.Store(e.resume.Failed)
+		for _, info := range e.resume.Results {
+			e.ipQueue.Enqueue(info)
+			e.desirable.Add(1)
+		}
+		log.Infow("Resuming scan from checkpoint",
+			zap.Int64("processed_ips", e.resume.Processed),
+			zap.Int("found_ips", len(e.resume.Results)),
+			zap.Time("saved_at", e.resume.UpdatedAt))
+	}
+
+	var sources []source
+	for _, cidr := range e.cidrs {
+		c := newCursor(cidr, e.seed, positions[cidr])
+		e.cursors = append(e.cursors, c)
+		sources = append(sources, source{cursor: c})
+	}
+	e.scan(sources)
 
+	if e.checkpoint == "" {
+		return
+	}
+	if e.ctx.Err() == nil && !e.budgetExhausted() {
+		// Every address was probed, so the next scan starts over.
+		if err := os.Remove(e.checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warnw("Failed to remove the scan checkpoint", zap.Error(err))
+		}
+		return
+	}
+	e.saveCheckpoint()
+	log.Infow("Saved scan checkpoint; pass --resume to continue", zap.String("path", e.checkpoint))
+}
+
+// saveCheckpoint saves the progress of a flat scan.
+func (e *Engine) saveCheckpoint() {
+	cp := checkpoint{
+		Seed:        e.seed,
+		Fingerprint: fingerprint(e.options),
+		Processed:   e.processed.Load(),
+		Failed:      e.failed.Load(),
+		Results:     e.ipQueue.AvailableIPs(false),
+		UpdatedAt:   time.Now(),
+	}
+	for _, c := range e.cursors {
+		cp.Prefixes = append(cp.Prefixes, c.position())
+	}
+	if err := cp.save(e.checkpoint); err != nil {
+		log.Warnw("Failed to save the scan checkpoint", zap.String("path", e.checkpoint), zap.Error(err))
+	}
+}
+
+// runSubnets ranks the subnets of every CIDR by probing a few addresses of
+// each, then deep-scans the addresses left in the best subnets.
+func (e *Engine) runSubnets() {
+	opts := e.options.Subnets.WithDefaults()
+
+	var sources []source
+	for _, cidr := range e.cidrs {
+		bits := opts.Bits4
+		if cidr.Addr().Is6() {
+			bits = opts.Bits6
+		}
+		subnets, err := ipgenerator.NewSubnetRange(cidr, bits, ipgenerator.WithSeed(e.seed), ipgenerator.WithSample(uint64(opts.MaxPerCIDR)))
+		if err != nil {
+			log.Warnw("Skipping CIDR", zap.Stringer("cidr", cidr), zap.Error(err))
+			continue
+		}
+		for subnet, ok := subnets.Next(); ok; subnet, ok = subnets.Next() {
+			stats := &statute.SubnetStats{Prefix: subnet}
+			e.subnetsMu.Lock()
+			e.subnets = append(e.subnets, stats)
+			e.subnetsMu.Unlock()
+			addrs, _ := ipgenerator.NewIPRange(subnet, ipgenerator.WithSeed(e.seed), ipgenerator.WithSample(uint64(opts.Probes)))
+			sources = append(sources, source{next: addrs.Next, subnet: stats})
+		}
+	}
+
+	log.Infow("Ranking subnets", zap.Int("subnets", len(sources)), zap.Int("probes_per_subnet", opts.Probes))
+	e.scan(sources)
+	if e.ctx.Err() != nil || e.budgetExhausted() {
+		return
+	}
+
+	ranked := e.SubnetStats()
+	sources = sources[:0]
+	for _, stats := range ranked {
+		if len(sources) == opts.Top || stats.Answered == 0 {
+			break
+		}
+
+		// The same seed repeats the order of the first phase, so skipping
+		// its addresses leaves the ones not probed yet.
+		addrs, _ := ipgenerator.NewIPRange(stats.Prefix, ipgenerator.WithSeed(e.seed))
+		for i := 0; i < opts.Probes; i++ {
+			addrs.Next()
+		}
+		e.subnetsMu.Lock()
+		subnet := e.subnet(stats.Prefix)
+		subnet.DeepScanned = true
+		e.subnetsMu.Unlock()
+		sources = append(sources, source{next: addrs.Next, subnet: subnet})
+
+		log.Infow("Deep-scanning subnet",
+			zap.Stringer("subnet", stats.Prefix),
+			zap.Int("answered", stats.Answered),
+			zap.Int("probed", stats.Probed),
+			zap.Duration("score", stats.Score))
+	}
+	if len(sources) == 0 {
+		log.Info("No subnet answered; nothing to deep-scan")
+		return
+	}
+	e.scan(sources)
+}
+
+// subnet returns the statistics of prefix. The caller holds subnetsMu.
+func (e *Engine) subnet(prefix netip.Prefix) *statute.SubnetStats {
+	for _, stats := range e.subnets {
+		if stats.Prefix == prefix {
+			return stats
+		}
+	}
+	return nil
+}
+
+// scan probes the addresses of sources with the worker pool and returns once
+// they are exhausted or the engine is shut down.
+func (e *Engine) scan(sources []source) {
+	concurrency := e.options.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	targets := make(chan target)
+	go e.schedule(sources, targets)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range targets {
+				e.pingAddr(t)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	progressTicker := time.NewTicker(progressInterval)
 	defer progressTicker.Stop()
 
+	var checkpointTick <-chan time.Time
+	if e.checkpoint != "" {
+		checkpointTicker := time.NewTicker(checkpointInterval)
+		defer checkpointTicker.Stop()
+		checkpointTick = checkpointTicker.C
+	}
+
 	for {
 		select {
-		case <-e.ctx.Done():
-			log.Info("Scanner Done")
+		case <-done:
 			return
 		case <-progressTicker.C:
-			log.Infow("Scanning progress", zap.Int("processed_ips", processedIPs), zap.Int("found_ips", e.ipQueue.Size()))
-		default:
-			var wg sync.WaitGroup
-			for _, generator := range e.generators {
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					ip, ok := generator.Next()
-					if ok {
-						e.pingAddr(ip)
-					}
-					processedIPs++
-				}()
+			stats := e.Stats()
+			log.Infow("Scanning progress",
+				zap.Int64("processed_ips", stats.Processed),
+				zap.Int64("failed_ips", stats.Failed),
+				zap.Int("found_ips", stats.Found))
+		case <-checkpointTick:
+			e.saveCheckpoint()
+		}
+	}
+}
+
+// schedule feeds targets with one address from each source in turn, so that
+// large prefixes do not starve small ones, and closes it once every source is
+// exhausted or the engine is shut down.
+func (e *Engine) schedule(sources []source, targets chan<- target) {
+	defer close(targets)
+
+	active := append([]source(nil), sources...)
+	for len(active) > 0 {
+		next := active[:0]
+		for _, src := range active {
+			if e.budgetExhausted() {
+				log.Infow("Probe budget exhausted", zap.Int64("max_probes", e.options.MaxProbes))
+				return
+			}
+			var (
+				addr  netip.Addr
+				index uint64
+				ok    bool
+			)
+			if src.cursor != nil {
+				addr, index, ok = src.cursor.take()
+			} else {
+				addr, ok = src.next()
+			}
+			if !ok {
+				continue
+			}
+			next = append(next, src)
+			if e.exclude.contains(addr) {
+				if src.cursor != nil {
+					src.cursor.done(index)
+				}
+				continue
+			}
+			e.scheduled.Add(1)
+
+			select {
+			case targets <- target{addr: addr, subnet: src.subnet, cursor: src.cursor, index: index}:
+			case <-e.ctx.Done():
+				return
 			}
-			wg.Wait()
 		}
+		active = next
 	}
 }
 
-func (e *Engine) pingAddr(addr netip.Addr) {
+func (e *Engine) pingAddr(t target) {
+	addr := t.addr
 	log.Debugw("Pinging IP", zap.String("ip", addr.String()))
 
-	info, err := e.ping.DoPing(e.ctx, addr)
+	info, err := e.probe(e.ctx, addr)
+	if err == nil && e.verify != nil && info.RTT < e.options.MaxDesirableRTT {
+		err = e.verify(e.ctx, info.AddrPort)
+		if errors.Is(err, ping.ErrNoDataPath) {
+			log.Infow("Endpoint answers handshakes but does not forward data", zap.String("ip", info.AddrPort.String()))
+			if e.cache != nil {
+				e.cache.MarkBad(info.AddrPort.String())
+			}
+		}
+	}
+	// A probe cut short by the shutdown is neither counted nor marked done,
+	// so that it is repeated on resume.
+	completed := e.ctx.Err() == nil
+	if completed {
+		e.processed.Add(1)
+		if t.cursor != nil {
+			t.cursor.done(t.index)
+		}
+		if t.subnet != nil {
+			e.subnetsMu.Lock()
+			t.subnet.Add(info, err == nil, e.options.ScoreWeights)
+			e.subnetsMu.Unlock()
+		}
+	}
 	if err != nil {
+		if completed {
+			e.failed.Add(1)
+		}
 		log.Debugw("Ping failed", zap.String("ip", addr.String()), zap.Error(err))
 		return
 	}
 
-	if e.options.Cache != nil {
-		e.options.Cache.SaveEndpoint(info.AddrPort.String(), info.RTT)
+	if e.cache != nil {
+		e.cache.SaveEndpoint(info.AddrPort.String(), info.RTT)
 	}
 
 	if info.RTT < e.options.MaxDesirableRTT {
 		e.ipQueue.Enqueue(info)
 		log.Infow("Found desirable IP", zap.String("ip", info.AddrPort.String()), zap.Duration("rtt", info.RTT))
+		if n := e.desirable.Add(1); e.options.Count > 0 && n == int64(e.options.Count) {
+			log.Infow("Found enough desirable IPs; stopping the scan", zap.Int("count", e.options.Count))
+			e.cancel()
+		}
 	} else {
 		log.Debugw("IP pinged but RTT is too high", zap.String("ip", info.AddrPort.String()), zap.Duration("rtt", info.RTT))
 	}
 }
 
+// budgetExhausted reports whether MaxProbes addresses were scheduled.
+func (e *Engine) budgetExhausted() bool {
+	return e.options.MaxProbes > 0 && e.scheduled.Load() >= e.options.MaxProbes
+}
+
+// Stats returns the current scan counters.
+func (e *Engine) Stats() Stats {
+	return Stats{
+		Processed: e.processed.Load(),
+		Failed:    e.failed.Load(),
+		Found:     e.ipQueue.Size(),
+	}
+}
+
+// SubnetStats returns the statistics of the subnets probed in the subnets
+// scan mode: those that answered first, best score first.
+func (e *Engine) SubnetStats() []statute.SubnetStats {
+	e.subnetsMu.Lock()
+	defer e.subnetsMu.Unlock()
+
+	stats := make([]statute.SubnetStats, 0, len(e.subnets))
+	for _, s := range e.subnets {
+		stats = append(stats, *s)
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if (a.Answered > 0) != (b.Answered > 0) {
+			return a.Answered > 0
+		}
+		return a.Score < b.Score
+	})
+	return stats
+}
+
 func (e *Engine) GetAvailableIPs(desc bool) []statute.IPInfo {
 	if e.ipQueue != nil {
 		return e.ipQueue.AvailableIPs(desc)
@@ -120,5 +528,4 @@ func (e *Engine) GetAvailableIPs(desc bool) []statute.IPInfo {
 
 func (e *Engine) Shutdown() {
 	e.cancel()
-	e.ctx.Done()
 }
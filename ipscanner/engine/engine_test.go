@@ -0,0 +1,433 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shahradelahi/cloudflare-warp/core/cache"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/ping"
+)
+
+func TestEngineRun(t *testing.T) {
+	opts := &statute.ScannerOptions{
+		UseIPv4: true,
+		CidrList: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/24"),
+			netip.MustParsePrefix("10.1.0.0/30"),
+		},
+		IPQueueSize:     4,
+		MaxDesirableRTT: time.Second,
+		Concurrency:     3,
+	}
+	e, err := NewScannerEngine(context.Background(), opts)
+	assert.NoError(t, err)
+
+	var (
+		inFlight, maxInFlight atomic.Int32
+		mu                    sync.Mutex
+		order                 []netip.Addr
+	)
+	e.probe = func(ctx context.Context, addr netip.Addr) (statute.IPInfo, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+
+		mu.Lock()
+		order = append(order, addr)
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+
+		if addr.As4()[3]%2 == 1 {
+			return statute.IPInfo{}, errors.New("no response")
+		}
+		return statute.IPInfo{AddrPort: netip.AddrPortFrom(addr, 2408), RTT: time.Millisecond}, nil
+	}
+
+	e.Run()
+
+	stats := e.Stats()
+	assert.Equal(t, int64(256+4), stats.Processed)
+	assert.Equal(t, int64(128+2), stats.Failed)
+	assert.Equal(t, 4, stats.Found)
+	assert.LessOrEqual(t, maxInFlight.Load(), int32(3))
+
+	small := 0
+	for _, addr := range order[:12] {
+		if netip.MustParsePrefix("10.1.0.0/30").Contains(addr) {
+			small++
+		}
+	}
+	assert.GreaterOrEqual(t, small, 3, "the small prefix is scanned alongside the large one")
+}
+
+func TestEngineShutdown(t *testing.T) {
+	opts := &statute.ScannerOptions{
+		UseIPv4:         true,
+		CidrList:        []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		IPQueueSize:     4,
+		MaxDesirableRTT: time.Second,
+	}
+	e, err := NewScannerEngine(context.Background(), opts)
+	assert.NoError(t, err)
+	e.probe = func(ctx context.Context, addr netip.Addr) (statute.IPInfo, error) {
+		<-ctx.Done()
+		return statute.IPInfo{}, ctx.Err()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		e.Run()
+		close(done)
+	}()
+	time.AfterFunc(50*time.Millisecond, e.Shutdown)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Shutdown")
+	}
+	assert.Zero(t, e.Stats().Processed, "probes cut short by the shutdown are not counted")
+}
+
+func TestEngineVerify(t *testing.T) {
+	c := &cache.Cache{}
+	opts := &statute.ScannerOptions{
+		UseIPv4:         true,
+		CidrList:        []netip.Prefix{netip.MustParsePrefix("10.0.0.0/28")},
+		IPQueueSize:     16,
+		MaxDesirableRTT: time.Second,
+		Cache:           c,
+	}
+	e, err := NewScannerEngine(context.Background(), opts)
+	assert.NoError(t, err)
+	e.probe = func(ctx context.Context, addr netip.Addr) (statute.IPInfo, error) {
+		return statute.IPInfo{AddrPort: netip.AddrPortFrom(addr, 2408), RTT: time.Millisecond}, nil
+	}
+	e.verify = func(ctx context.Context, addr netip.AddrPort) error {
+		if addr.Addr().As4()[3]%2 == 1 {
+			return ping.ErrNoDataPath
+		}
+		return nil
+	}
+
+	e.Run()
+
+	stats := e.Stats()
+	assert.Equal(t, int64(8), stats.Failed)
+	assert.Equal(t, 8, stats.Found)
+	assert.Len(t, c.Endpoints, 16, "endpoints that do not forward data are kept in the cache")
+	assert.Len(t, c.GetAllEndpoints(), 8, "but marked bad")
+	for _, info := range e.GetAvailableIPs(false) {
+		assert.Zero(t, info.AddrPort.Addr().As4()[3]%2)
+	}
+}
+
+func TestEngineSubnets(t *testing.T) {
+	opts := &statute.ScannerOptions{
+		UseIPv4:         true,
+		CidrList:        []netip.Prefix{netip.MustParsePrefix("10.0.0.0/22")},
+		IPQueueSize:     4,
+		MaxDesirableRTT: time.Second,
+		ScoreWeights:    statute.DefaultScoreWeights,
+		Mode:            statute.ScanSubnets,
+		Subnets:         statute.SubnetOptions{Top: 1},
+	}
+	e, err := NewScannerEngine(context.Background(), opts)
+	assert.NoError(t, err)
+
+	// 10.0.2.0/24 answers fast, 10.0.1.0/24 slowly and the others not at all.
+	var probed sync.Map
+	e.probe = func(ctx context.Context, addr netip.Addr) (statute.IPInfo, error) {
+		_, dup := probed.LoadOrStore(addr, true)
+		assert.False(t, dup, "%s probed twice", addr)
+
+		var rtt time.Duration
+		switch addr.As4()[2] {
+		case 1:
+			rtt = 200 * time.Millisecond
+		case 2:
+			rtt = 10 * time.Millisecond
+		default:
+			return statute.IPInfo{}, errors.New("no response")
+		}
+		return statute.IPInfo{AddrPort: netip.AddrPortFrom(addr, 2408), RTT: rtt, Score: rtt}, nil
+	}
+
+	e.Run()
+
+	probes := statute.DefaultSubnetOptions.Probes
+	assert.Equal(t, int64(4*probes+256-probes), e.Stats().Processed, "every subnet is sampled, then the best is scanned entirely")
+
+	stats := e.SubnetStats()
+	assert.Len(t, stats, 4)
+	assert.Equal(t, netip.MustParsePrefix("10.0.2.0/24"), stats[0].Prefix)
+	assert.True(t, stats[0].DeepScanned)
+	assert.Equal(t, 256, stats[0].Probed)
+	assert.Equal(t, 10*time.Millisecond, stats[0].Score)
+	assert.Equal(t, netip.MustParsePrefix("10.0.1.0/24"), stats[1].Prefix)
+	assert.False(t, stats[1].DeepScanned)
+	assert.Zero(t, stats[2].Answered)
+	assert.Equal(t, probes, stats[2].Probed)
+}
+
+func TestEngineStopCriteria(t *testing.T) {
+	newEngine := func(opts *statute.ScannerOptions) *Engine {
+		opts.UseIPv4 = true
+		opts.CidrList = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")}
+		opts.IPQueueSize = 4
+		opts.MaxDesirableRTT = time.Second
+		opts.Concurrency = 2
+		e, err := NewScannerEngine(context.Background(), opts)
+		assert.NoError(t, err)
+		e.probe = func(ctx context.Context, addr netip.Addr) (statute.IPInfo, error) {
+			if err := ctx.Err(); err != nil {
+				return statute.IPInfo{}, err
+			}
+			if addr.As4()[3]%4 != 0 {
+				return statute.IPInfo{}, errors.New("no response")
+			}
+			return statute.IPInfo{AddrPort: netip.AddrPortFrom(addr, 2408), RTT: time.Millisecond}, nil
+		}
+		return e
+	}
+
+	t.Run("count", func(t *testing.T) {
+		e := newEngine(&statute.ScannerOptions{Count: 3})
+		e.Run()
+		// A probe in flight when the third endpoint is found may add one.
+		assert.InDelta(t, 3, e.desirable.Load(), 1)
+		assert.Less(t, e.Stats().Processed, int64(1<<16))
+	})
+
+	t.Run("max probes", func(t *testing.T) {
+		e := newEngine(&statute.ScannerOptions{MaxProbes: 100})
+		e.Run()
+		assert.Equal(t, int64(100), e.Stats().Processed)
+	})
+
+	t.Run("max probes in subnets mode", func(t *testing.T) {
+		e := newEngine(&statute.ScannerOptions{
+			MaxProbes: 10,
+			Mode:      statute.ScanSubnets,
+		})
+		e.Run()
+		assert.Equal(t, int64(10), e.Stats().Processed)
+		for _, s := range e.SubnetStats() {
+			assert.False(t, s.DeepScanned)
+		}
+	})
+}
+
+func TestEngineExclude(t *testing.T) {
+	opts := &statute.ScannerOptions{
+		UseIPv4: true,
+		CidrList: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/24"),
+			netip.MustParsePrefix("10.1.0.0/24"),
+		},
+		Exclude: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.128/25"),
+			netip.MustParsePrefix("10.0.0.7/32"),
+			netip.MustParsePrefix("10.1.0.0/16"),
+		},
+		IPQueueSize:     4,
+		MaxDesirableRTT: time.Second,
+	}
+	e, err := NewScannerEngine(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}, e.cidrs)
+
+	var probed sync.Map
+	e.probe = func(ctx context.Context, addr netip.Addr) (statute.IPInfo, error) {
+		probed.Store(addr, true)
+		return statute.IPInfo{}, errors.New("no response")
+	}
+	e.Run()
+
+	assert.Equal(t, int64(128-1), e.Stats().Processed)
+	_, ok := probed.Load(netip.MustParseAddr("10.0.0.7"))
+	assert.False(t, ok)
+	_, ok = probed.Load(netip.MustParseAddr("10.0.0.200"))
+	assert.False(t, ok)
+
+	opts.Exclude = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	_, err = NewScannerEngine(context.Background(), opts)
+	assert.Error(t, err, "nothing is left to scan")
+}
+
+func TestEngineCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	newEngine := func(opts statute.ScannerOptions, probed map[netip.Addr]int, mu *sync.Mutex) *Engine {
+		opts.UseIPv4 = true
+		opts.CidrList = []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/24"),
+			netip.MustParsePrefix("10.1.0.0/26"),
+		}
+		opts.IPQueueSize = 1024
+		opts.MaxDesirableRTT = time.Second
+		opts.Concurrency = 4
+		opts.Checkpoint = path
+		e, err := NewScannerEngine(context.Background(), &opts)
+		assert.NoError(t, err)
+		e.probe = func(ctx context.Context, addr netip.Addr) (statute.IPInfo, error) {
+			if err := ctx.Err(); err != nil {
+				return statute.IPInfo{}, err
+			}
+			mu.Lock()
+			probed[addr]++
+			mu.Unlock()
+			if addr.As4()[3]%8 != 0 {
+				return statute.IPInfo{}, errors.New("no response")
+			}
+			return statute.IPInfo{AddrPort: netip.AddrPortFrom(addr, 2408), RTT: time.Millisecond}, nil
+		}
+		return e
+	}
+
+	var mu sync.Mutex
+	probed := make(map[netip.Addr]int)
+
+	first := newEngine(statute.ScannerOptions{Seed: 42, MaxProbes: 100}, probed, &mu)
+	first.Run()
+	assert.FileExists(t, path)
+	cp, err := loadCheckpoint(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), cp.Seed)
+	assert.Equal(t, int64(100), cp.Processed)
+	total := uint64(0)
+	for _, p := range cp.Prefixes {
+		total += p.Position
+	}
+	assert.Equal(t, uint64(100), total)
+
+	// The seed comes from the checkpoint and the scan goes on where the
+	// first one stopped.
+	second := newEngine(statute.ScannerOptions{}, probed, &mu)
+	assert.Equal(t, uint64(42), second.seed)
+	second.Run()
+	assert.NoFileExists(t, path, "a finished scan removes its checkpoint")
+
+	assert.Len(t, probed, 256+64)
+	for addr, n := range probed {
+		assert.Equal(t, 1, n, "%s probed %d times", addr, n)
+	}
+	assert.Equal(t, int64(256+64), second.Stats().Processed)
+	assert.Len(t, second.GetAvailableIPs(false), (256+64)/8)
+}
+
+func TestEngineCheckpointShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	opts := func() *statute.ScannerOptions {
+		return &statute.ScannerOptions{
+			UseIPv4:         true,
+			CidrList:        []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")},
+			IPQueueSize:     4,
+			MaxDesirableRTT: time.Second,
+			Concurrency:     4,
+			Checkpoint:      path,
+		}
+	}
+
+	var probed sync.Map
+	e, err := NewScannerEngine(context.Background(), opts())
+	assert.NoError(t, err)
+	var n atomic.Int32
+	e.probe = func(ctx context.Context, addr netip.Addr) (statute.IPInfo, error) {
+		if n.Add(1) > 50 {
+			// Interrupted probes must be repeated on resume.
+			<-ctx.Done()
+			return statute.IPInfo{}, ctx.Err()
+		}
+		probed.Store(addr, true)
+		return statute.IPInfo{}, errors.New("no response")
+	}
+	time.AfterFunc(50*time.Millisecond, e.Shutdown)
+	e.Run()
+	assert.FileExists(t, path)
+
+	cp, err := loadCheckpoint(path)
+	assert.NoError(t, err)
+	// The four interrupted probes are retried, and the address the
+	// scheduler held when the scan stopped, if any.
+	assert.GreaterOrEqual(t, len(cp.Prefixes[0].Retry), 4)
+	assert.LessOrEqual(t, len(cp.Prefixes[0].Retry), 5)
+	assert.Equal(t, int64(50), cp.Processed, "interrupted probes are not counted")
+	assert.Equal(t, int64(50), cp.Failed)
+
+	e, err = NewScannerEngine(context.Background(), opts())
+	assert.NoError(t, err)
+	e.probe = func(ctx context.Context, addr netip.Addr) (statute.IPInfo, error) {
+		_, dup := probed.LoadOrStore(addr, true)
+		assert.False(t, dup, "%s probed twice", addr)
+		return statute.IPInfo{}, errors.New("no response")
+	}
+	e.Run()
+
+	count := 0
+	probed.Range(func(any, any) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, 256, count)
+}
+
+func TestEngineCheckpointSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	opts := func() *statute.ScannerOptions {
+		return &statute.ScannerOptions{
+			UseIPv4:         true,
+			CidrList:        []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")},
+			IPQueueSize:     4,
+			MaxDesirableRTT: time.Second,
+			Concurrency:     4,
+			Checkpoint:      path,
+			Seed:            42,
+			MaxProbes:       100,
+		}
+	}
+
+	e, err := NewScannerEngine(context.Background(), opts())
+	assert.NoError(t, err)
+	e.probe = func(ctx context.Context, addr netip.Addr) (statute.IPInfo, error) {
+		return statute.IPInfo{}, errors.New("no response")
+	}
+	e.Run()
+	assert.FileExists(t, path)
+
+	e, err = NewScannerEngine(context.Background(), opts())
+	assert.NoError(t, err)
+	assert.NotNil(t, e.resume, "the same settings resume the scan")
+
+	changes := map[string]func(*statute.ScannerOptions){
+		"probe":         func(o *statute.ScannerOptions) { o.Probe = ping.ProbeTCP },
+		"ports":         func(o *statute.ScannerOptions) { o.Ports = []uint16{2408} },
+		"port strategy": func(o *statute.ScannerOptions) { o.PortStrategy = statute.PortsRandom },
+		"exclude":       func(o *statute.ScannerOptions) { o.Exclude = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/28")} },
+		"rtt":           func(o *statute.ScannerOptions) { o.MaxDesirableRTT = 500 * time.Millisecond },
+		"samples":       func(o *statute.ScannerOptions) { o.Samples = 3 },
+		"obfuscation":   func(o *statute.ScannerOptions) { o.Obfuscation = statute.DefaultObfuscationProfile() },
+		"reserved":      func(o *statute.ScannerOptions) { o.WarpReserved = []byte{1, 2, 3} },
+		"identity":      func(o *statute.ScannerOptions) { o.WarpPrivateKey = "another key" },
+	}
+	for name, change := range changes {
+		o := opts()
+		change(o)
+		e, err := NewScannerEngine(context.Background(), o)
+		assert.NoError(t, err)
+		assert.Nil(t, e.resume, "a checkpoint saved with another %s is not resumed", name)
+	}
+}
@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"net/netip"
+)
+
+// exclusions is a set of prefixes whose addresses are not probed. Single
+// addresses, typically a list of known bad IPs, are looked up in a map.
+type exclusions struct {
+	addrs    map[netip.Addr]struct{}
+	prefixes []netip.Prefix
+}
+
+func newExclusions(prefixes []netip.Prefix) *exclusions {
+	x := &exclusions{addrs: make(map[netip.Addr]struct{})}
+	for _, prefix := range prefixes {
+		prefix = prefix.Masked()
+		if prefix.IsSingleIP() {
+			x.addrs[prefix.Addr()] = struct{}{}
+		} else if prefix.IsValid() {
+			x.prefixes = append(x.prefixes, prefix)
+		}
+	}
+	return x
+}
+
+// contains reports whether addr is excluded.
+func (x *exclusions) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if _, ok := x.addrs[addr]; ok {
+		return true
+	}
+	for _, prefix := range x.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether every address of cidr is excluded.
+func (x *exclusions) covers(cidr netip.Prefix) bool {
+	if cidr.IsSingleIP() {
+		return x.contains(cidr.Addr())
+	}
+	for _, prefix := range x.prefixes {
+		if prefix.Bits() <= cidr.Bits() && prefix.Contains(cidr.Addr()) {
+			return true
+		}
+	}
+	return false
+}
@@ -56,9 +56,9 @@ func (q *IPQueue) Enqueue(info statute.IPInfo) bool {
 		}
 	}()
 
-	log.Debug("Enqueue: Sorting queue by RTT")
+	log.Debug("Enqueue: Sorting queue by score")
 	sort.Slice(q.queue, func(i, j int) bool {
-		return q.queue[i].RTT < q.queue[j].RTT
+		return q.queue[i].Score < q.queue[j].Score
 	})
 
 	if len(q.queue) == 0 {
@@ -68,17 +68,18 @@ func (q *IPQueue) Enqueue(info statute.IPInfo) bool {
 	}
 
 	if info.RTT <= q.rttThreshold {
-		log.Debug("Enqueue: the new item's RTT is less than at least one of the members.")
-		if len(q.queue) >= q.maxQueueSize && info.RTT < q.queue[len(q.queue)-1].RTT {
-			log.Debug("Enqueue: the queue is full, remove the item with the highest RTT.")
-			q.queue = q.queue[:len(q.queue)-1]
-		} else if len(q.queue) < q.maxQueueSize {
-			log.Debug("Enqueue: Insert the new item in a sorted position.")
-			index := sort.Search(len(q.queue), func(i int) bool { return q.queue[i].RTT > info.RTT })
-			q.queue = append(q.queue[:index], append([]statute.IPInfo{info}, q.queue[index:]...)...)
-		} else {
+		log.Debug("Enqueue: the new item's RTT is within the threshold.")
+		if len(q.queue) >= q.maxQueueSize && info.Score >= q.queue[len(q.queue)-1].Score {
 			log.Debug("Enqueue: The Queue is full but we keep the new item in the reserved queue.")
 			q.reserved.Enqueue(info)
+		} else {
+			if len(q.queue) >= q.maxQueueSize {
+				log.Debug("Enqueue: the queue is full, remove the item with the highest score.")
+				q.queue = q.queue[:len(q.queue)-1]
+			}
+			log.Debug("Enqueue: Insert the new item in a sorted position.")
+			index := sort.Search(len(q.queue), func(i int) bool { return q.queue[i].Score > info.Score })
+			q.queue = append(q.queue[:index], append([]statute.IPInfo{info}, q.queue[index:]...)...)
 		}
 	}
 
@@ -183,12 +184,12 @@ func (q *IPQueue) AvailableIPs(desc bool) []statute.IPInfo {
 	sortedQueue := make([]statute.IPInfo, len(q.queue))
 	copy(sortedQueue, q.queue)
 
-	// Sort by RTT ascending/descending
+	// Sort by score ascending/descending
 	sort.Slice(sortedQueue, func(i, j int) bool {
 		if desc {
-			return sortedQueue[i].RTT > sortedQueue[j].RTT
+			return sortedQueue[i].Score > sortedQueue[j].Score
 		}
-		return sortedQueue[i].RTT < sortedQueue[j].RTT
+		return sortedQueue[i].Score < sortedQueue[j].Score
 	})
 
 	return sortedQueue
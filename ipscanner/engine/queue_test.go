@@ -0,0 +1,35 @@
+package engine
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+func TestIPQueueOverfill(t *testing.T) {
+	q := NewIPQueue(&statute.ScannerOptions{IPQueueSize: 2, MaxDesirableRTT: time.Second})
+
+	info := func(port uint16, score time.Duration) statute.IPInfo {
+		return statute.IPInfo{
+			AddrPort: netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), port),
+			RTT:      score,
+			Score:    score,
+		}
+	}
+	q.Enqueue(info(1, 30*time.Millisecond))
+	q.Enqueue(info(2, 20*time.Millisecond))
+	// The queue is full: a better item replaces the worst one and a worse one
+	// is left out.
+	q.Enqueue(info(3, 10*time.Millisecond))
+	q.Enqueue(info(4, 40*time.Millisecond))
+
+	var ports []uint16
+	for _, ip := range q.AvailableIPs(false) {
+		ports = append(ports, ip.AddrPort.Port())
+	}
+	assert.Equal(t, []uint16{3, 2}, ports)
+}
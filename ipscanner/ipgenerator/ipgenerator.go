@@ -1,7 +1,8 @@
 package ipgenerator
 
 import (
-	"math/big"
+	"fmt"
+	"math/rand/v2"
 	"net/netip"
 )
 
@@ -11,17 +12,62 @@ type IpGenerator struct {
 	currentRange int
 }
 
+// Option configures the iteration order of a generator or range.
+type Option func(*config)
+
+type config struct {
+	seed       uint64
+	seeded     bool
+	sample     uint64
+	sequential bool
+}
+
+// WithSeed sets the key of the pseudo-random order, so that a scan can be
+// reproduced. A random seed is used otherwise.
+func WithSeed(seed uint64) Option {
+	return func(c *config) {
+		c.seed = seed
+		c.seeded = true
+	}
+}
+
+// WithSample limits each prefix to n addresses. Unlimited when 0.
+func WithSample(n uint64) Option {
+	return func(c *config) {
+		c.sample = n
+	}
+}
+
+// WithSequential visits the addresses in ascending order.
+func WithSequential() Option {
+	return func(c *config) {
+		c.sequential = true
+	}
+}
+
+func newConfig(opts []Option) config {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if !c.seeded {
+		c.seed = rand.Uint64()
+	}
+	return c
+}
+
 // NewIpGenerator creates a new IpGenerator.
-func NewIpGenerator(cidrs []netip.Prefix) (*IpGenerator, error) {
+func NewIpGenerator(cidrs []netip.Prefix, opts ...Option) (*IpGenerator, error) {
+	c := newConfig(opts)
+
 	var ipRanges []IPRange
 	for _, cidr := range cidrs {
-		ipRange, err := NewIPRange(cidr)
-		if err != nil {
+		if !cidr.IsValid() {
 			// We can choose to skip invalid CIDRs or return an error.
 			// For now, let's skip.
 			continue
 		}
-		ipRanges = append(ipRanges, ipRange)
+		ipRanges = append(ipRanges, newIPRange(cidr, c))
 	}
 	return &IpGenerator{
 		ipRanges:     ipRanges,
@@ -59,111 +105,89 @@ func (g *IpGenerator) GetAll() []netip.Addr {
 	return allIPs
 }
 
-// IPRange represents a range of IP addresses from a CIDR.
+// IPRange iterates over the addresses of a CIDR prefix. Unless sequential,
+// the addresses are visited in a pseudo-random order without repeats: the
+// n-th address is the prefix base plus a keyed permutation of n, so the
+// iteration state is a counter whatever the size of the prefix.
 type IPRange struct {
-	start   *big.Int
-	current *big.Int
-	end     *big.Int
-	isIPv4  bool
+	base     uint128
+	hostBits int
+	isIPv4   bool
+	perm     *permutation
+
+	next    uint128
+	done    bool
+	sample  uint64
+	emitted uint64
 }
 
 // NewIPRange creates a new IPRange from a CIDR prefix.
-func NewIPRange(cidr netip.Prefix) (IPRange, error) {
-	startIP := cidr.Addr()
-	startInt := big.NewInt(0).SetBytes(startIP.AsSlice())
+func NewIPRange(cidr netip.Prefix, opts ...Option) (IPRange, error) {
+	if !cidr.IsValid() {
+		return IPRange{}, fmt.Errorf("invalid prefix %s", cidr)
+	}
+	return newIPRange(cidr, newConfig(opts)), nil
+}
 
-	// Calculate the last IP address in the CIDR range.
-	prefixLen := cidr.Bits()
+func newIPRange(cidr netip.Prefix, c config) IPRange {
+	cidr = cidr.Masked()
 	addrLen := 128
-	if startIP.Is4() {
+	if cidr.Addr().Is4() {
 		addrLen = 32
 	}
+	hostBits := addrLen - cidr.Bits()
 
-	// Create a mask to get the last IP.
-	mask := new(big.Int).Lsh(big.NewInt(1), uint(addrLen-prefixLen))
-	mask.Sub(mask, big.NewInt(1))
-	mask.Not(mask)
-
-	networkInt := new(big.Int).And(startInt, mask)
-
-	broadcastMask := new(big.Int).Lsh(big.NewInt(1), uint(addrLen-prefixLen))
-	broadcastMask.Sub(broadcastMask, big.NewInt(1))
-
-	endInt := new(big.Int).Or(networkInt, broadcastMask)
-
-	return IPRange{
-		start:   startInt,
-		current: new(big.Int).Set(startInt),
-		end:     endInt,
-		isIPv4:  startIP.Is4(),
-	}, nil
+	r := IPRange{
+		base:     uint128FromAddr(cidr.Addr()),
+		hostBits: hostBits,
+		isIPv4:   cidr.Addr().Is4(),
+		sample:   c.sample,
+	}
+	if !c.sequential {
+		// Every prefix gets its own order from the same seed.
+		prefixKey := r.base.hi ^ mix64(r.base.lo^uint64(hostBits))
+		r.perm = newPermutation(hostBits, c.seed^prefixKey)
+	}
+	return r
 }
 
 // Next returns the next IP address in the range.
 func (r *IPRange) Next() (netip.Addr, bool) {
-	if r.current.Cmp(r.end) > 0 {
+	if r.done || (r.sample > 0 && r.emitted >= r.sample) {
 		return netip.Addr{}, false
 	}
 
-	ipBytes := r.current.Bytes()
-	var ip netip.Addr
-	var ok bool
-
-	// Pad with leading zeros if necessary
-	addrLen := 16 // IPv6
-	if r.isIPv4 {
-		addrLen = 4
-	}
-	if len(ipBytes) < addrLen {
-		paddedBytes := make([]byte, addrLen)
-		copy(paddedBytes[addrLen-len(ipBytes):], ipBytes)
-		ip, ok = netip.AddrFromSlice(paddedBytes)
+	offset := r.next
+	if r.next.cmp(mask128(r.hostBits)) == 0 {
+		r.done = true
 	} else {
-		ip, ok = netip.AddrFromSlice(ipBytes)
+		r.next = r.next.add64(1)
 	}
-
-	if !ok {
-		// This should ideally not happen if logic is correct.
-		return netip.Addr{}, false
+	if r.perm != nil {
+		offset = r.perm.apply(offset)
 	}
+	r.emitted++
 
-	r.current.Add(r.current, big.NewInt(1))
+	return r.base.or(offset).addr(r.isIPv4), true
+}
 
-	if r.isIPv4 {
-		return ip.Unmap(), true
-	}
-	return ip, true
+// Seek moves the range to its n-th address, so that the next call to Next
+// returns what the n+1-th call would have on a fresh range with the same
+// options. It is how an interrupted scan resumes.
+func (r *IPRange) Seek(n uint64) {
+	r.next = uint128{lo: n}
+	r.done = r.next.cmp(mask128(r.hostBits)) > 0
+	r.emitted = n
 }
 
-// GetAll returns all IP addresses in the range.
+// GetAll returns all IP addresses in the range, in ascending order.
 func (r *IPRange) GetAll() []netip.Addr {
 	var ips []netip.Addr
-	current := new(big.Int).Set(r.start)
-	for current.Cmp(r.end) <= 0 {
-		ipBytes := current.Bytes()
-		var ip netip.Addr
-		var ok bool
-
-		addrLen := 16 // IPv6
-		if r.isIPv4 {
-			addrLen = 4
-		}
-		if len(ipBytes) < addrLen {
-			paddedBytes := make([]byte, addrLen)
-			copy(paddedBytes[addrLen-len(ipBytes):], ipBytes)
-			ip, ok = netip.AddrFromSlice(paddedBytes)
-		} else {
-			ip, ok = netip.AddrFromSlice(ipBytes)
-		}
-
-		if ok {
-			if r.isIPv4 {
-				ips = append(ips, ip.Unmap())
-			} else {
-				ips = append(ips, ip)
-			}
+	last := mask128(r.hostBits)
+	for offset := (uint128{}); ; offset = offset.add64(1) {
+		ips = append(ips, r.base.or(offset).addr(r.isIPv4))
+		if offset.cmp(last) == 0 {
+			return ips
 		}
-		current.Add(current, big.NewInt(1))
 	}
-	return ips
 }
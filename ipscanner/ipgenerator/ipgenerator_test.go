@@ -104,3 +104,193 @@ func TestIpGenerator_IPv6(t *testing.T) {
 		t.Errorf("expected 4 IPs, got %d", count)
 	}
 }
+
+func collect(r *IPRange) []netip.Addr {
+	var ips []netip.Addr
+	for {
+		ip, ok := r.Next()
+		if !ok {
+			return ips
+		}
+		ips = append(ips, ip)
+	}
+}
+
+func TestIPRange_Permutation(t *testing.T) {
+	for _, s := range []string{"10.0.0.0/24", "10.0.0.0/27", "10.0.0.1/32", "2001:db8::/121", "2001:db8::/127"} {
+		cidr := netip.MustParsePrefix(s)
+		r, err := NewIPRange(cidr, WithSeed(42))
+		if err != nil {
+			t.Fatalf("failed to create range: %v", err)
+		}
+
+		ips := collect(&r)
+		want := 1 << (cidr.Addr().BitLen() - cidr.Bits())
+		if len(ips) != want {
+			t.Errorf("%s: expected %d IPs, got %d", s, want, len(ips))
+		}
+
+		seen := make(map[netip.Addr]bool)
+		for _, ip := range ips {
+			if !cidr.Contains(ip) {
+				t.Errorf("%s: generated IP %s not in CIDR", s, ip)
+			}
+			if seen[ip] {
+				t.Errorf("%s: duplicate IP generated: %s", s, ip)
+			}
+			seen[ip] = true
+		}
+	}
+}
+
+func TestIPRange_Seed(t *testing.T) {
+	cidr := netip.MustParsePrefix("10.0.0.0/24")
+	order := func(opts ...Option) []netip.Addr {
+		r, _ := NewIPRange(cidr, opts...)
+		return collect(&r)
+	}
+
+	a, b, c := order(WithSeed(1)), order(WithSeed(1)), order(WithSeed(2))
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("the same seed produced different orders at %d: %s != %s", i, a[i], b[i])
+		}
+	}
+
+	same := 0
+	for i := range a {
+		if a[i] == c[i] {
+			same++
+		}
+	}
+	if same > 16 {
+		t.Errorf("different seeds produced similar orders: %d of %d positions match", same, len(a))
+	}
+
+	sequential := order(WithSequential())
+	if sequential[0] != netip.MustParseAddr("10.0.0.0") || sequential[255] != netip.MustParseAddr("10.0.0.255") {
+		t.Errorf("sequential order starts at %s and ends at %s", sequential[0], sequential[255])
+	}
+}
+
+func TestIPRange_Seek(t *testing.T) {
+	cidr := netip.MustParsePrefix("10.0.0.0/28")
+	r, _ := NewIPRange(cidr, WithSeed(7))
+	all := collect(&r)
+
+	for _, n := range []uint64{0, 5, 15} {
+		r, _ := NewIPRange(cidr, WithSeed(7))
+		r.Seek(n)
+		rest := collect(&r)
+		if len(rest) != len(all)-int(n) {
+			t.Fatalf("after Seek(%d): expected %d IPs, got %d", n, len(all)-int(n), len(rest))
+		}
+		for i, ip := range rest {
+			if ip != all[int(n)+i] {
+				t.Fatalf("after Seek(%d): IP %d is %s, expected %s", n, i, ip, all[int(n)+i])
+			}
+		}
+	}
+
+	r, _ = NewIPRange(cidr, WithSeed(7))
+	r.Seek(16)
+	if ip, ok := r.Next(); ok {
+		t.Errorf("expected the range to be exhausted, got %s", ip)
+	}
+}
+
+func TestIPRange_Sample(t *testing.T) {
+	cidr := netip.MustParsePrefix("2a06:98c0::/29")
+	r, _ := NewIPRange(cidr, WithSample(1000))
+
+	ips := collect(&r)
+	if len(ips) != 1000 {
+		t.Fatalf("expected 1000 IPs, got %d", len(ips))
+	}
+
+	seen := make(map[netip.Addr]bool)
+	low := 0
+	for _, ip := range ips {
+		if !cidr.Contains(ip) || seen[ip] {
+			t.Fatalf("unexpected IP %s", ip)
+		}
+		seen[ip] = true
+		if netip.MustParsePrefix("2a06:98c0::/48").Contains(ip) {
+			low++
+		}
+	}
+	if low > 10 {
+		t.Errorf("%d of the sampled IPs are in the first /48", low)
+	}
+}
+
+func TestUint128(t *testing.T) {
+	u := mask128(70)
+	if u.hi != 1<<6-1 || u.lo != ^uint64(0) {
+		t.Errorf("mask128(70) = %x %x", u.hi, u.lo)
+	}
+	if got := u.rsh(64); got.hi != 0 || got.lo != 1<<6-1 {
+		t.Errorf("rsh(64) = %x %x", got.hi, got.lo)
+	}
+	if got := (uint128{lo: 1}).lsh(100); got.hi != 1<<36 || got.lo != 0 {
+		t.Errorf("lsh(100) = %x %x", got.hi, got.lo)
+	}
+	if got := (uint128{lo: ^uint64(0)}).add64(1); got.hi != 1 || got.lo != 0 {
+		t.Errorf("add64 carry = %x %x", got.hi, got.lo)
+	}
+
+	addr := netip.MustParseAddr("2001:db8::1")
+	if got := uint128FromAddr(addr).addr(false); got != addr {
+		t.Errorf("round trip of %s gave %s", addr, got)
+	}
+}
+
+func TestSubnetRange(t *testing.T) {
+	cidr := netip.MustParsePrefix("10.0.0.0/16")
+	s, err := NewSubnetRange(cidr, 24, WithSeed(7))
+	if err != nil {
+		t.Fatalf("failed to create subnet range: %v", err)
+	}
+
+	seen := make(map[netip.Prefix]bool)
+	for {
+		subnet, ok := s.Next()
+		if !ok {
+			break
+		}
+		if subnet.Bits() != 24 || !cidr.Contains(subnet.Addr()) || subnet != subnet.Masked() {
+			t.Errorf("unexpected subnet %s", subnet)
+		}
+		if seen[subnet] {
+			t.Errorf("duplicate subnet %s", subnet)
+		}
+		seen[subnet] = true
+	}
+	if len(seen) != 256 {
+		t.Errorf("expected 256 subnets, got %d", len(seen))
+	}
+
+	v6, err := NewSubnetRange(netip.MustParsePrefix("2606:4700:d0::/48"), 64, WithSample(10))
+	if err != nil {
+		t.Fatalf("failed to create subnet range: %v", err)
+	}
+	count := 0
+	for subnet, ok := v6.Next(); ok; subnet, ok = v6.Next() {
+		if subnet.Bits() != 64 || !netip.MustParsePrefix("2606:4700:d0::/48").Contains(subnet.Addr()) {
+			t.Errorf("unexpected subnet %s", subnet)
+		}
+		count++
+	}
+	if count != 10 {
+		t.Errorf("expected 10 subnets, got %d", count)
+	}
+
+	whole, _ := NewSubnetRange(netip.MustParsePrefix("10.1.2.0/26"), 24)
+	subnet, ok := whole.Next()
+	if !ok || subnet != netip.MustParsePrefix("10.1.2.0/26") {
+		t.Errorf("a prefix longer than the subnet length should yield itself, got %s", subnet)
+	}
+	if _, ok := whole.Next(); ok {
+		t.Error("expected a single subnet")
+	}
+}
@@ -0,0 +1,59 @@
+package ipgenerator
+
+// feistelRounds is enough rounds for the order to look random; the
+// permutation is not meant to be cryptographically strong.
+const feistelRounds = 4
+
+// permutation is a keyed bijection on the integers below 2^bits, built from a
+// balanced Feistel network over 2*half bits. Values that fall outside the
+// domain are fed through the network again (cycle walking), which takes at
+// most a couple of extra passes because the network is at most twice as
+// large as the domain.
+type permutation struct {
+	bits int
+	half uint
+	keys [feistelRounds]uint64
+}
+
+func newPermutation(bits int, seed uint64) *permutation {
+	p := &permutation{bits: bits, half: uint(bits+1) / 2}
+	state := seed
+	for i := range p.keys {
+		state += 0x9e3779b97f4a7c15
+		p.keys[i] = mix64(state)
+	}
+	return p
+}
+
+// apply returns the image of x, which must be below 2^bits.
+func (p *permutation) apply(x uint128) uint128 {
+	if p.bits == 0 {
+		return x
+	}
+	limit := mask128(p.bits)
+	for {
+		x = p.round(x)
+		if x.cmp(limit) <= 0 {
+			return x
+		}
+	}
+}
+
+func (p *permutation) round(x uint128) uint128 {
+	halfMask := mask128(int(p.half)).lo
+	left, right := x.rsh(p.half).lo, x.lo&halfMask
+	for _, key := range p.keys {
+		left, right = right, left^(mix64(right^key)&halfMask)
+	}
+	return uint128{lo: left}.lsh(p.half).or(uint128{lo: right})
+}
+
+// mix64 is the splitmix64 finalizer.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
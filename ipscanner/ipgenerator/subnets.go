@@ -0,0 +1,55 @@
+package ipgenerator
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// SubnetRange iterates over the sub-prefixes of a given length within a
+// prefix, in the same pseudo-random order and with the same options as
+// IPRange.
+type SubnetRange struct {
+	indices IPRange
+	base    uint128
+	shift   uint
+	bits    int
+	isIPv4  bool
+}
+
+// NewSubnetRange splits cidr into sub-prefixes of length bits. A prefix that
+// is already at least that long yields only itself.
+func NewSubnetRange(cidr netip.Prefix, bits int, opts ...Option) (*SubnetRange, error) {
+	if !cidr.IsValid() {
+		return nil, fmt.Errorf("invalid prefix %s", cidr)
+	}
+	cidr = cidr.Masked()
+	addrLen := cidr.Addr().BitLen()
+	if bits > addrLen {
+		return nil, fmt.Errorf("invalid subnet length /%d for %s", bits, cidr)
+	}
+	if bits < cidr.Bits() {
+		bits = cidr.Bits()
+	}
+
+	c := newConfig(opts)
+	// The sub-prefix indices are iterated as the host part of a prefix
+	// with as many host bits as there are subnet bits.
+	indexPrefix := netip.PrefixFrom(netip.IPv6Unspecified(), 128-(bits-cidr.Bits()))
+	return &SubnetRange{
+		indices: newIPRange(indexPrefix, c),
+		base:    uint128FromAddr(cidr.Addr()),
+		shift:   uint(addrLen - bits),
+		bits:    bits,
+		isIPv4:  cidr.Addr().Is4(),
+	}, nil
+}
+
+// Next returns the next sub-prefix.
+func (s *SubnetRange) Next() (netip.Prefix, bool) {
+	index, ok := s.indices.Next()
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	offset := uint128FromAddr(index).lsh(s.shift)
+	return netip.PrefixFrom(s.base.or(offset).addr(s.isIPv4), s.bits), true
+}
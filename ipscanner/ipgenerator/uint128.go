@@ -0,0 +1,96 @@
+package ipgenerator
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+)
+
+// uint128 is an unsigned 128-bit integer, wide enough for any IPv6 address.
+type uint128 struct {
+	hi, lo uint64
+}
+
+func uint128FromAddr(addr netip.Addr) uint128 {
+	b := addr.As16()
+	return uint128{
+		hi: binary.BigEndian.Uint64(b[:8]),
+		lo: binary.BigEndian.Uint64(b[8:]),
+	}
+}
+
+// addr converts u back to an address, unmapping it when is4 is set.
+func (u uint128) addr(is4 bool) netip.Addr {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], u.hi)
+	binary.BigEndian.PutUint64(b[8:], u.lo)
+	addr := netip.AddrFrom16(b)
+	if is4 {
+		return addr.Unmap()
+	}
+	return addr
+}
+
+// mask128 returns a value with the low n bits set.
+func mask128(n int) uint128 {
+	switch {
+	case n <= 0:
+		return uint128{}
+	case n < 64:
+		return uint128{lo: 1<<n - 1}
+	case n < 128:
+		return uint128{hi: 1<<(n-64) - 1, lo: ^uint64(0)}
+	default:
+		return uint128{hi: ^uint64(0), lo: ^uint64(0)}
+	}
+}
+
+func (u uint128) or(v uint128) uint128 {
+	return uint128{hi: u.hi | v.hi, lo: u.lo | v.lo}
+}
+
+func (u uint128) add64(n uint64) uint128 {
+	lo, carry := bits.Add64(u.lo, n, 0)
+	return uint128{hi: u.hi + carry, lo: lo}
+}
+
+func (u uint128) lsh(n uint) uint128 {
+	switch {
+	case n == 0:
+		return u
+	case n >= 128:
+		return uint128{}
+	case n >= 64:
+		return uint128{hi: u.lo << (n - 64)}
+	default:
+		return uint128{hi: u.hi<<n | u.lo>>(64-n), lo: u.lo << n}
+	}
+}
+
+func (u uint128) rsh(n uint) uint128 {
+	switch {
+	case n == 0:
+		return u
+	case n >= 128:
+		return uint128{}
+	case n >= 64:
+		return uint128{lo: u.hi >> (n - 64)}
+	default:
+		return uint128{hi: u.hi >> n, lo: u.lo>>n | u.hi<<(64-n)}
+	}
+}
+
+func (u uint128) cmp(v uint128) int {
+	switch {
+	case u.hi < v.hi:
+		return -1
+	case u.hi > v.hi:
+		return 1
+	case u.lo < v.lo:
+		return -1
+	case u.lo > v.lo:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,237 @@
+package statute
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Built-in obfuscation profile names.
+const (
+	ObfuscationOff            = "off"
+	ObfuscationScannerDefault = "scanner-default"
+)
+
+// Range is an inclusive range of integers.
+type Range struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+func (r Range) valid() bool {
+	return r.Min >= 0 && r.Max >= r.Min
+}
+
+// ObfuscationProfile describes the junk packets sent before a WireGuard
+// handshake initiation to disguise it from DPI.
+type ObfuscationProfile struct {
+	Name string `json:"name"`
+	// JunkCount is the number of junk packets sent before each handshake.
+	JunkCount Range `json:"junk_count"`
+	// JunkSize is the number of random bytes appended to the header of each
+	// junk packet.
+	JunkSize Range `json:"junk_size"`
+	// JunkDelay is the pause between junk packets, in milliseconds.
+	JunkDelay Range `json:"junk_delay_ms"`
+	// Headers are the templates junk packets start with; one is picked at
+	// random per handshake.
+	Headers []Template `json:"headers"`
+}
+
+// Enabled reports whether the profile sends any junk packets.
+func (p *ObfuscationProfile) Enabled() bool {
+	return p != nil && p.JunkCount.Max > 0
+}
+
+// GetName returns the profile name, or ObfuscationOff for a nil profile.
+func (p *ObfuscationProfile) GetName() string {
+	if p == nil {
+		return ObfuscationOff
+	}
+	return p.Name
+}
+
+// Validate checks that the ranges are consistent.
+func (p *ObfuscationProfile) Validate() error {
+	if !p.JunkCount.valid() || !p.JunkSize.valid() || !p.JunkDelay.valid() {
+		return fmt.Errorf("obfuscation profile %q: ranges must satisfy 0 <= min <= max", p.Name)
+	}
+	if p.Enabled() && len(p.Headers) == 0 {
+		return fmt.Errorf("obfuscation profile %q: at least one header template is required", p.Name)
+	}
+	return nil
+}
+
+// scannerHeaders reproduce the QUIC-like long headers the scanner has always
+// used: one of eight first bytes, a fixed version, an 8-byte random
+// connection ID and a fixed tail.
+func scannerHeaders() []Template {
+	var headers []Template
+	for _, b := range []byte{0xDC, 0xDE, 0xD3, 0xD9, 0xD0, 0xEC, 0xEE, 0xE3} {
+		headers = append(headers, Template{
+			{Static: []byte{b, 0x00, 0x00, 0x00, 0x01, 0x08}},
+			{Random: 8},
+			{Static: []byte{0x00, 0x00, 0x44, 0xD0}},
+		})
+	}
+	return headers
+}
+
+var builtinObfuscationProfiles = map[string]ObfuscationProfile{
+	ObfuscationOff: {Name: ObfuscationOff},
+	ObfuscationScannerDefault: {
+		Name:      ObfuscationScannerDefault,
+		JunkCount: Range{Min: 20, Max: 50},
+		JunkSize:  Range{Min: 10, Max: 120},
+		JunkDelay: Range{Min: 80, Max: 150},
+		Headers:   scannerHeaders(),
+	},
+}
+
+// ObfuscationProfileNames returns the names of the built-in profiles.
+func ObfuscationProfileNames() []string {
+	names := make([]string, 0, len(builtinObfuscationProfiles))
+	for name := range builtinObfuscationProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultObfuscationProfile returns the profile used when none is selected.
+func DefaultObfuscationProfile() *ObfuscationProfile {
+	p := builtinObfuscationProfiles[ObfuscationScannerDefault]
+	return &p
+}
+
+// LookupObfuscationProfile returns a built-in profile by name, or loads a
+// custom one when nameOrPath is the path of a JSON profile file.
+func LookupObfuscationProfile(nameOrPath string) (*ObfuscationProfile, error) {
+	if p, ok := builtinObfuscationProfiles[nameOrPath]; ok {
+		return &p, nil
+	}
+
+	data, err := os.ReadFile(nameOrPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("unknown obfuscation profile %q (expected %s or a profile file)",
+				nameOrPath, strings.Join(ObfuscationProfileNames(), ", "))
+		}
+		return nil, err
+	}
+
+	p := &ObfuscationProfile{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("invalid obfuscation profile %s: %w", nameOrPath, err)
+	}
+	if p.Name == "" {
+		p.Name = nameOrPath
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// TemplatePart is either a static byte sequence or a number of random bytes.
+type TemplatePart struct {
+	Static []byte
+	Random int
+}
+
+// Template is a packet template. Its text form uses the AmneziaWG tag syntax:
+// "<b 0xHEX>" for static bytes and "<r N>" for N random bytes.
+type Template []TemplatePart
+
+var templateTag = regexp.MustCompile(`^<(b|r)\s+([^>]+)>`)
+
+// ParseTemplate parses the text form of a template.
+func ParseTemplate(s string) (Template, error) {
+	var t Template
+	rest := strings.TrimSpace(s)
+	for rest != "" {
+		m := templateTag.FindStringSubmatch(rest)
+		if m == nil {
+			return nil, fmt.Errorf("invalid template %q: expected <b 0xHEX> or <r N> at %q", s, rest)
+		}
+		arg := strings.TrimSpace(m[2])
+
+		switch m[1] {
+		case "b":
+			b, err := hex.DecodeString(strings.TrimPrefix(arg, "0x"))
+			if err != nil || len(b) == 0 {
+				return nil, fmt.Errorf("invalid template %q: bad hex %q", s, arg)
+			}
+			t = append(t, TemplatePart{Static: b})
+		case "r":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid template %q: bad length %q", s, arg)
+			}
+			t = append(t, TemplatePart{Random: n})
+		}
+		rest = strings.TrimSpace(rest[len(m[0]):])
+	}
+	if len(t) == 0 {
+		return nil, fmt.Errorf("empty template")
+	}
+	return t, nil
+}
+
+// String returns the text form of the template.
+func (t Template) String() string {
+	var b strings.Builder
+	for _, part := range t {
+		if part.Random > 0 {
+			fmt.Fprintf(&b, "<r %d>", part.Random)
+		} else {
+			fmt.Fprintf(&b, "<b 0x%x>", part.Static)
+		}
+	}
+	return b.String()
+}
+
+// Len returns the size of the packets generated from the template.
+func (t Template) Len() int {
+	n := 0
+	for _, part := range t {
+		n += len(part.Static) + part.Random
+	}
+	return n
+}
+
+// Generate renders the template, filling random parts from crypto/rand.
+func (t Template) Generate() ([]byte, error) {
+	out := make([]byte, 0, t.Len())
+	for _, part := range t {
+		if part.Random > 0 {
+			b := make([]byte, part.Random)
+			if _, err := rand.Read(b); err != nil {
+				return nil, err
+			}
+			out = append(out, b...)
+			continue
+		}
+		out = append(out, part.Static...)
+	}
+	return out, nil
+}
+
+func (t Template) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *Template) UnmarshalText(text []byte) error {
+	parsed, err := ParseTemplate(string(text))
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
@@ -0,0 +1,49 @@
+package statute
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PortStrategy selects the ports probed on each IP.
+type PortStrategy string
+
+const (
+	// PortsAll probes every scanner port.
+	PortsAll PortStrategy = "all"
+	// PortsRandom probes PortCount ports picked at random for each IP.
+	PortsRandom PortStrategy = "random"
+	// PortsFixed probes the ports listed in ScannerOptions.Ports.
+	PortsFixed PortStrategy = "fixed"
+	// PortsAdaptive probes PortCount ports, favoring those that answered on
+	// earlier IPs while still exploring the others.
+	PortsAdaptive PortStrategy = "adaptive"
+)
+
+// DefaultPortCount is the number of ports probed per IP by the random and
+// adaptive strategies when ScannerOptions.PortCount is not set.
+const DefaultPortCount = 8
+
+// PortStrategies lists the valid strategies.
+var PortStrategies = []PortStrategy{PortsAll, PortsRandom, PortsFixed, PortsAdaptive}
+
+// ParsePortStrategy validates a strategy name.
+func ParsePortStrategy(s string) (PortStrategy, error) {
+	for _, strategy := range PortStrategies {
+		if PortStrategy(s) == strategy {
+			return strategy, nil
+		}
+	}
+	names := make([]string, len(PortStrategies))
+	for i, strategy := range PortStrategies {
+		names[i] = string(strategy)
+	}
+	return "", fmt.Errorf("unknown port strategy %q (expected %s)", s, strings.Join(names, ", "))
+}
+
+// PortResult is the handshake RTT measured on one port of an IP.
+type PortResult struct {
+	Port uint16        `json:"port"`
+	RTT  time.Duration `json:"rtt"`
+}
@@ -13,11 +13,11 @@ type IPInfQueue struct {
 func (q *IPInfQueue) Enqueue(item IPInfo) {
 	q.items = append(q.items, item)
 	sort.Slice(q.items, func(i, j int) bool {
-		return q.items[i].RTT < q.items[j].RTT
+		return q.items[i].Score < q.items[j].Score
 	})
 }
 
-// Dequeue removes and returns the item with the lowest RTT.
+// Dequeue removes and returns the item with the lowest score.
 func (q *IPInfQueue) Dequeue() IPInfo {
 	if len(q.items) == 0 {
 		return IPInfo{} // Returning an empty IPInfo when the queue is empty.
@@ -0,0 +1,55 @@
+package statute
+
+import (
+	"math"
+	"time"
+)
+
+// ScoreWeights define how an endpoint's score penalizes jitter and loss. The
+// score is a duration; lower is better.
+type ScoreWeights struct {
+	// Jitter multiplies the standard deviation of the RTT samples.
+	Jitter float64
+	// Loss is added for every percent of lost samples.
+	Loss time.Duration
+}
+
+// DefaultScoreWeights count jitter once and add 10ms per percent of loss.
+var DefaultScoreWeights = ScoreWeights{Jitter: 1, Loss: 10 * time.Millisecond}
+
+// Score returns the average RTT of info penalized by its jitter and loss.
+func (w ScoreWeights) Score(info IPInfo) time.Duration {
+	return info.AvgRTT +
+		time.Duration(w.Jitter*float64(info.StdDevRTT)) +
+		time.Duration(info.Loss*float64(w.Loss))
+}
+
+// SetSamples fills the RTT statistics of info from the RTTs of the samples
+// that were answered, out of sent samples. RTT is set to the average.
+func (info *IPInfo) SetSamples(rtts []time.Duration, sent int) {
+	info.MinRTT, info.AvgRTT, info.MaxRTT, info.StdDevRTT = 0, 0, 0, 0
+	info.Loss = 0
+	if sent > 0 {
+		info.Loss = 100 * float64(sent-len(rtts)) / float64(sent)
+	}
+	if len(rtts) == 0 {
+		return
+	}
+
+	var sum time.Duration
+	info.MinRTT, info.MaxRTT = rtts[0], rtts[0]
+	for _, rtt := range rtts {
+		sum += rtt
+		info.MinRTT = min(info.MinRTT, rtt)
+		info.MaxRTT = max(info.MaxRTT, rtt)
+	}
+	info.AvgRTT = sum / time.Duration(len(rtts))
+
+	var variance float64
+	for _, rtt := range rtts {
+		d := float64(rtt - info.AvgRTT)
+		variance += d * d
+	}
+	info.StdDevRTT = time.Duration(math.Sqrt(variance / float64(len(rtts))))
+	info.RTT = info.AvgRTT
+}
@@ -0,0 +1,28 @@
+package statute
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetSamples(t *testing.T) {
+	var info IPInfo
+	info.SetSamples([]time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond}, 4)
+
+	assert.Equal(t, 10*time.Millisecond, info.MinRTT)
+	assert.Equal(t, 20*time.Millisecond, info.AvgRTT)
+	assert.Equal(t, 30*time.Millisecond, info.MaxRTT)
+	assert.Equal(t, 20*time.Millisecond, info.RTT)
+	assert.InDelta(t, float64(8165*time.Microsecond), float64(info.StdDevRTT), float64(time.Microsecond))
+	assert.Equal(t, 25.0, info.Loss)
+}
+
+func TestScore(t *testing.T) {
+	info := IPInfo{AvgRTT: 100 * time.Millisecond, StdDevRTT: 10 * time.Millisecond, Loss: 5}
+
+	assert.Equal(t, 100*time.Millisecond, ScoreWeights{}.Score(info))
+	assert.Equal(t, 160*time.Millisecond, DefaultScoreWeights.Score(info))
+	assert.Equal(t, 120*time.Millisecond, ScoreWeights{Jitter: 2}.Score(info))
+}
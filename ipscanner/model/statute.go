@@ -15,6 +15,21 @@ type IPInfo struct {
 	AddrPort  netip.AddrPort
 	RTT       time.Duration
 	CreatedAt time.Time
+	// Ports are the ports that answered, fastest first. AddrPort and RTT
+	// are those of the first one.
+	Ports []PortResult
+	// RTT statistics and the percentage of lost samples of AddrPort, see
+	// SetSamples.
+	MinRTT    time.Duration
+	AvgRTT    time.Duration
+	MaxRTT    time.Duration
+	StdDevRTT time.Duration
+	Loss      float64
+	// Score ranks the endpoint, lower is better. See ScoreWeights.
+	Score time.Duration
+	// Colo is the Cloudflare data center that answered, for the probes
+	// that report it.
+	Colo string
 }
 
 type ScannerOptions struct {
@@ -24,12 +39,66 @@ type ScannerOptions struct {
 	WarpPrivateKey    string
 	WarpPeerPublicKey string
 	WarpPresharedKey  string
-	IPQueueSize       int
-	IPQueueTTL        time.Duration
-	MaxDesirableRTT   time.Duration
-	EventsHandler     EndpointEventHandler
-	Cache             *cache.Cache
-	Obfuscation       bool
+	// WarpReserved holds the reserved header bytes sent in handshakes.
+	WarpReserved    []byte
+	IPQueueSize     int
+	IPQueueTTL      time.Duration
+	MaxDesirableRTT time.Duration
+	EventsHandler   EndpointEventHandler
+	Cache           *cache.Cache
+	// Obfuscation selects the junk packets sent before each probe's
+	// handshake. No junk is sent when nil.
+	Obfuscation *ObfuscationProfile
+	// Concurrency is the number of addresses probed at the same time.
+	Concurrency int
+	// Rate caps the probes sent per second across all workers. A WARP
+	// handshake counts once, however many junk packets precede it.
+	// Unlimited when 0.
+	Rate int
+	// PortStrategy selects the ports probed on each IP, PortsAll when empty.
+	PortStrategy PortStrategy
+	// PortCount is the number of ports probed by the random and adaptive
+	// strategies. DefaultPortCount when 0.
+	PortCount int
+	// Ports replace the built-in WARP ports: the fixed strategy probes all
+	// of them and the random and adaptive strategies pick from them.
+	Ports []uint16
+	// Exclude are the prefixes whose addresses are never probed.
+	Exclude []netip.Prefix
+	// Samples is the number of handshakes used to measure the chosen port
+	// of each IP.
+	Samples int
+	// ScoreWeights rank the endpoints found.
+	ScoreWeights ScoreWeights
+	// Seed keys the pseudo-random order addresses are scanned in. A random
+	// seed is picked when 0.
+	Seed uint64
+	// Mode selects how probes are spent, ScanFlat when empty.
+	Mode ScanMode
+	// Subnets configures the ScanSubnets mode.
+	Subnets SubnetOptions
+	// Count stops the scan once that many desirable endpoints were found.
+	// Unlimited when 0.
+	Count int
+	// Timeout stops the scan after that long. Unlimited when 0.
+	Timeout time.Duration
+	// MaxProbes stops the scan after that many addresses were probed.
+	// Unlimited when 0.
+	MaxProbes int64
+	// MinResults is the number of desirable endpoints below which a
+	// finished scan is reported as failed.
+	MinResults int
+	// Checkpoint is the file the progress of a flat scan is saved to and
+	// resumed from. No checkpoints are kept when empty.
+	Checkpoint string
+	// Verify checks that desirable endpoints forward data, not just answer
+	// handshakes. No verification is done when nil.
+	Verify *VerifyOptions
+	// Probe is the name of the probe type, see ping.RegisterProbe. The
+	// WARP handshake probe is used when empty.
+	Probe string
+	// ProbeHost is the server name of the TLS and HTTP probes.
+	ProbeHost string
 }
 
 func DefaultCFRanges() []netip.Prefix {
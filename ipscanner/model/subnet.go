@@ -0,0 +1,128 @@
+package statute
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// ScanMode selects how the scanner spends its probes.
+type ScanMode string
+
+const (
+	// ScanFlat probes addresses from every CIDR in turn.
+	ScanFlat ScanMode = "flat"
+	// ScanSubnets first samples a few addresses of every subnet to rank the
+	// subnets, then deep-scans the best ones.
+	ScanSubnets ScanMode = "subnets"
+)
+
+// ParseScanMode validates a scan mode name.
+func ParseScanMode(s string) (ScanMode, error) {
+	switch mode := ScanMode(s); mode {
+	case ScanFlat, ScanSubnets:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown scan mode %q (expected %s or %s)", s, ScanFlat, ScanSubnets)
+	}
+}
+
+// SubnetOptions configure the subnets scan mode. Zero fields take the
+// defaults of DefaultSubnetOptions.
+type SubnetOptions struct {
+	// Bits4 and Bits6 are the lengths of the subnets CIDRs are split into.
+	Bits4 int
+	Bits6 int
+	// Probes is the number of addresses sampled in each subnet.
+	Probes int
+	// MaxPerCIDR caps the subnets sampled in each CIDR.
+	MaxPerCIDR int
+	// Top is the number of best subnets that are deep-scanned.
+	Top int
+}
+
+// DefaultSubnetOptions sample 3 addresses of up to 256 /24 or /64 subnets
+// per CIDR and deep-scan the best 4.
+var DefaultSubnetOptions = SubnetOptions{Bits4: 24, Bits6: 64, Probes: 3, MaxPerCIDR: 256, Top: 4}
+
+// WithDefaults returns o with its zero fields set to the defaults.
+func (o SubnetOptions) WithDefaults() SubnetOptions {
+	d := DefaultSubnetOptions
+	if o.Bits4 == 0 {
+		o.Bits4 = d.Bits4
+	}
+	if o.Bits6 == 0 {
+		o.Bits6 = d.Bits6
+	}
+	if o.Probes == 0 {
+		o.Probes = d.Probes
+	}
+	if o.MaxPerCIDR == 0 {
+		o.MaxPerCIDR = d.MaxPerCIDR
+	}
+	if o.Top == 0 {
+		o.Top = d.Top
+	}
+	return o
+}
+
+// Validate rejects negative fields, which would otherwise turn into unbounded
+// samples once converted to unsigned counts.
+func (o SubnetOptions) Validate() error {
+	for _, f := range []struct {
+		name  string
+		value int
+	}{
+		{"subnet bits", o.Bits4},
+		{"IPv6 subnet bits", o.Bits6},
+		{"subnet probes", o.Probes},
+		{"max subnets", o.MaxPerCIDR},
+		{"top subnets", o.Top},
+	} {
+		if f.value < 0 {
+			return fmt.Errorf("%s must be positive, got %d", f.name, f.value)
+		}
+	}
+	return nil
+}
+
+// SubnetStats summarize the probes sent to a subnet.
+type SubnetStats struct {
+	Prefix   netip.Prefix  `json:"prefix"`
+	Probed   int           `json:"probed"`
+	Answered int           `json:"answered"`
+	AvgRTT   time.Duration `json:"avg_rtt"`
+	// Score is the average score of the answering addresses plus the loss
+	// penalty for every percent of addresses that did not answer. Lower is
+	// better; subnets without answers have no score.
+	Score time.Duration `json:"score"`
+	// DeepScanned is set for the subnets selected for the second phase.
+	DeepScanned bool `json:"deep_scanned"`
+
+	rttSum   time.Duration
+	scoreSum time.Duration
+}
+
+// Reachability is the fraction of probed addresses that answered.
+func (s *SubnetStats) Reachability() float64 {
+	if s.Probed == 0 {
+		return 0
+	}
+	return float64(s.Answered) / float64(s.Probed)
+}
+
+// Add records the outcome of a probe; info is ignored when ok is false.
+func (s *SubnetStats) Add(info IPInfo, ok bool, weights ScoreWeights) {
+	s.Probed++
+	if ok {
+		s.Answered++
+		s.rttSum += info.RTT
+		s.scoreSum += info.Score
+	}
+	if s.Answered == 0 {
+		return
+	}
+	s.AvgRTT = s.rttSum / time.Duration(s.Answered)
+	unanswered := 100 * (1 - s.Reachability())
+	s.Score = s.scoreSum/time.Duration(s.Answered) + time.Duration(unanswered*float64(weights.Loss))
+}
@@ -0,0 +1,21 @@
+package statute
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubnetOptionsValidate(t *testing.T) {
+	assert.NoError(t, SubnetOptions{}.Validate(), "zero fields take the defaults")
+	assert.NoError(t, DefaultSubnetOptions.Validate())
+
+	for _, o := range []SubnetOptions{
+		{Probes: -1},
+		{MaxPerCIDR: -1},
+		{Top: -4},
+		{Bits4: -24},
+	} {
+		assert.Error(t, o.Validate(), "%+v", o)
+	}
+}
@@ -0,0 +1,43 @@
+package statute
+
+import (
+	"net/netip"
+	"time"
+)
+
+// VerifyOptions configure the data-path verification of endpoints: after a
+// handshake, an ICMP echo is sent to Target through the tunnel and the
+// endpoint is only kept if the reply comes back. Zero fields take the
+// defaults of DefaultVerifyOptions.
+type VerifyOptions struct {
+	// Source is the tunnel's IPv4 interface address, the identity's.
+	Source netip.Addr
+	// Target is the IPv4 address pinged through the tunnel.
+	Target netip.Addr
+	// Timeout is how long each echo waits for its reply, and Attempts the
+	// number of echoes sent before the endpoint is given up on.
+	Timeout  time.Duration
+	Attempts int
+}
+
+// DefaultVerifyOptions ping 1.1.1.1 twice, waiting 2s for each reply.
+var DefaultVerifyOptions = VerifyOptions{
+	Target:   netip.MustParseAddr("1.1.1.1"),
+	Timeout:  2 * time.Second,
+	Attempts: 2,
+}
+
+// WithDefaults returns o with its zero fields set to the defaults.
+func (o VerifyOptions) WithDefaults() VerifyOptions {
+	d := DefaultVerifyOptions
+	if !o.Target.IsValid() {
+		o.Target = d.Target
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = d.Timeout
+	}
+	if o.Attempts <= 0 {
+		o.Attempts = d.Attempts
+	}
+	return o
+}
@@ -0,0 +1,136 @@
+package ping
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+// connTimeout bounds a single measurement of the connection probes.
+const connTimeout = 5 * time.Second
+
+// rootCAs verifies the certificates of the TLS and HTTP probes, the system
+// roots when nil.
+var rootCAs *x509.CertPool
+
+// measureFunc measures addr once and returns the RTT and, if known, the colo
+// that answered.
+type measureFunc func(ctx context.Context, addr netip.AddrPort) (time.Duration, string, error)
+
+// connPing probes an address by repeating a measurement opts.Samples times,
+// such as a TCP connect or a TLS handshake. The first one must succeed, the
+// others count as lost when they fail.
+type connPing struct {
+	addr    netip.AddrPort
+	opts    *statute.ScannerOptions
+	measure measureFunc
+	// limiter paces the measurements. Unlimited when nil.
+	limiter *rate.Limiter
+}
+
+func newConnPing(addr netip.AddrPort, opts *statute.ScannerOptions, measure measureFunc) *connPing {
+	return &connPing{addr: addr, opts: opts, measure: measure}
+}
+
+func (c *connPing) Ping() statute.IPingResult {
+	return c.PingContext(context.Background())
+}
+
+func (c *connPing) PingContext(ctx context.Context) statute.IPingResult {
+	res := &ProbeResult{AddrPort: c.addr, Weights: c.opts.ScoreWeights}
+	for res.Sent < max(c.opts.Samples, 1) {
+		if res.Sent > 0 {
+			select {
+			case <-time.After(sampleInterval):
+			case <-ctx.Done():
+				return res
+			}
+		}
+		if c.limiter != nil {
+			if err := c.limiter.Wait(ctx); err != nil {
+				break
+			}
+		}
+
+		measureCtx, cancel := context.WithTimeout(ctx, connTimeout)
+		rtt, colo, err := c.measure(measureCtx, c.addr)
+		cancel()
+		if ctx.Err() != nil {
+			break
+		}
+		res.Sent++
+		if err != nil {
+			if len(res.Samples) == 0 {
+				return &ProbeResult{Err: err}
+			}
+			continue
+		}
+		res.Samples = append(res.Samples, rtt)
+		if colo != "" {
+			res.Colo = colo
+		}
+	}
+	if len(res.Samples) == 0 {
+		err := ctx.Err()
+		if err == nil {
+			err = errors.New("no samples")
+		}
+		return &ProbeResult{Err: err}
+	}
+	return res
+}
+
+func (c *connPing) share(p *Ping) error {
+	c.limiter = p.limiter
+	return nil
+}
+
+// NewTCPPing returns a probe that times TCP connections to port 443 of ip,
+// or to the first of opts.Ports.
+func NewTCPPing(ip netip.Addr, opts *statute.ScannerOptions) statute.IPing {
+	return newConnPing(netip.AddrPortFrom(ip, probePort(opts)), opts, measureTCP)
+}
+
+func measureTCP(ctx context.Context, addr netip.AddrPort) (time.Duration, string, error) {
+	var dialer net.Dialer
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		return 0, "", err
+	}
+	rtt := time.Since(start)
+	conn.Close()
+	return rtt, "", nil
+}
+
+// NewTLSPing returns a probe that times the TCP connection and TLS handshake
+// with port 443 of ip, or the first of opts.Ports. The certificate must be
+// valid for opts.ProbeHost.
+func NewTLSPing(ip netip.Addr, opts *statute.ScannerOptions) statute.IPing {
+	host := probeHost(opts)
+	return newConnPing(netip.AddrPortFrom(ip, probePort(opts)), opts, func(ctx context.Context, addr netip.AddrPort) (time.Duration, string, error) {
+		var dialer net.Dialer
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", addr.String())
+		if err != nil {
+			return 0, "", err
+		}
+		defer conn.Close()
+
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host, RootCAs: rootCAs})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return 0, "", err
+		}
+		return time.Since(start), "", nil
+	})
+}
+
+var _ statute.IPing = (*connPing)(nil)
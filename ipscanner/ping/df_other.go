@@ -0,0 +1,12 @@
+//go:build !linux
+
+package ping
+
+import (
+	"errors"
+	"net"
+)
+
+func setDontFragment(conn net.Conn, ipv6 bool) error {
+	return errors.New("not supported on this platform")
+}
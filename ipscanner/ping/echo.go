@@ -0,0 +1,138 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+// ICMP protocol numbers, as expected by icmp.ParseMessage.
+const (
+	protocolICMP   = 1
+	protocolICMPv6 = 58
+)
+
+// echoSeq numbers the echo requests of the ICMP probe.
+var echoSeq atomic.Uint32
+
+// NewICMPPing returns a probe that sends ICMP echo requests to ip. It uses
+// unprivileged ping sockets where the system allows them, and raw sockets
+// otherwise.
+func NewICMPPing(ip netip.Addr, opts *statute.ScannerOptions) statute.IPing {
+	return newConnPing(netip.AddrPortFrom(ip, 0), opts, measureICMP)
+}
+
+func measureICMP(ctx context.Context, addr netip.AddrPort) (time.Duration, string, error) {
+	ip := addr.Addr().Unmap()
+	conn, raw, err := listenICMP(ip.Is4())
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+	// Closing the socket interrupts the wait for the reply.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var (
+		typ   icmp.Type = ipv4.ICMPTypeEcho
+		reply icmp.Type = ipv4.ICMPTypeEchoReply
+		proto           = protocolICMP
+	)
+	if !ip.Is4() {
+		typ, reply, proto = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply, protocolICMPv6
+	}
+
+	seq := int(uint16(echoSeq.Add(1)))
+	msg := icmp.Message{
+		Type: typ,
+		Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: seq, Data: []byte("warp-scanner")},
+	}
+	packet, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, "", err
+	}
+
+	var dst net.Addr = &net.UDPAddr{IP: ip.AsSlice()}
+	if raw {
+		dst = &net.IPAddr{IP: ip.AsSlice()}
+	}
+
+	start := time.Now()
+	if _, err := conn.WriteTo(packet, dst); err != nil {
+		return 0, "", err
+	}
+
+	deadline := start.Add(connTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return 0, "", err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, "", ctx.Err()
+			}
+			return 0, "", err
+		}
+		if !sameIP(from, ip) {
+			continue
+		}
+		m, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || m.Type != reply {
+			continue
+		}
+		// Ping sockets rewrite the identifier, so only the sequence
+		// number is matched.
+		if echo, ok := m.Body.(*icmp.Echo); ok && echo.Seq == seq {
+			return time.Since(start), "", nil
+		}
+	}
+}
+
+// listenICMP opens an unprivileged ping socket, or a raw socket when those
+// are not allowed, and reports whether the socket is raw.
+func listenICMP(is4 bool) (*icmp.PacketConn, bool, error) {
+	network, rawNetwork, addr := "udp4", "ip4:icmp", "0.0.0.0"
+	if !is4 {
+		network, rawNetwork, addr = "udp6", "ip6:ipv6-icmp", "::"
+	}
+
+	conn, err := icmp.ListenPacket(network, addr)
+	if err == nil {
+		return conn, false, nil
+	}
+	conn, rawErr := icmp.ListenPacket(rawNetwork, addr)
+	if rawErr != nil {
+		return nil, false, errors.Join(err, rawErr)
+	}
+	return conn, true, nil
+}
+
+func sameIP(addr net.Addr, ip netip.Addr) bool {
+	var from net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		from = a.IP
+	case *net.IPAddr:
+		from = a.IP
+	default:
+		return false
+	}
+	fromAddr, ok := netip.AddrFromSlice(from)
+	return ok && fromAddr.Unmap() == ip
+}
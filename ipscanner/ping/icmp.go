@@ -0,0 +1,118 @@
+package ping
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"time"
+)
+
+const (
+	ipv4HeaderSize = 20
+	icmpHeaderSize = 8
+
+	icmpEchoReply   = 0
+	icmpUnreachable = 3
+	icmpEchoRequest = 8
+
+	// icmpFragmentationNeeded is the "fragmentation needed and DF set" code
+	// of destination unreachable messages.
+	icmpFragmentationNeeded = 4
+
+	// MinEchoSize is the size of an echo request without payload.
+	MinEchoSize = ipv4HeaderSize + icmpHeaderSize
+)
+
+// ErrPacketTooBig is returned by Echo when a router inside the tunnel reports
+// that the packet exceeds its MTU.
+var ErrPacketTooBig = errors.New("packet too big")
+
+// Echo sends an ICMP echo request from src to dst through the tunnel and
+// waits for the reply. size is the total length of the inner IPv4 packet,
+// which is sent with the DF bit set. It returns the round-trip time.
+func (s *Session) Echo(src, dst netip.Addr, size int, timeout time.Duration) (time.Duration, error) {
+	if !src.Is4() || !dst.Is4() {
+		return 0, errors.New("echo requires IPv4 source and destination addresses")
+	}
+	if size < MinEchoSize || size > 65535 {
+		return 0, fmt.Errorf("invalid echo packet size %d", size)
+	}
+
+	s.echoSeq++
+	id, seq := uint16(os.Getpid()), s.echoSeq
+	packet := icmpEchoPacket(src, dst, id, seq, size)
+
+	start := time.Now()
+	if err := s.WritePacket(packet); err != nil {
+		return 0, err
+	}
+
+	deadline := start.Add(timeout)
+	for {
+		reply, err := s.ReadPacket(deadline)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(reply) < MinEchoSize || reply[0]>>4 != 4 || reply[9] != 1 {
+			continue
+		}
+		icmp := reply[int(reply[0]&0x0f)*4:]
+		if len(icmp) < icmpHeaderSize {
+			continue
+		}
+
+		switch icmp[0] {
+		case icmpEchoReply:
+			if binary.BigEndian.Uint16(icmp[4:6]) == id && binary.BigEndian.Uint16(icmp[6:8]) == seq {
+				return time.Since(start), nil
+			}
+		case icmpUnreachable:
+			if icmp[1] == icmpFragmentationNeeded {
+				return 0, ErrPacketTooBig
+			}
+		}
+	}
+}
+
+func icmpEchoPacket(src, dst netip.Addr, id, seq uint16, size int) []byte {
+	packet := make([]byte, size)
+
+	// IPv4 header
+	packet[0] = 0x45 // version 4, 20-byte header
+	binary.BigEndian.PutUint16(packet[2:4], uint16(size))
+	binary.BigEndian.PutUint16(packet[4:6], seq)
+	binary.BigEndian.PutUint16(packet[6:8], 0x4000) // don't fragment
+	packet[8] = 64                                  // TTL
+	packet[9] = 1                                   // ICMP
+	srcBytes, dstBytes := src.As4(), dst.As4()
+	copy(packet[12:16], srcBytes[:])
+	copy(packet[16:20], dstBytes[:])
+	binary.BigEndian.PutUint16(packet[10:12], checksum(packet[:ipv4HeaderSize]))
+
+	// ICMP echo request, the payload is left zeroed
+	icmp := packet[ipv4HeaderSize:]
+	icmp[0] = icmpEchoRequest
+	binary.BigEndian.PutUint16(icmp[4:6], id)
+	binary.BigEndian.PutUint16(icmp[6:8], seq)
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp))
+
+	return packet
+}
+
+// checksum computes the Internet checksum (RFC 1071).
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -3,24 +3,62 @@ package ping
 import (
 	"context"
 	"net/netip"
+	"sync"
+
+	"golang.org/x/time/rate"
 
 	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
 )
 
 type Ping struct {
 	options *statute.ScannerOptions
+	limiter *rate.Limiter
+	ports   *portSelector
+
+	proberOnce sync.Once
+	prober     *Prober
+	proberErr  error
 }
 
-// NewPinger creates a new Ping instance.
+// NewPinger creates a new Ping instance. Its probes share the rate limit of
+// opts.Rate.
 func NewPinger(opts *statute.ScannerOptions) *Ping {
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if opts.Rate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(opts.Rate), 1)
+	}
 	return &Ping{
 		options: opts,
+		limiter: limiter,
+		ports:   newPortSelector(opts),
 	}
 }
 
-// DoPing performs a ping on the given IP address.
+// sharedProbe is implemented by the built-in probes that use the rate limit
+// and sockets shared by the pings of a scan. Other probes are rate-limited
+// once per address.
+type sharedProbe interface {
+	share(p *Ping) error
+}
+
+// DoPing probes the given IP address with the probe type selected in the
+// options.
 func (p *Ping) DoPing(ctx context.Context, ip netip.Addr) (statute.IPInfo, error) {
-	res, err := p.calc(ctx, NewWarpPing(ip, p.options))
+	factory, err := LookupProbe(p.options.Probe)
+	if err != nil {
+		return statute.IPInfo{}, err
+	}
+
+	tp := factory(ip, p.options)
+	if sp, ok := tp.(sharedProbe); ok {
+		if err := sp.share(p); err != nil {
+			return statute.IPInfo{}, err
+		}
+	} else if err := p.limiter.Wait(ctx); err != nil {
+		return statute.IPInfo{}, err
+	}
+
+	res, err := p.calc(ctx, tp)
 	if err != nil {
 		return statute.IPInfo{}, err
 	}
@@ -28,6 +66,31 @@ func (p *Ping) DoPing(ctx context.Context, ip netip.Addr) (statute.IPInfo, error
 	return res, nil
 }
 
+// sharedProber returns the prober whose sockets the WARP probes share,
+// creating it on first use.
+func (p *Ping) sharedProber() (*Prober, error) {
+	p.proberOnce.Do(func() {
+		p.prober, p.proberErr = NewProber(SessionConfig{
+			PrivateKey:    p.options.WarpPrivateKey,
+			PeerPublicKey: p.options.WarpPeerPublicKey,
+			PresharedKey:  p.options.WarpPresharedKey,
+			Obfuscation:   p.options.Obfuscation,
+			Reserved:      p.options.WarpReserved,
+		})
+	})
+	return p.prober, p.proberErr
+}
+
+// Close releases the sockets shared by the pings.
+func (p *Ping) Close() error {
+	// Mark the prober as created so that it cannot appear after Close.
+	p.proberOnce.Do(func() {})
+	if p.prober != nil {
+		return p.prober.Close()
+	}
+	return nil
+}
+
 func (p *Ping) calc(ctx context.Context, tp statute.IPing) (statute.IPInfo, error) {
 	pr := tp.PingContext(ctx)
 	err := pr.Error()
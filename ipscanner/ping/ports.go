@@ -0,0 +1,129 @@
+package ping
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/network"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+// portSelector picks the ports probed on each IP according to a strategy.
+// The adaptive strategy learns from the outcomes passed to record.
+type portSelector struct {
+	strategy statute.PortStrategy
+	ports    []uint16
+	count    int
+
+	mu    sync.Mutex
+	stats map[uint16]*portStats
+}
+
+type portStats struct {
+	attempts  int
+	successes int
+}
+
+// score is the success rate with a uniform prior, so that untried ports rank
+// in the middle.
+func (s *portStats) score() float64 {
+	if s == nil {
+		return 0.5
+	}
+	return float64(s.successes+1) / float64(s.attempts+2)
+}
+
+func newPortSelector(opts *statute.ScannerOptions) *portSelector {
+	strategy := opts.PortStrategy
+	if strategy == "" {
+		strategy = statute.PortsAll
+	}
+
+	ports := network.ScannerPorts()
+	if len(opts.Ports) > 0 {
+		ports = opts.Ports
+	}
+
+	count := opts.PortCount
+	if count <= 0 {
+		count = statute.DefaultPortCount
+	}
+	if count > len(ports) {
+		count = len(ports)
+	}
+
+	return &portSelector{
+		strategy: strategy,
+		ports:    ports,
+		count:    count,
+		stats:    make(map[uint16]*portStats),
+	}
+}
+
+// selectPorts returns the ports to probe on the next IP.
+func (s *portSelector) selectPorts() []uint16 {
+	switch s.strategy {
+	case statute.PortsRandom:
+		return s.random(s.ports, s.count)
+	case statute.PortsAdaptive:
+		return s.adaptive()
+	default:
+		return append([]uint16(nil), s.ports...)
+	}
+}
+
+func (s *portSelector) random(ports []uint16, n int) []uint16 {
+	shuffled := append([]uint16(nil), ports...)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled[:n]
+}
+
+// adaptive returns the best-scoring three quarters of the ports and fills the
+// rest with random others, so that ports that stopped answering can be
+// replaced by ones that started to.
+func (s *portSelector) adaptive() []uint16 {
+	s.mu.Lock()
+	ranked := s.random(s.ports, len(s.ports))
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return s.stats[ranked[i]].score() > s.stats[ranked[j]].score()
+	})
+	s.mu.Unlock()
+
+	exploit := s.count - s.count/4
+	selected := ranked[:exploit]
+	return append(selected, s.random(ranked[exploit:], s.count-exploit)...)
+}
+
+// record notes whether a probe on port got an answer.
+func (s *portSelector) record(port uint16, ok bool) {
+	if s.strategy != statute.PortsAdaptive {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats[port]
+	if stats == nil {
+		stats = &portStats{}
+		s.stats[port] = stats
+	}
+	stats.attempts++
+	if ok {
+		stats.successes++
+	}
+}
+
+// sortPortResults orders results by RTT, breaking ties by port number so the
+// chosen port does not depend on the order the answers arrived in.
+func sortPortResults(results []statute.PortResult) {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].RTT != results[j].RTT {
+			return results[i].RTT < results[j].RTT
+		}
+		return results[i].Port < results[j].Port
+	})
+}
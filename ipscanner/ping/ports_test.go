@@ -0,0 +1,94 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shahradelahi/cloudflare-warp/cloudflare/network"
+	"github.com/shahradelahi/cloudflare-warp/internal/wgtest"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+func TestPortSelector(t *testing.T) {
+	all := newPortSelector(&statute.ScannerOptions{})
+	assert.Equal(t, network.ScannerPorts(), all.selectPorts())
+
+	random := newPortSelector(&statute.ScannerOptions{PortStrategy: statute.PortsRandom, PortCount: 5})
+	ports := random.selectPorts()
+	assert.Len(t, ports, 5)
+	for _, port := range ports {
+		assert.Contains(t, network.ScannerPorts(), port)
+	}
+
+	fixed := newPortSelector(&statute.ScannerOptions{PortStrategy: statute.PortsFixed, Ports: []uint16{2408, 500}})
+	assert.Equal(t, []uint16{2408, 500}, fixed.selectPorts())
+
+	custom := []uint16{854, 855, 856, 857}
+	random = newPortSelector(&statute.ScannerOptions{PortStrategy: statute.PortsRandom, PortCount: 2, Ports: custom})
+	assert.Subset(t, custom, random.selectPorts(), "random picks from the given ports")
+}
+
+func TestPortSelectorAdaptive(t *testing.T) {
+	s := newPortSelector(&statute.ScannerOptions{PortStrategy: statute.PortsAdaptive, PortCount: 4})
+	assert.Len(t, s.selectPorts(), 4)
+
+	for _, port := range network.ScannerPorts() {
+		for i := 0; i < 5; i++ {
+			s.record(port, port == 2408 || port == 500 || port == 4500)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		ports := s.selectPorts()
+		assert.Len(t, ports, 4)
+		assert.Subset(t, ports, []uint16{2408, 500, 4500}, "ports that answer are always probed")
+	}
+}
+
+func TestSortPortResults(t *testing.T) {
+	results := []statute.PortResult{
+		{Port: 2408, RTT: 30 * time.Millisecond},
+		{Port: 943, RTT: 20 * time.Millisecond},
+		{Port: 500, RTT: 20 * time.Millisecond},
+	}
+	sortPortResults(results)
+	assert.Equal(t, []statute.PortResult{
+		{Port: 500, RTT: 20 * time.Millisecond},
+		{Port: 943, RTT: 20 * time.Millisecond},
+		{Port: 2408, RTT: 30 * time.Millisecond},
+	}, results)
+}
+
+func TestWarpPingPorts(t *testing.T) {
+	privateKey, publicKey, err := wgtest.KeyPair()
+	assert.NoError(t, err)
+	peer, err := wgtest.NewPeer(publicKey, 1500)
+	assert.NoError(t, err)
+	defer peer.Close()
+
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer silent.Close()
+	silentPort := silent.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+
+	opts := &statute.ScannerOptions{
+		WarpPrivateKey:    privateKey,
+		WarpPeerPublicKey: peer.PublicKey,
+		PortStrategy:      statute.PortsFixed,
+		Ports:             []uint16{silentPort, peer.Endpoint.Port()},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	res := NewWarpPing(peer.Endpoint.Addr(), opts).PingContext(ctx)
+	assert.NoError(t, res.Error())
+
+	info := res.Result()
+	assert.Equal(t, peer.Endpoint, info.AddrPort)
+	assert.Len(t, info.Ports, 1, "only the answering port is reported")
+	assert.Equal(t, info.RTT, info.Ports[0].RTT)
+}
@@ -0,0 +1,162 @@
+package ping
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+// Built-in probe types.
+const (
+	// ProbeWarp performs WireGuard handshakes with the WARP ports.
+	ProbeWarp = "warp"
+	// ProbeTCP connects to TCP port 443.
+	ProbeTCP = "tcp"
+	// ProbeTLS performs a TLS handshake on port 443.
+	ProbeTLS = "tls"
+	// ProbeHTTPTrace fetches /cdn-cgi/trace over HTTPS and records the
+	// Cloudflare colo that answered.
+	ProbeHTTPTrace = "http-trace"
+	// ProbeICMP sends ICMP echo requests.
+	ProbeICMP = "icmp"
+)
+
+const (
+	// DefaultProbeHost is the server name of the TLS and HTTP probes.
+	DefaultProbeHost = "cloudflare.com"
+	// DefaultProbePort is the port of the TCP, TLS and HTTP probes.
+	DefaultProbePort = 443
+)
+
+// ProbeFactory creates the probe of one IP address from the scanner's
+// options.
+type ProbeFactory func(ip netip.Addr, opts *statute.ScannerOptions) statute.IPing
+
+var (
+	probesMu sync.RWMutex
+	probes   = make(map[string]ProbeFactory)
+)
+
+func init() {
+	RegisterProbe(ProbeWarp, func(ip netip.Addr, opts *statute.ScannerOptions) statute.IPing {
+		return NewWarpPing(ip, opts)
+	})
+	RegisterProbe(ProbeTCP, NewTCPPing)
+	RegisterProbe(ProbeTLS, NewTLSPing)
+	RegisterProbe(ProbeHTTPTrace, NewHTTPTracePing)
+	RegisterProbe(ProbeICMP, NewICMPPing)
+}
+
+// RegisterProbe makes a probe type selectable by name, replacing the probe
+// previously registered under that name.
+func RegisterProbe(name string, factory ProbeFactory) {
+	probesMu.Lock()
+	defer probesMu.Unlock()
+	probes[name] = factory
+}
+
+// LookupProbe returns the factory of the probe type name, ProbeWarp when
+// name is empty.
+func LookupProbe(name string) (ProbeFactory, error) {
+	if name == "" {
+		name = ProbeWarp
+	}
+
+	probesMu.RLock()
+	defer probesMu.RUnlock()
+	factory, ok := probes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown probe %q (expected one of %v)", name, probeNames())
+	}
+	return factory, nil
+}
+
+// ProbeNames returns the registered probe types, sorted.
+func ProbeNames() []string {
+	probesMu.RLock()
+	defer probesMu.RUnlock()
+	return probeNames()
+}
+
+func probeNames() []string {
+	names := make([]string, 0, len(probes))
+	for name := range probes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsWarpProbe reports whether name selects the WARP handshake probe, the
+// only one whose results are WARP endpoints.
+func IsWarpProbe(name string) bool {
+	return name == "" || name == ProbeWarp
+}
+
+// ProbeResult is the outcome of a probe that measures a single port, such
+// as the built-in TCP, TLS, HTTP and ICMP probes.
+type ProbeResult struct {
+	AddrPort netip.AddrPort
+	// Samples are the RTTs measured out of Sent attempts.
+	Samples []time.Duration
+	Sent    int
+	// Colo is the Cloudflare data center that answered, when the probe
+	// reports it.
+	Colo    string
+	Weights statute.ScoreWeights
+	Err     error
+}
+
+func (r *ProbeResult) Result() statute.IPInfo {
+	info := statute.IPInfo{AddrPort: r.AddrPort, CreatedAt: time.Now(), Colo: r.Colo}
+	info.SetSamples(r.Samples, r.Sent)
+	info.Ports = []statute.PortResult{{Port: r.AddrPort.Port(), RTT: info.RTT}}
+	info.Score = r.Weights.Score(info)
+	return info
+}
+
+func (r *ProbeResult) Error() error {
+	return r.Err
+}
+
+func (r *ProbeResult) String() string {
+	if r.Err != nil {
+		return r.Err.Error()
+	}
+	return fmt.Sprintf("%s: time=%s", r.AddrPort, r.RTT())
+}
+
+// RTT returns the average of the samples.
+func (r *ProbeResult) RTT() time.Duration {
+	if len(r.Samples) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, rtt := range r.Samples {
+		sum += rtt
+	}
+	return sum / time.Duration(len(r.Samples))
+}
+
+// probeHost returns the server name of the TLS and HTTP probes.
+func probeHost(opts *statute.ScannerOptions) string {
+	if opts.ProbeHost != "" {
+		return opts.ProbeHost
+	}
+	return DefaultProbeHost
+}
+
+// probePort returns the port of the TCP, TLS and HTTP probes: the first of
+// opts.Ports, or DefaultProbePort.
+func probePort(opts *statute.ScannerOptions) uint16 {
+	if len(opts.Ports) > 0 {
+		return opts.Ports[0]
+	}
+	return DefaultProbePort
+}
+
+var _ statute.IPingResult = (*ProbeResult)(nil)
@@ -0,0 +1,119 @@
+package ping
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+type fixedPing struct {
+	addr netip.AddrPort
+}
+
+func (f *fixedPing) Ping() statute.IPingResult {
+	return f.PingContext(context.Background())
+}
+
+func (f *fixedPing) PingContext(context.Context) statute.IPingResult {
+	return &ProbeResult{AddrPort: f.addr, Samples: []time.Duration{time.Millisecond}, Sent: 1, Colo: "TST"}
+}
+
+func TestProbeRegistry(t *testing.T) {
+	assert.Subset(t, ProbeNames(), []string{ProbeWarp, ProbeTCP, ProbeTLS, ProbeHTTPTrace, ProbeICMP})
+
+	_, err := LookupProbe("nope")
+	assert.ErrorContains(t, err, `unknown probe "nope"`)
+
+	RegisterProbe("fixed", func(ip netip.Addr, opts *statute.ScannerOptions) statute.IPing {
+		return &fixedPing{addr: netip.AddrPortFrom(ip, 7)}
+	})
+	p := NewPinger(&statute.ScannerOptions{Probe: "fixed"})
+	defer p.Close()
+
+	info, err := p.DoPing(context.Background(), netip.MustParseAddr("10.0.0.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("10.0.0.1:7"), info.AddrPort)
+	assert.Equal(t, time.Millisecond, info.RTT)
+	assert.Equal(t, "TST", info.Colo)
+}
+
+func TestTCPPing(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	opts := &statute.ScannerOptions{Ports: []uint16{port}, Samples: 3, ScoreWeights: statute.DefaultScoreWeights}
+	res := NewTCPPing(netip.MustParseAddr("127.0.0.1"), opts).PingContext(context.Background())
+	assert.NoError(t, res.Error())
+	info := res.Result()
+	assert.Equal(t, port, info.AddrPort.Port())
+	assert.Zero(t, info.Loss)
+
+	ln.Close()
+	res = NewTCPPing(netip.MustParseAddr("127.0.0.1"), opts).PingContext(context.Background())
+	assert.Error(t, res.Error())
+}
+
+func TestHTTPTracePing(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != tracePath || r.Host != "example.com" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "fl=1\nh=example.com\ncolo=AMS\nhttp=http/1.1\n")
+	}))
+	// The TLS probe hangs up right after the handshake.
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	rootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	defer func() { rootCAs = nil }()
+
+	addr := netip.MustParseAddrPort(srv.Listener.Addr().String())
+	opts := &statute.ScannerOptions{Ports: []uint16{addr.Port()}, ProbeHost: "example.com"}
+
+	res := NewHTTPTracePing(addr.Addr(), opts).PingContext(context.Background())
+	assert.NoError(t, res.Error())
+	assert.Equal(t, "AMS", res.Result().Colo)
+
+	res = NewTLSPing(addr.Addr(), opts).PingContext(context.Background())
+	assert.NoError(t, res.Error())
+
+	opts.ProbeHost = "cloudflare.com"
+	res = NewTLSPing(addr.Addr(), opts).PingContext(context.Background())
+	assert.Error(t, res.Error(), "the certificate is not valid for the host")
+}
+
+func TestParseTraceColo(t *testing.T) {
+	colo, err := parseTraceColo(strings.NewReader("fl=1\ncolo=FRA\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "FRA", colo)
+
+	_, err = parseTraceColo(strings.NewReader("fl=1\n"))
+	assert.Error(t, err)
+}
+
+func TestICMPPing(t *testing.T) {
+	conn, _, err := listenICMP(true)
+	if err != nil {
+		t.Skipf("ICMP sockets are not available: %v", err)
+	}
+	conn.Close()
+
+	res := NewICMPPing(netip.MustParseAddr("127.0.0.1"), &statute.ScannerOptions{}).PingContext(context.Background())
+	assert.NoError(t, res.Error())
+	assert.Positive(t, res.Result().RTT)
+}
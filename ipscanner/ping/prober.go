@@ -0,0 +1,246 @@
+package ping
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/flynn/noise"
+	"go.uber.org/zap"
+
+	"github.com/shahradelahi/cloudflare-warp/log"
+)
+
+// proberReadBuffer is the socket receive buffer requested for each prober
+// socket, large enough to absorb bursts of responses.
+const proberReadBuffer = 4 << 20
+
+// ErrProberClosed is returned by Probe after the prober has been closed.
+var ErrProberClosed = errors.New("prober closed")
+
+// Prober measures the handshake RTT of many endpoints at once. Initiations
+// are sent from one unconnected UDP socket per address family, each with a
+// unique sender index, and responses are matched back to their probe by that
+// index and the source address.
+type Prober struct {
+	config SessionConfig
+	conn4  *net.UDPConn
+	conn6  *net.UDPConn
+
+	mu        sync.Mutex
+	pending   map[uint32]*pendingProbe
+	nextIndex uint32
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+type pendingProbe struct {
+	addr netip.AddrPort
+	hs   *noise.HandshakeState
+	sent time.Time
+	rtt  chan time.Duration
+}
+
+// NewProber opens the prober's sockets. The IPv6 socket is optional; probes
+// to IPv6 endpoints fail when it cannot be opened.
+func NewProber(config SessionConfig) (*Prober, error) {
+	conn4, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	conn6, err := net.ListenUDP("udp6", nil)
+	if err != nil {
+		log.Debugw("IPv6 probes are unavailable", zap.Error(err))
+		conn6 = nil
+	}
+
+	var seed [4]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		conn4.Close()
+		if conn6 != nil {
+			conn6.Close()
+		}
+		return nil, err
+	}
+
+	p := &Prober{
+		config:    config,
+		conn4:     conn4,
+		conn6:     conn6,
+		pending:   make(map[uint32]*pendingProbe),
+		nextIndex: binary.LittleEndian.Uint32(seed[:]),
+		closed:    make(chan struct{}),
+	}
+	for _, conn := range []*net.UDPConn{conn4, conn6} {
+		if conn == nil {
+			continue
+		}
+		if err := conn.SetReadBuffer(proberReadBuffer); err != nil {
+			log.Debugw("Failed to enlarge prober receive buffer", zap.Error(err))
+		}
+		p.wg.Add(1)
+		go p.receive(conn)
+	}
+	return p, nil
+}
+
+// Probe sends a handshake initiation to addr, preceded by the configured junk
+// packets, and returns the time until the matching response arrived.
+func (p *Prober) Probe(ctx context.Context, addr netip.AddrPort) (time.Duration, error) {
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	conn := p.conn4
+	if addr.Addr().Is6() {
+		conn = p.conn6
+	}
+	if conn == nil {
+		return 0, errors.New("IPv6 is not available")
+	}
+
+	probe := &pendingProbe{addr: addr, rtt: make(chan time.Duration, 1)}
+	index, err := p.register(probe)
+	if err != nil {
+		return 0, err
+	}
+	defer p.unregister(index)
+
+	initiation, hs, err := newInitiation(p.config, index)
+	if err != nil {
+		return 0, err
+	}
+
+	err = sendJunk(ctx, p.config.Obfuscation, func(packet []byte) error {
+		_, err := conn.WriteToUDPAddrPort(packet, addr)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	p.mu.Lock()
+	probe.hs = hs
+	probe.sent = time.Now()
+	p.mu.Unlock()
+
+	if _, err := conn.WriteToUDPAddrPort(initiation, addr); err != nil {
+		return 0, err
+	}
+
+	timer := time.NewTimer(handshakeTimeout)
+	defer timer.Stop()
+
+	select {
+	case rtt := <-probe.rtt:
+		return rtt, nil
+	case <-timer.C:
+		return 0, errors.New("handshake timed out")
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-p.closed:
+		return 0, ErrProberClosed
+	}
+}
+
+// Close closes the sockets and fails the probes in flight.
+func (p *Prober) Close() error {
+	select {
+	case <-p.closed:
+		return nil
+	default:
+	}
+	close(p.closed)
+
+	p.conn4.Close()
+	if p.conn6 != nil {
+		p.conn6.Close()
+	}
+	p.wg.Wait()
+	return nil
+}
+
+func (p *Prober) register(probe *pendingProbe) (uint32, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.closed:
+		return 0, ErrProberClosed
+	default:
+	}
+
+	for {
+		index := p.nextIndex
+		p.nextIndex++
+		if _, ok := p.pending[index]; !ok {
+			p.pending[index] = probe
+			return index, nil
+		}
+	}
+}
+
+func (p *Prober) unregister(index uint32) {
+	p.mu.Lock()
+	delete(p.pending, index)
+	p.mu.Unlock()
+}
+
+func (p *Prober) receive(conn *net.UDPConn) {
+	defer p.wg.Done()
+
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			select {
+			case <-p.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Debugw("Prober failed to read", zap.Error(err))
+			continue
+		}
+		received := time.Now()
+
+		response := buf[:n]
+		if len(response) != responseSize || response[0] != messageResponse {
+			continue
+		}
+		index := binary.LittleEndian.Uint32(response[8:12])
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+		p.mu.Lock()
+		probe, ok := p.pending[index]
+		if !ok || probe.hs == nil || probe.addr != from {
+			p.mu.Unlock()
+			continue
+		}
+		hs, sent := probe.hs, probe.sent
+		p.mu.Unlock()
+
+		// Only this goroutine reads the responses of the probe's address
+		// family. A response that fails to authenticate leaves the handshake
+		// state unchanged, so the probe keeps waiting for a valid one.
+		if _, _, _, err := readResponse(hs, response, index); err != nil {
+			log.Debugw("Invalid handshake response", zap.Stringer("address", from), zap.Error(err))
+			continue
+		}
+
+		// A handshake state can only complete once.
+		p.mu.Lock()
+		probe.hs = nil
+		p.mu.Unlock()
+
+		select {
+		case probe.rtt <- received.Sub(sent):
+		default:
+		}
+	}
+}
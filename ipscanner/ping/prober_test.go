@@ -0,0 +1,113 @@
+package ping
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shahradelahi/cloudflare-warp/internal/wgtest"
+)
+
+func TestProber(t *testing.T) {
+	privateKey, publicKey, err := wgtest.KeyPair()
+	assert.NoError(t, err)
+	peer, err := wgtest.NewPeer(publicKey, 1500)
+	assert.NoError(t, err)
+	defer peer.Close()
+
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer silent.Close()
+
+	p, err := NewProber(SessionConfig{PrivateKey: privateKey, PeerPublicKey: peer.PublicKey})
+	assert.NoError(t, err)
+
+	// A probe without a response stays pending while others complete on the
+	// same socket.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := p.Probe(ctx, silent.LocalAddr().(*net.UDPAddr).AddrPort())
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	}()
+
+	// WireGuard ignores initiations from one key that follow each other
+	// within 20ms, so the probes to the peer are spaced out.
+	for i := 0; i < 3; i++ {
+		rtt, err := p.Probe(context.Background(), peer.Endpoint)
+		assert.NoError(t, err)
+		assert.Greater(t, rtt, time.Duration(0))
+		time.Sleep(50 * time.Millisecond)
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	assert.Empty(t, p.pending, "finished probes are unregistered")
+	p.mu.Unlock()
+
+	assert.NoError(t, p.Close())
+	_, err = p.Probe(context.Background(), peer.Endpoint)
+	assert.ErrorIs(t, err, ErrProberClosed)
+}
+
+func TestProberInvalidResponse(t *testing.T) {
+	privateKey, publicKey, err := wgtest.KeyPair()
+	assert.NoError(t, err)
+	peer, err := wgtest.NewPeer(publicKey, 1500)
+	assert.NoError(t, err)
+	defer peer.Close()
+
+	// front answers the initiation with forged responses for its sender
+	// index, one with a zero ephemeral and one with random bytes, before
+	// relaying the peer's real response from the same address.
+	front, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer front.Close()
+	back, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(peer.Endpoint))
+	assert.NoError(t, err)
+	defer back.Close()
+
+	go func() {
+		buf := make([]byte, 2048)
+		n, client, err := front.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		initiation := append([]byte(nil), buf[:n]...)
+
+		for _, random := range []bool{false, true} {
+			forged := make([]byte, responseSize)
+			if random {
+				rand.Read(forged)
+			}
+			forged[0] = messageResponse
+			copy(forged[8:12], initiation[4:8])
+			front.WriteToUDP(forged, client)
+		}
+
+		back.Write(initiation)
+		back.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if n, err = back.Read(buf); err != nil {
+			return
+		}
+		front.WriteToUDP(buf[:n], client)
+	}()
+
+	p, err := NewProber(SessionConfig{PrivateKey: privateKey, PeerPublicKey: peer.PublicKey})
+	assert.NoError(t, err)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rtt, err := p.Probe(ctx, front.LocalAddr().(*net.UDPAddr).AddrPort())
+	assert.NoError(t, err, "the valid response after a forged one completes the probe")
+	assert.Greater(t, rtt, time.Duration(0))
+}
@@ -0,0 +1,346 @@
+package ping
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/flynn/noise"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+	"github.com/shahradelahi/cloudflare-warp/utils"
+)
+
+// WireGuard message types and sizes.
+const (
+	messageInitiation = 1
+	messageResponse   = 2
+	messageTransport  = 4
+
+	responseSize        = 92
+	transportHeaderSize = 16
+	// TransportOverhead is the number of bytes WireGuard adds to an inner
+	// packet: the transport header and the authentication tag.
+	TransportOverhead = transportHeaderSize + 16
+
+	// localIndex is the sender index we use for every session.
+	localIndex = 28
+
+	handshakeTimeout = 5 * time.Second
+)
+
+// SessionConfig holds the keys and options of a WireGuard session.
+type SessionConfig struct {
+	PrivateKey    string
+	PeerPublicKey string
+	PresharedKey  string
+	// Obfuscation selects the junk packets sent before the handshake.
+	Obfuscation *statute.ObfuscationProfile
+	// Reserved is written to the three reserved header bytes of outgoing
+	// messages. WARP uses them to carry the decoded client_id.
+	Reserved []byte
+	// DontFragment sets the DF bit on outgoing packets where supported, so
+	// packets larger than the path MTU are dropped instead of fragmented.
+	DontFragment bool
+}
+
+// Session is a minimal WireGuard initiator: it performs the handshake and
+// exchanges transport data packets with the peer, without any of the timers
+// or rekeying of a full implementation. It is meant for short-lived probes.
+type Session struct {
+	conn        net.Conn
+	reserved    []byte
+	rtt         time.Duration
+	remoteIndex uint32
+	send        noise.Cipher
+	receive     noise.Cipher
+	sendCounter uint64
+	echoSeq     uint16
+}
+
+// DialSession performs a WireGuard handshake with addr and returns the
+// established session.
+func DialSession(ctx context.Context, addr netip.AddrPort, config SessionConfig) (*Session, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if config.DontFragment {
+		if err := setDontFragment(conn, addr.Addr().Is6()); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to set don't fragment: %w", err)
+		}
+	}
+
+	s := &Session{conn: conn, reserved: config.Reserved}
+	if err := s.handshake(ctx, config); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// RTT returns the time the peer took to answer the handshake.
+func (s *Session) RTT() time.Duration {
+	return s.rtt
+}
+
+// Close closes the underlying connection.
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
+
+// WritePacket encrypts an IP packet and sends it to the peer.
+func (s *Session) WritePacket(packet []byte) error {
+	msg := make([]byte, transportHeaderSize, transportHeaderSize+len(packet)+16)
+	msg[0] = messageTransport
+	copy(msg[1:4], s.reserved)
+	binary.LittleEndian.PutUint32(msg[4:8], s.remoteIndex)
+	binary.LittleEndian.PutUint64(msg[8:16], s.sendCounter)
+
+	msg = s.send.Encrypt(msg, s.sendCounter, nil, packet)
+	s.sendCounter++
+
+	_, err := s.conn.Write(msg)
+	return err
+}
+
+// ReadPacket waits until deadline for a transport data packet and returns
+// the decrypted IP packet. Keepalives and other messages are skipped.
+func (s *Session) ReadPacket(deadline time.Time) ([]byte, error) {
+	if err := s.conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		msg := buf[:n]
+		if len(msg) < TransportOverhead || msg[0] != messageTransport {
+			continue
+		}
+		if binary.LittleEndian.Uint32(msg[4:8]) != localIndex {
+			continue
+		}
+
+		counter := binary.LittleEndian.Uint64(msg[8:16])
+		packet, err := s.receive.Decrypt(nil, counter, nil, msg[transportHeaderSize:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt transport packet: %w", err)
+		}
+		if len(packet) == 0 {
+			// keepalive
+			continue
+		}
+		return packet, nil
+	}
+}
+
+func (s *Session) handshake(ctx context.Context, config SessionConfig) error {
+	initiation, hs, err := newInitiation(config, localIndex)
+	if err != nil {
+		return err
+	}
+
+	if err := SendRandomPackets(ctx, s.conn, config.Obfuscation); err != nil {
+		return err
+	}
+
+	if _, err := s.conn.Write(initiation); err != nil {
+		return err
+	}
+	t0 := time.Now()
+
+	response := make([]byte, responseSize)
+	deadline := time.Now().Add(handshakeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	s.conn.SetReadDeadline(deadline)
+	i, err := s.conn.Read(response)
+	if err != nil {
+		return err
+	}
+	s.rtt = time.Since(t0)
+
+	s.remoteIndex, s.send, s.receive, err = readResponse(hs, response[:i], localIndex)
+	return err
+}
+
+// newInitiation builds a handshake initiation with the given sender index and
+// returns it with the handshake state needed to read the response.
+func newInitiation(config SessionConfig, index uint32) ([]byte, *noise.HandshakeState, error) {
+	if len(config.Reserved) != 0 && len(config.Reserved) != 3 {
+		return nil, nil, fmt.Errorf("reserved must be 3 bytes, got %d", len(config.Reserved))
+	}
+
+	staticKeyPair, err := staticKeypair(config.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	peerPublicKey, err := base64.StdEncoding.DecodeString(config.PeerPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	presharedKey, err := base64.StdEncoding.DecodeString(config.PresharedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if config.PresharedKey == "" {
+		presharedKey = make([]byte, 32)
+	}
+
+	ephemeral, err := ephemeralKeypair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:           cs,
+		Pattern:               noise.HandshakeIK,
+		Initiator:             true,
+		StaticKeypair:         staticKeyPair,
+		PeerStatic:            peerPublicKey,
+		Prologue:              []byte("WireGuard v1 zx2c4 Jason@zx2c4.com"),
+		PresharedKey:          presharedKey,
+		PresharedKeyPlacement: 2,
+		EphemeralKeypair:      ephemeral,
+		Random:                rand.Reader,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Prepare handshake initiation packet
+
+	// TAI64N timestamp calculation
+	now := time.Now().UTC()
+	epochOffset := int64(4611686018427387914) // TAI offset from Unix epoch
+
+	tai64nTimestampBuf := make([]byte, 0, 16)
+	tai64nTimestampBuf = binary.BigEndian.AppendUint64(tai64nTimestampBuf, uint64(epochOffset+now.Unix()))
+	tai64nTimestampBuf = binary.BigEndian.AppendUint32(tai64nTimestampBuf, uint32(now.Nanosecond()))
+	msg, _, _, err := hs.WriteMessage(nil, tai64nTimestampBuf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	initiationPacket := new(bytes.Buffer)
+	binary.Write(initiationPacket, binary.BigEndian, []byte{messageInitiation, 0x00, 0x00, 0x00})
+	binary.Write(initiationPacket, binary.BigEndian, utils.Uint32ToBytes(index))
+	binary.Write(initiationPacket, binary.BigEndian, msg)
+
+	macKey := blake2s.Sum256(append([]byte("mac1----"), peerPublicKey...))
+	hasher, err := blake2s.New128(macKey[:]) // using macKey as the key
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = hasher.Write(initiationPacket.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	initiationPacketMAC := hasher.Sum(nil)
+
+	// Append the MAC and 16 null bytes to the initiation packet
+	binary.Write(initiationPacket, binary.BigEndian, initiationPacketMAC[:16])
+	binary.Write(initiationPacket, binary.BigEndian, [16]byte{})
+
+	// The reserved bytes are not covered by the MAC; WARP reads them as is.
+	copy(initiationPacket.Bytes()[1:4], config.Reserved)
+
+	return initiationPacket.Bytes(), hs, nil
+}
+
+// readResponse checks a handshake response to the initiation sent with the
+// given sender index and returns the peer's index and the transport ciphers.
+func readResponse(hs *noise.HandshakeState, response []byte, index uint32) (uint32, noise.Cipher, noise.Cipher, error) {
+	if len(response) < 60 {
+		return 0, nil, nil, fmt.Errorf("invalid handshake response length %d bytes", len(response))
+	}
+
+	// Check the response type
+	if response[0] != messageResponse {
+		return 0, nil, nil, errors.New("invalid response type")
+	}
+
+	// Extract sender and receiver index from the response
+	remoteIndex := binary.LittleEndian.Uint32(response[4:8])
+	ourIndex := binary.LittleEndian.Uint32(response[8:12])
+	if ourIndex != index { // Check if the response corresponds to our sender index
+		return 0, nil, nil, errors.New("invalid sender index in response")
+	}
+
+	// Noise rolls its state back when a response fails to decrypt, but not
+	// when a low-order ephemeral fails the DH, so reject those up front and
+	// leave the handshake state usable for a later response.
+	if _, err := curve25519.X25519(hs.LocalEphemeral().Private, response[12:44]); err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid ephemeral in response: %w", err)
+	}
+
+	payload, sendState, receiveState, err := hs.ReadMessage(nil, response[12:60])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	// Check if the payload is empty (as expected in WireGuard handshake)
+	if len(payload) != 0 {
+		return 0, nil, nil, errors.New("unexpected payload in response")
+	}
+
+	// Noise's split yields the same transport keys as WireGuard, and its
+	// ChaCha20-Poly1305 nonce encoding matches WireGuard's counter.
+	return remoteIndex, sendState.Cipher(), receiveState.Cipher(), nil
+}
+
+func staticKeypair(privateKeyBase64 string) (noise.DHKey, error) {
+	privateKey, err := base64.StdEncoding.DecodeString(privateKeyBase64)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+
+	var pubkey, privkey [32]byte
+	copy(privkey[:], privateKey)
+	curve25519.ScalarBaseMult(&pubkey, &privkey)
+
+	return noise.DHKey{
+		Private: privateKey,
+		Public:  pubkey[:],
+	}, nil
+}
+
+func ephemeralKeypair() (noise.DHKey, error) {
+	// Generate an ephemeral private key
+	ephemeralPrivateKey := make([]byte, 32)
+	if _, err := rand.Read(ephemeralPrivateKey); err != nil {
+		return noise.DHKey{}, err
+	}
+
+	// Derive the corresponding ephemeral public key
+	ephemeralPublicKey, err := curve25519.X25519(ephemeralPrivateKey, curve25519.Basepoint)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+
+	return noise.DHKey{
+		Private: ephemeralPrivateKey,
+		Public:  ephemeralPublicKey,
+	}, nil
+}
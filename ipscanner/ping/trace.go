@@ -0,0 +1,81 @@
+package ping
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+// tracePath is Cloudflare's diagnostic page, served by every edge.
+const tracePath = "/cdn-cgi/trace"
+
+// NewHTTPTracePing returns a probe that fetches /cdn-cgi/trace of
+// opts.ProbeHost over HTTPS from port 443 of ip, or the first of
+// opts.Ports, and records the colo that answered.
+func NewHTTPTracePing(ip netip.Addr, opts *statute.ScannerOptions) statute.IPing {
+	host := probeHost(opts)
+	return newConnPing(netip.AddrPortFrom(ip, probePort(opts)), opts, func(ctx context.Context, addr netip.AddrPort) (time.Duration, string, error) {
+		return measureTrace(ctx, addr, host)
+	})
+}
+
+func measureTrace(ctx context.Context, addr netip.AddrPort, host string) (time.Duration, string, error) {
+	var dialer net.Dialer
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr.String())
+			},
+			TLSClientConfig:   &tls.Config{ServerName: host, RootCAs: rootCAs},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+host+tracePath, nil)
+	if err != nil {
+		return 0, "", err
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	colo, err := parseTraceColo(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return 0, "", err
+	}
+	return time.Since(start), colo, nil
+}
+
+// parseTraceColo returns the colo field of a /cdn-cgi/trace body, lines of
+// key=value pairs.
+func parseTraceColo(r io.Reader) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if colo, ok := strings.CutPrefix(scanner.Text(), "colo="); ok {
+			return colo, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no colo in %s", tracePath)
+}
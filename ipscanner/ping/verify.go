@@ -0,0 +1,65 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+// verifyEchoSize is the size of the echo requests sent by VerifyDataPath,
+// small enough for any path.
+const verifyEchoSize = MinEchoSize + 32
+
+// ErrNoDataPath is returned by VerifyDataPath when an endpoint completes the
+// handshake but no echo reply comes back through the tunnel.
+var ErrNoDataPath = errors.New("endpoint does not forward data")
+
+// VerifyDataPath performs a handshake with addr and pings opts.Target
+// through the session, to make sure the endpoint carries traffic for the
+// identity and not just answers handshakes.
+func VerifyDataPath(ctx context.Context, addr netip.AddrPort, config SessionConfig, opts statute.VerifyOptions) error {
+	opts = opts.WithDefaults()
+
+	s, err := DialSession(ctx, addr, config)
+	if err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	defer s.Close()
+	// Closing the session interrupts the echo waiting for its reply.
+	stop := context.AfterFunc(ctx, func() { s.Close() })
+	defer stop()
+
+	for attempt := 0; attempt < opts.Attempts; attempt++ {
+		_, err := s.Echo(opts.Source, opts.Target, verifyEchoSize, opts.Timeout)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			return nil
+		}
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			return err
+		}
+	}
+	return ErrNoDataPath
+}
+
+// Verify checks the data path of addr with the scanner's keys and options. It
+// shares the rate limit of the probes.
+func (p *Ping) Verify(ctx context.Context, addr netip.AddrPort) error {
+	if err := p.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	return VerifyDataPath(ctx, addr, SessionConfig{
+		PrivateKey:    p.options.WarpPrivateKey,
+		PeerPublicKey: p.options.WarpPeerPublicKey,
+		PresharedKey:  p.options.WarpPresharedKey,
+		Obfuscation:   p.options.Obfuscation,
+		Reserved:      p.options.WarpReserved,
+	}, *p.options.Verify)
+}
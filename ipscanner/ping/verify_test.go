@@ -0,0 +1,42 @@
+package ping
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shahradelahi/cloudflare-warp/internal/wgtest"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+func TestVerifyDataPath(t *testing.T) {
+	privateKey, publicKey, err := wgtest.KeyPair()
+	assert.NoError(t, err)
+	peer, err := wgtest.NewPeer(publicKey, 1500)
+	assert.NoError(t, err)
+	defer peer.Close()
+
+	config := SessionConfig{PrivateKey: privateKey, PeerPublicKey: peer.PublicKey}
+	src := netip.MustParseAddr("172.16.0.2")
+
+	err = VerifyDataPath(context.Background(), peer.Endpoint, config, statute.VerifyOptions{
+		Source: src,
+		Target: wgtest.PeerAddr,
+	})
+	assert.NoError(t, err)
+
+	// The peer ignores initiations that follow each other too closely.
+	time.Sleep(sampleInterval)
+
+	// The peer completes the handshake but nothing answers this address.
+	err = VerifyDataPath(context.Background(), peer.Endpoint, config, statute.VerifyOptions{
+		Source:   src,
+		Target:   netip.MustParseAddr("10.9.9.9"),
+		Timeout:  200 * time.Millisecond,
+		Attempts: 2,
+	})
+	assert.ErrorIs(t, err, ErrNoDataPath)
+}
@@ -1,11 +1,8 @@
 package ping
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
-	"encoding/base64"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -13,34 +10,39 @@ import (
 	"sync"
 	"time"
 
-	"github.com/flynn/noise"
 	"go.uber.org/zap"
-	"golang.org/x/crypto/blake2s"
-	"golang.org/x/crypto/curve25519"
+	"golang.org/x/time/rate"
 
-	"github.com/shahradelahi/cloudflare-warp/cloudflare/network"
 	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
 	"github.com/shahradelahi/cloudflare-warp/log"
 	"github.com/shahradelahi/cloudflare-warp/utils"
 )
 
-const (
-	minRandomPackets       = 20
-	maxRandomPackets       = 50
-	minRandomPacketSize    = 10  // Relative to header size
-	maxRandomPacketSize    = 120 // Relative to header size
-	minRandomPacketDelayMs = 80
-	maxRandomPacketDelayMs = 150
-)
+// sampleInterval separates the handshakes that sample one endpoint. WireGuard
+// ignores initiations from the same key that arrive within 20ms.
+const sampleInterval = 50 * time.Millisecond
 
 type WarpPingResult struct {
 	AddrPort netip.AddrPort
 	RTT      time.Duration
-	Err      error
+	// Ports are the ports that answered, fastest first.
+	Ports []statute.PortResult
+	// Samples are the RTTs measured on AddrPort out of Sent handshakes.
+	Samples []time.Duration
+	Sent    int
+	Weights statute.ScoreWeights
+	Err     error
 }
 
 func (h *WarpPingResult) Result() statute.IPInfo {
-	return statute.IPInfo{AddrPort: h.AddrPort, RTT: h.RTT, CreatedAt: time.Now()}
+	info := statute.IPInfo{AddrPort: h.AddrPort, RTT: h.RTT, CreatedAt: time.Now(), Ports: h.Ports}
+	if h.Sent > 0 {
+		info.SetSamples(h.Samples, h.Sent)
+	} else {
+		info.SetSamples([]time.Duration{h.RTT}, 1)
+	}
+	info.Score = h.Weights.Score(info)
+	return info
 }
 
 func (h *WarpPingResult) Error() error {
@@ -61,137 +63,163 @@ type WarpPing struct {
 	PresharedKey  string
 	IP            netip.Addr
 	opts          *statute.ScannerOptions
+	// limiter paces the handshakes. Unlimited when nil.
+	limiter *rate.Limiter
+	// prober sends the handshakes from shared sockets. Each handshake uses
+	// its own connection when nil.
+	prober *Prober
+	// ports selects the probed ports. A scan shares the selector of its
+	// Ping; a standalone probe builds its own on first use.
+	ports *portSelector
 }
 
 func (h *WarpPing) Ping() statute.IPingResult {
 	return h.PingContext(context.Background())
 }
 
+// PingContext probes the selected ports of the IP concurrently and reports
+// the fastest one along with every other port that answered.
 func (h *WarpPing) PingContext(ctx context.Context) statute.IPingResult {
-	ports := network.ScannerPorts()
-	results := make(chan statute.IPingResult, len(ports))
-	var wg sync.WaitGroup
+	if h.ports == nil {
+		h.ports = newPortSelector(h.opts)
+	}
+	ports := h.ports.selectPorts()
+
+	var (
+		mu      sync.Mutex
+		answers []statute.PortResult
+		lastErr error
+		wg      sync.WaitGroup
+	)
 
 	for _, port := range ports {
 		wg.Add(1)
 		addr := netip.AddrPortFrom(h.IP, port)
 		go func(addr netip.AddrPort) {
 			defer wg.Done()
+			if err := h.wait(ctx); err != nil {
+				mu.Lock()
+				lastErr = err
+				mu.Unlock()
+				return
+			}
 			log.Debugf("Attempting to ping WARP endpoint: %s", addr.String())
-			rtt, err := initiateHandshake(
-				ctx,
-				addr,
-				h.PrivateKey,
-				h.PeerPublicKey,
-				h.PresharedKey,
-				true, // Obfuscation
-			)
+			rtt, err := h.handshake(ctx, addr)
+			if ctx.Err() == nil {
+				h.ports.record(addr.Port(), err == nil)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
 			if err == nil {
 				log.Debugf("Successfully pinged WARP endpoint %s, RTT: %s", addr.String(), rtt.String())
-				results <- &WarpPingResult{AddrPort: addr, RTT: rtt, Err: nil}
+				answers = append(answers, statute.PortResult{Port: addr.Port(), RTT: rtt})
 			} else {
 				log.Debugw("Failed to ping WARP endpoint", zap.String("address", addr.String()), zap.Error(err))
 				if h.opts != nil && h.opts.EventsHandler != nil {
 					h.opts.EventsHandler.IncrementFailure(addr.String())
 				}
-				results <- h.errorResult(err)
+				lastErr = err
 			}
 		}(addr)
 	}
 
 	wg.Wait()
-	close(results)
 
-	var lastErr error
-	for res := range results {
-		if res.Error() == nil {
-			return res
+	if len(answers) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no ports to probe")
 		}
-		lastErr = res.Error()
+		return h.errorResult(lastErr)
 	}
 
-	return h.errorResult(lastErr)
+	sortPortResults(answers)
+	best := netip.AddrPortFrom(h.IP, answers[0].Port)
+	samples, sent := h.sample(ctx, best, answers[0].RTT)
+	return &WarpPingResult{
+		AddrPort: best,
+		RTT:      answers[0].RTT,
+		Ports:    answers,
+		Samples:  samples,
+		Sent:     sent,
+		Weights:  h.opts.ScoreWeights,
+	}
 }
 
-func (h *WarpPing) errorResult(err error) *WarpPingResult {
-	r := &WarpPingResult{}
-	r.Err = err
-	return r
-}
+// sample measures addr until opts.Samples handshakes, including the first
+// one that took rtt, have been sent, and returns the RTTs of those answered.
+func (h *WarpPing) sample(ctx context.Context, addr netip.AddrPort, rtt time.Duration) ([]time.Duration, int) {
+	samples, sent := []time.Duration{rtt}, 1
+	for sent < h.opts.Samples {
+		select {
+		case <-time.After(sampleInterval):
+		case <-ctx.Done():
+			return samples, sent
+		}
+		if err := h.wait(ctx); err != nil {
+			return samples, sent
+		}
 
-func staticKeypair(privateKeyBase64 string) (noise.DHKey, error) {
-	privateKey, err := base64.StdEncoding.DecodeString(privateKeyBase64)
-	if err != nil {
-		return noise.DHKey{}, err
+		rtt, err := h.handshake(ctx, addr)
+		if ctx.Err() != nil {
+			return samples, sent
+		}
+		sent++
+		if err != nil {
+			log.Debugw("Sample lost", zap.String("address", addr.String()), zap.Error(err))
+			continue
+		}
+		samples = append(samples, rtt)
 	}
-
-	var pubkey, privkey [32]byte
-	copy(privkey[:], privateKey)
-	curve25519.ScalarBaseMult(&pubkey, &privkey)
-
-	return noise.DHKey{
-		Private: privateKey,
-		Public:  pubkey[:],
-	}, nil
+	return samples, sent
 }
 
-func ephemeralKeypair() (noise.DHKey, error) {
-	// Generate an ephemeral private key
-	ephemeralPrivateKey := make([]byte, 32)
-	if _, err := rand.Read(ephemeralPrivateKey); err != nil {
-		return noise.DHKey{}, err
-	}
-
-	// Derive the corresponding ephemeral public key
-	ephemeralPublicKey, err := curve25519.X25519(ephemeralPrivateKey, curve25519.Basepoint)
-	if err != nil {
-		return noise.DHKey{}, err
+// wait blocks until the rate limit allows another handshake. The limit counts
+// handshakes, not packets: the junk sent before one is not charged.
+func (h *WarpPing) wait(ctx context.Context) error {
+	if h.limiter == nil {
+		return nil
 	}
+	return h.limiter.Wait(ctx)
+}
 
-	return noise.DHKey{
-		Private: ephemeralPrivateKey,
-		Public:  ephemeralPublicKey,
-	}, nil
+func (h *WarpPing) errorResult(err error) *WarpPingResult {
+	r := &WarpPingResult{}
+	r.Err = err
+	return r
 }
 
-func generateObfuscationHeader() ([]byte, error) {
-	clist := []byte{0xDC, 0xDE, 0xD3, 0xD9, 0xD0, 0xEC, 0xEE, 0xE3}
-	firstByteIndex, err := utils.RandomInt(0, uint64(len(clist)-1))
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate random byte for header: %w", err)
-	}
-	header := []byte{
-		clist[firstByteIndex],
-		0x00, 0x00, 0x00, 0x01, 0x08,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x44, 0xD0,
-	}
-	_, err = rand.Read(header[6:14])
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate random part of header: %w", err)
-	}
-	return header, nil
+// SendRandomPackets writes the profile's junk packets to conn: a header picked
+// from the profile's templates followed by random padding. Nothing is sent
+// when the profile is nil or disabled.
+func SendRandomPackets(ctx context.Context, conn net.Conn, profile *statute.ObfuscationProfile) error {
+	return sendJunk(ctx, profile, func(packet []byte) error {
+		_, err := conn.Write(packet)
+		return err
+	})
 }
 
-func sendRandomPackets(ctx context.Context, conn net.Conn, obfuscation bool) error {
-	if !obfuscation {
+// sendJunk generates the profile's junk packets and passes each to write.
+func sendJunk(ctx context.Context, profile *statute.ObfuscationProfile, write func([]byte) error) error {
+	if !profile.Enabled() {
 		return nil
 	}
 
-	header, err := generateObfuscationHeader()
+	headerIndex, err := utils.RandomInt(0, uint64(len(profile.Headers)-1))
 	if err != nil {
-		return fmt.Errorf("failed to generate obfuscation header: %w", err)
+		return fmt.Errorf("failed to pick obfuscation header: %w", err)
 	}
-	if header == nil {
-		return nil
+	header, err := profile.Headers[headerIndex].Generate()
+	if err != nil {
+		return fmt.Errorf("failed to generate obfuscation header: %w", err)
 	}
 
-	numPackets, err := utils.RandomInt(minRandomPackets, maxRandomPackets)
+	numPackets, err := utils.RandomInt(uint64(profile.JunkCount.Min), uint64(profile.JunkCount.Max))
 	if err != nil {
 		return fmt.Errorf("failed to generate random packet count: %w", err)
 	}
 
-	maxPacketSize := uint64(len(header)) + maxRandomPacketSize
+	maxPacketSize := uint64(len(header) + profile.JunkSize.Max)
 	randomPacket := make([]byte, maxPacketSize)
 
 	for i := uint64(0); i < numPackets; i++ {
@@ -199,7 +227,7 @@ func sendRandomPackets(ctx context.Context, conn net.Conn, obfuscation bool) err
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
-			packetSize, err := utils.RandomInt(uint64(len(header))+minRandomPacketSize, maxPacketSize)
+			packetSize, err := utils.RandomInt(uint64(len(header)+profile.JunkSize.Min), maxPacketSize)
 			if err != nil {
 				return fmt.Errorf("failed to generate random packet size: %w", err)
 			}
@@ -215,151 +243,77 @@ func sendRandomPackets(ctx context.Context, conn net.Conn, obfuscation bool) err
 			// Copy header
 			copy(randomPacket[:len(header)], header)
 
-			_, err = conn.Write(randomPacket[:packetSize])
+			err = write(randomPacket[:packetSize])
 			if err != nil {
 				return fmt.Errorf("error sending random packet: %w", err)
 			}
 
-			delay, err := utils.RandomInt(minRandomPacketDelayMs, maxRandomPacketDelayMs)
+			delay, err := utils.RandomInt(uint64(profile.JunkDelay.Min), uint64(profile.JunkDelay.Max))
 			if err != nil {
 				log.Warnw("Failed to generate random delay", zap.Error(err))
-			} else {
-				time.Sleep(time.Duration(delay) * time.Millisecond)
+			} else if err := sleep(ctx, time.Duration(delay)*time.Millisecond); err != nil {
+				return err
 			}
 		}
 	}
 	return nil
 }
 
-func initiateHandshake(ctx context.Context, serverAddr netip.AddrPort, privateKeyBase64, peerPublicKeyBase64, presharedKeyBase64 string, obfuscation bool) (time.Duration, error) {
-	staticKeyPair, err := staticKeypair(privateKeyBase64)
-	if err != nil {
-		return 0, err
-	}
-
-	peerPublicKey, err := base64.StdEncoding.DecodeString(peerPublicKeyBase64)
-	if err != nil {
-		return 0, err
-	}
+// sleep pauses for d, returning early with the context's error if ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
 
-	presharedKey, err := base64.StdEncoding.DecodeString(presharedKeyBase64)
-	if err != nil {
-		return 0, err
-	}
-
-	if presharedKeyBase64 == "" {
-		presharedKey = make([]byte, 32)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
+}
 
-	ephemeral, err := ephemeralKeypair()
-	if err != nil {
-		return 0, err
-	}
+func (h *WarpPing) handshake(ctx context.Context, addr netip.AddrPort) (time.Duration, error) {
+	if h.prober != nil {
+		return h.prober.Probe(ctx, addr)
+	}
+	return initiateHandshake(
+		ctx,
+		addr,
+		h.PrivateKey,
+		h.PeerPublicKey,
+		h.PresharedKey,
+		h.opts.Obfuscation,
+		h.opts.WarpReserved,
+	)
+}
 
-	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
-	hs, err := noise.NewHandshakeState(noise.Config{
-		CipherSuite:           cs,
-		Pattern:               noise.HandshakeIK,
-		Initiator:             true,
-		StaticKeypair:         staticKeyPair,
-		PeerStatic:            peerPublicKey,
-		Prologue:              []byte("WireGuard v1 zx2c4 Jason@zx2c4.com"),
-		PresharedKey:          presharedKey,
-		PresharedKeyPlacement: 2,
-		EphemeralKeypair:      ephemeral,
-		Random:                rand.Reader,
+// initiateHandshake performs a WireGuard handshake with serverAddr and returns
+// the time the server took to respond.
+func initiateHandshake(ctx context.Context, serverAddr netip.AddrPort, privateKeyBase64, peerPublicKeyBase64, presharedKeyBase64 string, obfuscation *statute.ObfuscationProfile, reserved []byte) (time.Duration, error) {
+	s, err := DialSession(ctx, serverAddr, SessionConfig{
+		PrivateKey:    privateKeyBase64,
+		PeerPublicKey: peerPublicKeyBase64,
+		PresharedKey:  presharedKeyBase64,
+		Obfuscation:   obfuscation,
+		Reserved:      reserved,
 	})
 	if err != nil {
 		return 0, err
 	}
+	defer s.Close()
 
-	// Prepare handshake initiation packet
-
-	// TAI64N timestamp calculation
-	now := time.Now().UTC()
-	epochOffset := int64(4611686018427387914) // TAI offset from Unix epoch
-
-	tai64nTimestampBuf := make([]byte, 0, 16)
-	tai64nTimestampBuf = binary.BigEndian.AppendUint64(tai64nTimestampBuf, uint64(epochOffset+now.Unix()))
-	tai64nTimestampBuf = binary.BigEndian.AppendUint32(tai64nTimestampBuf, uint32(now.Nanosecond()))
-	msg, _, _, err := hs.WriteMessage(nil, tai64nTimestampBuf)
-	if err != nil {
-		return 0, err
-	}
-
-	initiationPacket := new(bytes.Buffer)
-	binary.Write(initiationPacket, binary.BigEndian, []byte{0x01, 0x00, 0x00, 0x00})
-	binary.Write(initiationPacket, binary.BigEndian, utils.Uint32ToBytes(28))
-	binary.Write(initiationPacket, binary.BigEndian, msg)
-
-	macKey := blake2s.Sum256(append([]byte("mac1----"), peerPublicKey...))
-	hasher, err := blake2s.New128(macKey[:]) // using macKey as the key
-	if err != nil {
-		return 0, err
-	}
-	_, err = hasher.Write(initiationPacket.Bytes())
-	if err != nil {
-		return 0, err
-	}
-	initiationPacketMAC := hasher.Sum(nil)
-
-	// Append the MAC and 16 null bytes to the initiation packet
-	binary.Write(initiationPacket, binary.BigEndian, initiationPacketMAC[:16])
-	binary.Write(initiationPacket, binary.BigEndian, [16]byte{})
-
-	conn, err := net.Dial("udp", serverAddr.String())
-	if err != nil {
-		return 0, err
-	}
-	defer conn.Close()
-
-	if err := sendRandomPackets(ctx, conn, obfuscation); err != nil {
-		return 0, err
-	}
-
-	_, err = initiationPacket.WriteTo(conn)
-	if err != nil {
-		return 0, err
-	}
-	t0 := time.Now()
-
-	response := make([]byte, 92)
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	i, err := conn.Read(response)
-	if err != nil {
-		return 0, err
-	}
-	rtt := time.Since(t0)
-
-	if i < 60 {
-		return 0, fmt.Errorf("invalid handshake response length %d bytes", i)
-	}
-
-	// Check the response type
-	if response[0] != 2 { // 2 is the message type for response
-		return 0, errors.New("invalid response type")
-	}
-
-	// Extract sender and receiver index from the response
-	// peer index
-	_ = binary.LittleEndian.Uint32(response[4:8])
-	// our index(we set it to 28)
-	ourIndex := binary.LittleEndian.Uint32(response[8:12])
-	if ourIndex != 28 { // Check if the response corresponds to our sender index
-		return 0, errors.New("invalid sender index in response")
-	}
+	return s.RTT(), nil
+}
 
-	payload, _, _, err := hs.ReadMessage(nil, response[12:60])
+func (h *WarpPing) share(p *Ping) error {
+	prober, err := p.sharedProber()
 	if err != nil {
-		return 0, err
-	}
-
-	// Check if the payload is empty (as expected in WireGuard handshake)
-	if len(payload) != 0 {
-		return 0, errors.New("unexpected payload in response")
+		return err
 	}
-
-	return rtt, nil
+	h.limiter = p.limiter
+	h.prober = prober
+	h.ports = p.ports
+	return nil
 }
 
 func NewWarpPing(ip netip.Addr, opts *statute.ScannerOptions) *WarpPing {
@@ -0,0 +1,55 @@
+package ping
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shahradelahi/cloudflare-warp/internal/wgtest"
+	"github.com/shahradelahi/cloudflare-warp/ipscanner/model"
+)
+
+func TestWarpPingSamples(t *testing.T) {
+	privateKey, publicKey, err := wgtest.KeyPair()
+	assert.NoError(t, err)
+	peer, err := wgtest.NewPeer(publicKey, 1500)
+	assert.NoError(t, err)
+	defer peer.Close()
+
+	opts := &statute.ScannerOptions{
+		WarpPrivateKey:    privateKey,
+		WarpPeerPublicKey: peer.PublicKey,
+		PortStrategy:      statute.PortsFixed,
+		Ports:             []uint16{peer.Endpoint.Port()},
+		Samples:           3,
+		ScoreWeights:      statute.DefaultScoreWeights,
+	}
+
+	res := NewWarpPing(peer.Endpoint.Addr(), opts).PingContext(context.Background())
+	assert.NoError(t, res.Error())
+
+	info := res.Result()
+	assert.Zero(t, info.Loss)
+	assert.LessOrEqual(t, info.MinRTT, info.AvgRTT)
+	assert.LessOrEqual(t, info.AvgRTT, info.MaxRTT)
+	assert.Equal(t, info.AvgRTT+info.StdDevRTT, info.Score)
+}
+
+func TestWarpPingSharedPorts(t *testing.T) {
+	privateKey, publicKey, err := wgtest.KeyPair()
+	assert.NoError(t, err)
+
+	opts := &statute.ScannerOptions{
+		WarpPrivateKey:    privateKey,
+		WarpPeerPublicKey: publicKey,
+	}
+	p := NewPinger(opts)
+	defer p.Close()
+
+	h := NewWarpPing(netip.MustParseAddr("127.0.0.1"), opts)
+	assert.Nil(t, h.ports, "the selector is only built when the probe runs on its own")
+	assert.NoError(t, h.share(p))
+	assert.Same(t, p.ports, h.ports)
+}
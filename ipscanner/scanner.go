@@ -3,6 +3,7 @@ package ipscanner
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/netip"
 	"time"
 
@@ -14,6 +15,10 @@ import (
 	"github.com/shahradelahi/cloudflare-warp/log"
 )
 
+// ErrNotEnoughResults is returned by Run when the scan found fewer endpoints
+// than WithMinResults asked for.
+var ErrNotEnoughResults = errors.New("not enough endpoints found")
+
 type IPScanner struct {
 	options statute.ScannerOptions
 	engine  *engine.Engine
@@ -41,6 +46,10 @@ func NewScanner(options ...Option) *IPScanner {
 			MaxDesirableRTT:   400 * time.Millisecond,
 			IPQueueTTL:        30 * time.Second,
 			Cache:             c,
+			Obfuscation:       statute.DefaultObfuscationProfile(),
+			Concurrency:       engine.DefaultConcurrency,
+			Samples:           1,
+			ScoreWeights:      statute.DefaultScoreWeights,
 		},
 		ctx: context.Background(),
 	}
@@ -114,6 +123,161 @@ func WithWarpPreSharedKey(presharedKey string) Option {
 	}
 }
 
+// WithObfuscation sets the junk packets sent before each probe's handshake.
+// Passing nil disables them.
+func WithObfuscation(profile *statute.ObfuscationProfile) Option {
+	return func(i *IPScanner) {
+		i.options.Obfuscation = profile
+	}
+}
+
+// WithWarpReserved sets the reserved header bytes of handshake initiations,
+// usually the identity's decoded client_id.
+func WithWarpReserved(reserved []byte) Option {
+	return func(i *IPScanner) {
+		i.options.WarpReserved = reserved
+	}
+}
+
+// WithConcurrency sets the number of addresses probed at the same time.
+func WithConcurrency(n int) Option {
+	return func(i *IPScanner) {
+		i.options.Concurrency = n
+	}
+}
+
+// WithRate caps the handshake probes sent per second. Zero means unlimited.
+func WithRate(perSecond int) Option {
+	return func(i *IPScanner) {
+		i.options.Rate = perSecond
+	}
+}
+
+// WithPortStrategy selects the ports probed on each IP. count is the number
+// of ports used by the random and adaptive strategies.
+func WithPortStrategy(strategy statute.PortStrategy, count int) Option {
+	return func(i *IPScanner) {
+		i.options.PortStrategy = strategy
+		i.options.PortCount = count
+	}
+}
+
+// WithPorts replaces the built-in WARP ports: the fixed strategy probes all
+// of them and the random and adaptive strategies pick from them.
+func WithPorts(ports []uint16) Option {
+	return func(i *IPScanner) {
+		i.options.Ports = ports
+	}
+}
+
+// WithSamples sets the number of handshakes used to measure the RTT, jitter
+// and loss of each endpoint found.
+func WithSamples(n int) Option {
+	return func(i *IPScanner) {
+		i.options.Samples = n
+	}
+}
+
+// WithScoreWeights sets how jitter and loss penalize an endpoint's score.
+func WithScoreWeights(weights statute.ScoreWeights) Option {
+	return func(i *IPScanner) {
+		i.options.ScoreWeights = weights
+	}
+}
+
+// WithSeed sets the seed of the pseudo-random scan order, to reproduce a
+// previous scan. Zero picks a random seed.
+func WithSeed(seed uint64) Option {
+	return func(i *IPScanner) {
+		i.options.Seed = seed
+	}
+}
+
+// WithScanMode selects how probes are spent; see statute.ScanMode.
+func WithScanMode(mode statute.ScanMode) Option {
+	return func(i *IPScanner) {
+		i.options.Mode = mode
+	}
+}
+
+// WithSubnetOptions configures the subnets scan mode.
+func WithSubnetOptions(opts statute.SubnetOptions) Option {
+	return func(i *IPScanner) {
+		i.options.Subnets = opts
+	}
+}
+
+// WithCount stops the scan once n desirable endpoints were found. Zero
+// scans until the CIDRs are exhausted or the context is canceled.
+func WithCount(n int) Option {
+	return func(i *IPScanner) {
+		i.options.Count = n
+	}
+}
+
+// WithTimeout stops the scan after d. Zero means no timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(i *IPScanner) {
+		i.options.Timeout = d
+	}
+}
+
+// WithMaxProbes stops the scan after n addresses were probed. Zero means
+// unlimited.
+func WithMaxProbes(n int64) Option {
+	return func(i *IPScanner) {
+		i.options.MaxProbes = n
+	}
+}
+
+// WithMinResults makes Run fail with ErrNotEnoughResults when the scan
+// stops with fewer than n desirable endpoints.
+func WithMinResults(n int) Option {
+	return func(i *IPScanner) {
+		i.options.MinResults = n
+	}
+}
+
+// WithCheckpoint saves the progress of the scan to path periodically and
+// when it stops, and resumes from the checkpoint found there if it is for
+// the same targets.
+func WithCheckpoint(path string) Option {
+	return func(i *IPScanner) {
+		i.options.Checkpoint = path
+	}
+}
+
+// WithVerify only keeps the endpoints that carry an ICMP echo through the
+// tunnel after the handshake; see statute.VerifyOptions.
+func WithVerify(opts statute.VerifyOptions) Option {
+	return func(i *IPScanner) {
+		i.options.Verify = &opts
+	}
+}
+
+// WithExclude skips the addresses of the given prefixes.
+func WithExclude(prefixes []netip.Prefix) Option {
+	return func(i *IPScanner) {
+		i.options.Exclude = prefixes
+	}
+}
+
+// WithProbe selects the probe type by name: one of the built-in ping.Probe*
+// types or one registered with ping.RegisterProbe. Only the results of the
+// WARP probe are saved to the endpoint cache.
+func WithProbe(name string) Option {
+	return func(i *IPScanner) {
+		i.options.Probe = name
+	}
+}
+
+// WithProbeHost sets the server name of the TLS and HTTP probes.
+func WithProbeHost(host string) Option {
+	return func(i *IPScanner) {
+		i.options.ProbeHost = host
+	}
+}
+
 func WithCache(c *cache.Cache) Option {
 	return func(i *IPScanner) {
 		i.options.Cache = c
@@ -129,13 +293,23 @@ func (i *IPScanner) Run() error {
 		return nil
 	}
 
-	eng, err := engine.NewScannerEngine(i.ctx, &i.options)
+	ctx := i.ctx
+	if i.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, i.options.Timeout)
+		defer cancel()
+	}
+
+	eng, err := engine.NewScannerEngine(ctx, &i.options)
 	if err != nil {
-		return errors.New("failed to create scanner engine")
+		return fmt.Errorf("failed to create scanner engine: %w", err)
 	}
 
 	i.engine = eng
 	i.engine.Run()
+	if i.options.Timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		log.Infow("Scan timed out", zap.Duration("timeout", i.options.Timeout))
+	}
 
 	if i.options.Cache != nil {
 		// Save the cache to a file
@@ -144,6 +318,9 @@ func (i *IPScanner) Run() error {
 		}
 	}
 
+	if found := len(i.GetAvailableIPs()); found < i.options.MinResults {
+		return fmt.Errorf("%w: %d of %d", ErrNotEnoughResults, found, i.options.MinResults)
+	}
 	return nil
 }
 
@@ -160,4 +337,13 @@ func (i *IPScanner) GetAvailableIPs() []statute.IPInfo {
 	return nil
 }
 
+// GetSubnetStats returns the per-subnet results of the subnets scan mode, best
+// first.
+func (i *IPScanner) GetSubnetStats() []statute.SubnetStats {
+	if i.engine != nil {
+		return i.engine.SubnetStats()
+	}
+	return nil
+}
+
 type IPInfo = statute.IPInfo